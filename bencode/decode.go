@@ -0,0 +1,478 @@
+// Package bencode encodes and decodes the bencoding BitTorrent uses for
+// torrent files, tracker responses and peer wire extensions.
+//
+// It maps to Go values the way encoding/json does: dicts to structs (using
+// `bencode:"key,omitempty"` tags) or maps with string keys, lists to slices
+// and arrays, strings to string, []byte and [N]byte, and integers to the int,
+// uint and bool kinds. RawMessage holds on to a value's exact bytes so it can
+// be decoded later or hashed, which is how the info hash is taken.
+//
+// A Decoder reads one value at a time from a stream. Limits protect against
+// hostile input and strict mode rejects anything that isn't canonical.
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Unmarshaler is implemented by types that decode themselves, they get the
+// raw bytes of exactly one value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// RawMessage is an encoded value kept as is. It can be used to put off
+// decoding part of a message, or to get at the exact bytes of it.
+type RawMessage []byte
+
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, errors.New("bencode: empty RawMessage")
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+// UnmarshalTypeError is a value that doesn't fit the Go type it's decoded into
+type UnmarshalTypeError struct {
+	Value  string // "integer", "string", "list" or "dict"
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// InvalidUnmarshalError is returned when Decode isn't given a non nil pointer
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	if e.Type.Kind() != reflect.Ptr {
+		return "bencode: Unmarshal(non-pointer " + e.Type.String() + ")"
+	}
+	return "bencode: Unmarshal(nil " + e.Type.String() + ")"
+}
+
+// Unmarshal decodes the first value in data into v. It's lenient: anything
+// after the value is ignored and non canonical input is accepted.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetLimits(Limits{MaxDepth: DefaultLimits.MaxDepth})
+	err := d.Decode(v)
+	if err == io.EOF {
+		return &SyntaxError{msg: "unexpected end of input", Offset: 0}
+	}
+	return err
+}
+
+// UnmarshalStrict is Unmarshal for input that has to be canonical: integers
+// and lengths without leading zeros, dict keys sorted and unique, and nothing
+// following the value.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetLimits(Limits{MaxDepth: DefaultLimits.MaxDepth})
+	d.SetStrict(true)
+	err := d.Decode(v)
+	if err == io.EOF {
+		return &SyntaxError{msg: "unexpected end of input", Offset: 0}
+	}
+	if err != nil {
+		return err
+	}
+	if d.InputOffset() != int64(len(data)) {
+		return &SyntaxError{msg: "trailing data after value", Offset: d.InputOffset()}
+	}
+	return nil
+}
+
+// Valid reports whether data is exactly one well formed value
+func Valid(data []byte) bool {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetLimits(Limits{MaxDepth: DefaultLimits.MaxDepth})
+	_, err := d.s.next()
+	return err == nil && d.InputOffset() == int64(len(data))
+}
+
+// Decoder reads values one after another off a stream
+type Decoder struct {
+	s scanner
+}
+
+// NewDecoder reads from r using DefaultLimits. It may read past the end of
+// the value it's asked for.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{s: scanner{r: bufio.NewReader(r), limits: DefaultLimits}}
+}
+
+// SetLimits changes the limits for values decoded from now on
+func (d *Decoder) SetLimits(l Limits) {
+	d.s.limits = l
+}
+
+// SetStrict makes the decoder reject input that isn't canonical
+func (d *Decoder) SetStrict(strict bool) {
+	d.s.strict = strict
+}
+
+// InputOffset is how many bytes of the stream have been decoded
+func (d *Decoder) InputOffset() int64 {
+	return d.s.offset
+}
+
+// Decode reads the next value into v. At the end of the stream it returns
+// io.EOF.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	raw, err := d.s.next()
+	if err != nil {
+		return err
+	}
+	ds := &decodeState{data: raw, base: d.s.start}
+	ds.value(rv)
+	return ds.savedError
+}
+
+// decodeState walks a value the scanner has already checked, so it doesn't
+// need to worry about malformed input.
+type decodeState struct {
+	data       []byte
+	off        int
+	base       int64 // offset of data in the stream
+	savedError error
+}
+
+// typeError notes the first mismatch but carries on, the way encoding/json does
+func (d *decodeState) typeError(what string, t reflect.Type, at int) {
+	if d.savedError == nil {
+		d.savedError = &UnmarshalTypeError{Value: what, Type: t, Offset: d.base + int64(at)}
+	}
+}
+
+func (d *decodeState) value(v reflect.Value) {
+	start := d.off
+	u, v := indirect(v)
+	if u != nil {
+		d.skip()
+		if err := u.UnmarshalBencode(d.data[start:d.off]); err != nil && d.savedError == nil {
+			d.savedError = err
+		}
+		return
+	}
+	switch d.data[d.off] {
+	case 'i':
+		d.integer(v)
+	case 'l':
+		d.list(v)
+	case 'd':
+		d.dict(v)
+	default:
+		d.str(v)
+	}
+}
+
+// indirect follows and allocates pointers until it reaches a value, stopping
+// early at anything that decodes itself.
+func indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
+	if v.Kind() != reflect.Ptr && v.Type().Name() != "" && v.CanAddr() {
+		v = v.Addr()
+	}
+	for {
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			if e := v.Elem(); e.Kind() == reflect.Ptr && !e.IsNil() {
+				v = e
+				continue
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().NumMethod() > 0 {
+			if u, ok := v.Interface().(Unmarshaler); ok {
+				return u, reflect.Value{}
+			}
+		}
+		v = v.Elem()
+	}
+	return nil, v
+}
+
+// skip moves past the value at d.off
+func (d *decodeState) skip() {
+	switch d.data[d.off] {
+	case 'i':
+		d.off += bytes.IndexByte(d.data[d.off:], 'e') + 1
+	case 'l', 'd':
+		d.off++
+		for d.data[d.off] != 'e' {
+			d.skip()
+		}
+		d.off++
+	default:
+		d.rawString()
+	}
+}
+
+func (d *decodeState) rawString() []byte {
+	colon := d.off + bytes.IndexByte(d.data[d.off:], ':')
+	n, _ := strconv.Atoi(string(d.data[d.off:colon]))
+	d.off = colon + 1 + n
+	return d.data[colon+1 : d.off]
+}
+
+func (d *decodeState) rawInteger() string {
+	end := d.off + bytes.IndexByte(d.data[d.off:], 'e')
+	s := string(d.data[d.off+1 : end])
+	d.off = end + 1
+	return s
+}
+
+func (d *decodeState) integer(v reflect.Value) {
+	start := d.off
+	s := d.rawInteger()
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			d.typeError("integer "+s, v.Type(), start)
+			return
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			d.typeError("integer "+s, v.Type(), start)
+			return
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		v.SetBool(s != "0")
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("integer", v.Type(), start)
+			return
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			d.typeError("integer "+s, v.Type(), start)
+			return
+		}
+		v.Set(reflect.ValueOf(n))
+	default:
+		d.typeError("integer", v.Type(), start)
+	}
+}
+
+func (d *decodeState) str(v reflect.Value) {
+	start := d.off
+	b := d.rawString()
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			d.typeError("string", v.Type(), start)
+			return
+		}
+		v.SetBytes(append([]byte(nil), b...))
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(b) {
+			d.typeError("string", v.Type(), start)
+			return
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("string", v.Type(), start)
+			return
+		}
+		v.Set(reflect.ValueOf(string(b)))
+	default:
+		d.typeError("string", v.Type(), start)
+	}
+}
+
+func (d *decodeState) list(v reflect.Value) {
+	start := d.off
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			v.Set(reflect.ValueOf(d.listInterface()))
+			return
+		}
+		d.typeError("list", v.Type(), start)
+		d.skip()
+		return
+	case reflect.Slice, reflect.Array:
+	default:
+		d.typeError("list", v.Type(), start)
+		d.skip()
+		return
+	}
+
+	d.off++ // 'l'
+	i := 0
+	for ; d.data[d.off] != 'e'; i++ {
+		if v.Kind() == reflect.Slice {
+			if i >= v.Cap() {
+				grown := reflect.MakeSlice(v.Type(), v.Len(), v.Cap()+v.Cap()/2+4)
+				reflect.Copy(grown, v)
+				v.Set(grown)
+			}
+			if i >= v.Len() {
+				v.SetLen(i + 1)
+			}
+		}
+		if i < v.Len() {
+			d.value(v.Index(i))
+		} else {
+			d.skip() // past the end of an array
+		}
+	}
+	d.off++
+
+	switch {
+	case v.Kind() == reflect.Array:
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	case i == 0 && v.IsNil():
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	default:
+		v.SetLen(i)
+	}
+}
+
+func (d *decodeState) dict(v reflect.Value) {
+	start := d.off
+	var fields []field
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			v.Set(reflect.ValueOf(d.dictInterface()))
+			return
+		}
+		d.typeError("dict", v.Type(), start)
+		d.skip()
+		return
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			d.typeError("dict", v.Type(), start)
+			d.skip()
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fields = cachedFields(v.Type())
+	default:
+		d.typeError("dict", v.Type(), start)
+		d.skip()
+		return
+	}
+
+	d.off++ // 'd'
+	for d.data[d.off] != 'e' {
+		key := string(d.rawString())
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			d.value(elem)
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			continue
+		}
+		f := fieldByName(fields, key)
+		if f == nil {
+			d.skip()
+			continue
+		}
+		fv := fieldByIndex(v, f.index)
+		if !fv.IsValid() {
+			d.skip()
+			continue
+		}
+		d.value(fv)
+	}
+	d.off++
+}
+
+// fieldByIndex is reflect's FieldByIndex but it allocates nil embedded
+// pointers on the way, it returns an invalid Value if it can't.
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// valueInterface decodes into int64, string, []interface{} and
+// map[string]interface{}
+func (d *decodeState) valueInterface() interface{} {
+	switch d.data[d.off] {
+	case 'i':
+		start := d.off
+		s := d.rawInteger()
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			d.typeError("integer "+s, reflect.TypeOf(n), start)
+		}
+		return n
+	case 'l':
+		return d.listInterface()
+	case 'd':
+		return d.dictInterface()
+	default:
+		return string(d.rawString())
+	}
+}
+
+func (d *decodeState) listInterface() []interface{} {
+	list := []interface{}{}
+	d.off++
+	for d.data[d.off] != 'e' {
+		list = append(list, d.valueInterface())
+	}
+	d.off++
+	return list
+}
+
+func (d *decodeState) dictInterface() map[string]interface{} {
+	dict := make(map[string]interface{})
+	d.off++
+	for d.data[d.off] != 'e' {
+		key := string(d.rawString())
+		dict[key] = d.valueInterface()
+	}
+	d.off++
+	return dict
+}
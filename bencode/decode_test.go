@@ -0,0 +1,220 @@
+package bencode
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"`
+	Hash        [4]byte    `bencode:"hash"`
+}
+
+type testTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+	Skipped  string     `bencode:"-"`
+	Comment  string
+}
+
+func Test_Unmarshal(t *testing.T) {
+	var info testInfo
+	data := "d5:filesld6:lengthi3e4:pathl1:a1:beee4:hash4:abcd4:name4:test12:piece lengthi16384e7:privatei1e7:unknownli1eee"
+	if err := Unmarshal([]byte(data), &info); err != nil {
+		t.Fatal(err)
+	}
+	expected := testInfo{
+		Name:        "test",
+		PieceLength: 16384,
+		Files:       []testFile{{Length: 3, Path: []string{"a", "b"}}},
+		Private:     true,
+		Hash:        [4]byte{'a', 'b', 'c', 'd'},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("got %+v; want %+v", info, expected)
+	}
+}
+
+func Test_UnmarshalRawMessage(t *testing.T) {
+	rawInfo := "d4:name1:x1:ai01ee" // not canonical, has to come through untouched
+	data := "d8:announce4:http7:comment2:hi4:info" + rawInfo + "7:Skipped1:xe"
+	var tor testTorrent
+	if err := Unmarshal([]byte(data), &tor); err != nil {
+		t.Fatal(err)
+	}
+	if string(tor.Info) != rawInfo {
+		t.Errorf("got raw %q; want %q", tor.Info, rawInfo)
+	}
+	if tor.Announce != "http" || tor.Comment != "hi" || tor.Skipped != "" {
+		t.Errorf("got %+v", tor)
+	}
+
+	var keys map[string]RawMessage
+	if err := Unmarshal(tor.Info, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if string(keys["a"]) != "i01e" || string(keys["name"]) != "1:x" {
+		t.Errorf("got %q", keys)
+	}
+}
+
+func Test_UnmarshalInterface(t *testing.T) {
+	var v interface{}
+	if err := Unmarshal([]byte("d1:ali1ei-2e0:e1:bd1:c1:dee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": []interface{}{int64(1), int64(-2), ""},
+		"b": map[string]interface{}{"c": "d"},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("got %#v; want %#v", v, expected)
+	}
+}
+
+func Test_UnmarshalErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   string
+		v      interface{}
+		err    string
+		strict bool
+	}{
+		{"empty", "", new(interface{}), "unexpected end of input at offset 0", false},
+		{"truncated string", "5:abc", new(string), "unexpected end of input at offset 5", false},
+		{"truncated dict", "d1:ai1e", new(interface{}), "unexpected end of input at offset 7", false},
+		{"bad integer", "i1x2e", new(int), "invalid character 'x' in integer at offset 2", false},
+		{"empty integer", "ie", new(int), "integer has no digits at offset 1", false},
+		{"non string key", "di1ei2ee", new(interface{}), "dict key must be a string, found 'i' at offset 1", false},
+		{"bad value", "x", new(interface{}), "invalid character 'x' looking for a value at offset 0", false},
+		{"wrong type", "d4:name4:teste", new(int), "cannot decode dict into Go value of type int at offset 0", false},
+		{"wrong nested type", "d12:piece length3:abce", new(testInfo), "cannot decode string into Go value of type int64 at offset 16", false},
+		{"overflow", "i300e", new(int8), "cannot decode integer 300 into Go value of type int8 at offset 0", false},
+		{"negative unsigned", "i-1e", new(uint), "cannot decode integer -1 into Go value of type uint at offset 0", false},
+		{"not a pointer", "i1e", 1, "Unmarshal(non-pointer int)", false},
+		{"leading zero", "d1:ai01ee", new(interface{}), "leading zero in integer at offset 5", true},
+		{"negative zero", "i-0e", new(int), "negative zero or leading zero in integer at offset 1", true},
+		{"leading zero length", "01:a", new(string), "leading zero in string length at offset 0", true},
+		{"unsorted keys", "d1:bi1e1:ai2ee", new(interface{}), "dict key \"a\" out of order at offset 7", true},
+		{"duplicate keys", "d1:ai1e1:ai2ee", new(interface{}), "duplicate dict key \"a\" at offset 7", true},
+		{"trailing data", "i1ei2e", new(int), "trailing data after value at offset 3", true},
+		{"overflowing length", "18446744073709551615:", new(interface{}), "string length too long at offset 0", false},
+		{"overflowing dict key", "d18446744073709551615:e", new(interface{}), "string length too long at offset 1", false},
+		{"overflowing dict value", "d1:a18446744073709551615:e", new(interface{}), "string length too long at offset 4", false},
+		{"overflowing list item", "l18446744073709551615:ee", new(interface{}), "string length too long at offset 1", false},
+		{"too many length digits", "00000000000000000001:a", new(interface{}), "string length too long at offset 0", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+			if tc.strict {
+				err = UnmarshalStrict([]byte(tc.data), tc.v)
+			} else {
+				err = Unmarshal([]byte(tc.data), tc.v)
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), tc.err) {
+				t.Errorf("got %v; want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_UnmarshalStrictAcceptsCanonical(t *testing.T) {
+	var v interface{}
+	if err := UnmarshalStrict([]byte("d0:i0e1:ai-10e1:bl0:ee"), &v); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_DecoderLimits(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   string
+		limits Limits
+		err    string
+	}{
+		{"long string", "10:abcdefghij", Limits{MaxStringLength: 5}, "string longer than 5 bytes at offset 0"},
+		{"huge claimed string", "99999999999:a", Limits{MaxSize: 1 << 10}, "value larger than 1024 bytes at offset 0"},
+		{"big value", "l3:abc3:defe", Limits{MaxSize: 8}, "value larger than 8 bytes at offset 6"},
+		{"deep", "llllleeeee", Limits{MaxDepth: 4}, "nested deeper than 4 at offset 4"},
+		{"long integer", "i123456789012345678901234e", Limits{}, "integer too long at offset 1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tc.data))
+			d.SetLimits(tc.limits)
+			var v interface{}
+			err := d.Decode(&v)
+			if err == nil || !strings.HasSuffix(err.Error(), tc.err) {
+				t.Errorf("got %v; want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_DecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:abcd1:xi2eeli1ee"))
+	var got []interface{}
+	for {
+		var v interface{}
+		err := d.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	expected := []interface{}{int64(1), "abc", map[string]interface{}{"x": int64(2)}, []interface{}{int64(1)}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v; want %#v", got, expected)
+	}
+	if d.InputOffset() != 21 {
+		t.Errorf("got offset %d; want 21", d.InputOffset())
+	}
+}
+
+type embedded struct {
+	Inner string `bencode:"inner"`
+	Outer string `bencode:"outer"`
+}
+
+type Extra struct {
+	Length int64 `bencode:"length"`
+}
+
+type embedding struct {
+	embedded
+	*Extra
+	Outer  string   `bencode:"outer"`
+	Nested embedded `bencode:"nested"`
+}
+
+func Test_Embedded(t *testing.T) {
+	data := "d5:inner1:a6:lengthi7e6:nestedd5:inner1:be5:outer1:ce"
+	var v embedding
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Inner != "a" || v.Outer != "c" || v.embedded.Outer != "" || v.Nested.Inner != "b" || v.Extra == nil || v.Length != 7 {
+		t.Errorf("got %+v", v)
+	}
+	out, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "d5:inner1:a6:lengthi7e6:nestedd5:inner1:b5:outer0:e5:outer1:ce" {
+		t.Errorf("got %s", out)
+	}
+}
@@ -0,0 +1,258 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Marshaler is implemented by types that encode themselves, they have to
+// return exactly one valid value.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// UnsupportedTypeError is a Go type bencode has no way to represent, floats
+// for example.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// UnsupportedValueError is a value that can't be encoded, like a nil pointer
+type UnsupportedValueError struct {
+	Str string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
+// MarshalerError wraps an error from a Marshaler
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "bencode: error calling MarshalBencode for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+// Marshal returns the canonical encoding of v: dict keys are sorted, struct
+// fields are named by their tags, nil pointers and interfaces in dicts are
+// left out, and bools become 0 or 1.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encodeState{}
+	if err := e.value(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// Encoder writes values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the encoding of v, nothing is written if it can't be encoded
+func (enc *Encoder) Encode(v interface{}) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = enc.w.Write(b)
+	return err
+}
+
+type encodeState struct {
+	bytes.Buffer
+	scratch [64]byte
+}
+
+func (e *encodeState) value(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedValueError{Str: "nil"}
+	}
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return &UnsupportedValueError{Str: "nil " + v.Type().String()}
+		}
+		return e.marshaler(v.Interface().(Marshaler), v.Type())
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && reflect.PtrTo(v.Type()).Implements(marshalerType) {
+		return e.marshaler(v.Addr().Interface().(Marshaler), v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		e.str(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			e.WriteString("i1e")
+		} else {
+			e.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.WriteByte('i')
+		e.Write(strconv.AppendInt(e.scratch[:0], v.Int(), 10))
+		e.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.WriteByte('i')
+		e.Write(strconv.AppendUint(e.scratch[:0], v.Uint(), 10))
+		e.WriteByte('e')
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.bytes(v.Bytes())
+			return nil
+		}
+		return e.list(v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.bytes(b)
+			return nil
+		}
+		return e.list(v)
+	case reflect.Map:
+		return e.dict(v)
+	case reflect.Struct:
+		return e.structDict(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedValueError{Str: "nil " + v.Type().String()}
+		}
+		return e.value(v.Elem())
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func (e *encodeState) marshaler(m Marshaler, t reflect.Type) error {
+	b, err := m.MarshalBencode()
+	if err != nil {
+		return &MarshalerError{Type: t, Err: err}
+	}
+	if !Valid(b) {
+		return &MarshalerError{Type: t, Err: fmt.Errorf("invalid value %q", b)}
+	}
+	e.Write(b)
+	return nil
+}
+
+func (e *encodeState) str(s string) {
+	e.Write(strconv.AppendInt(e.scratch[:0], int64(len(s)), 10))
+	e.WriteByte(':')
+	e.WriteString(s)
+}
+
+func (e *encodeState) bytes(b []byte) {
+	e.Write(strconv.AppendInt(e.scratch[:0], int64(len(b)), 10))
+	e.WriteByte(':')
+	e.Write(b)
+}
+
+func (e *encodeState) list(v reflect.Value) error {
+	e.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := e.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) dict(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	e.WriteByte('d')
+	for _, k := range keys {
+		elem := v.MapIndex(k)
+		if isNil(elem) {
+			continue
+		}
+		e.str(k.String())
+		if err := e.value(elem); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) structDict(v reflect.Value) error {
+	e.WriteByte('d')
+	for _, f := range cachedFields(v.Type()) {
+		fv, ok := fieldForEncode(v, f.index)
+		if !ok || isNil(fv) || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		e.str(f.name)
+		if err := e.value(fv); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+// fieldForEncode follows index, giving up at nil embedded pointers
+func fieldForEncode(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isNil is true for values that have nothing to encode, they're left out of
+// dicts since bencode has no null.
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Type() == rawMessageType && v.Len() == 0
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
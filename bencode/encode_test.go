@@ -0,0 +1,99 @@
+package bencode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalBencode() ([]byte, error) {
+	return []byte("i1"), nil
+}
+
+func Test_Marshal(t *testing.T) {
+	num := 5
+	cases := []struct {
+		name     string
+		v        interface{}
+		expected string
+	}{
+		{"string", "spam", "4:spam"},
+		{"bytes", []byte("ab"), "2:ab"},
+		{"byte array", [3]byte{'a', 'b', 'c'}, "3:abc"},
+		{"int", -42, "i-42e"},
+		{"uint", uint64(1 << 63), "i9223372036854775808e"},
+		{"bool", true, "i1e"},
+		{"pointer", &num, "i5e"},
+		{"list", []interface{}{"a", int64(1), []string{}}, "l1:ai1elee"},
+		{"map sorted", map[string]int{"b": 2, "a": 1, "": 0}, "d0:i0e1:ai1e1:bi2ee"},
+		{"map skips nil", map[string]interface{}{"a": nil, "b": 1}, "d1:bi1ee"},
+		{"struct", testInfo{Name: "x", PieceLength: 1}, "d4:hash4:\x00\x00\x00\x004:name1:x12:piece lengthi1ee"},
+		{"struct with everything", testInfo{
+			Name:    "x",
+			Files:   []testFile{{Length: 1, Path: []string{"a"}}},
+			Private: true,
+			Hash:    [4]byte{'1', '2', '3', '4'},
+		}, "d5:filesld6:lengthi1e4:pathl1:aeee4:hash4:12344:name1:x12:piece lengthi0e7:privatei1ee"},
+		{"raw message", testTorrent{Announce: "a", Info: RawMessage("d1:xi01ee")}, "d7:Comment0:8:announce1:a4:infod1:xi01eee"},
+		{"empty raw message left out", testTorrent{Announce: "a"}, "d7:Comment0:8:announce1:ae"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Marshal(tc.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.expected {
+				t.Errorf("got %q; want %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func Test_MarshalErrors(t *testing.T) {
+	var nilPtr *int
+	cases := []struct {
+		name string
+		v    interface{}
+		err  string
+	}{
+		{"float", 1.5, "unsupported type: float64"},
+		{"nil", nil, "unsupported value: nil"},
+		{"nil pointer", nilPtr, "unsupported value: nil *int"},
+		{"int keys", map[int]int{1: 1}, "unsupported type: map[int]int"},
+		{"bad marshaler", []interface{}{badMarshaler{}}, "error calling MarshalBencode for type bencode.badMarshaler"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Marshal(tc.v)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v; want %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_RoundTrip(t *testing.T) {
+	in := testInfo{
+		Name:        "round",
+		PieceLength: 262144,
+		Files:       []testFile{{Length: 10, Path: []string{"dir", "file"}}, {Length: 0, Path: []string{"empty"}}},
+	}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	var out testInfo
+	if err := UnmarshalStrict(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again) {
+		t.Errorf("got %q; want %q", again, buf.Bytes())
+	}
+}
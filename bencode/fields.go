@@ -0,0 +1,121 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// field is a struct field that's encoded as a dict entry
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the fields of struct type t sorted by their key, which
+// is the order they're encoded in.
+func cachedFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields works out the keys for t's fields from their tags:
+//
+//	Field int `bencode:"key"`           // "key"
+//	Field int `bencode:"key,omitempty"` // "key", left out if zero
+//	Field int `bencode:"-"`             // never encoded or decoded
+//	Field int                           // "Field"
+//
+// Untagged embedded structs have their fields promoted the same way
+// encoding/json does it, a tagged one is encoded as a dict under its key.
+// Where names collide the shallowest field wins.
+func typeFields(t reflect.Type) []field {
+	var fields []field
+	seen := make(map[string]bool)
+
+	type queued struct {
+		typ   reflect.Type
+		index []int
+	}
+	current := []queued{{typ: t}}
+	visited := make(map[reflect.Type]bool)
+	for len(current) > 0 {
+		var next []queued
+		atDepth := make(map[string]bool)
+		for _, q := range current {
+			if visited[q.typ] {
+				continue
+			}
+			visited[q.typ] = true
+			for i := 0; i < q.typ.NumField(); i++ {
+				sf := q.typ.Field(i)
+				tag := sf.Tag.Get("bencode")
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := append(append([]int(nil), q.index...), i)
+
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, queued{typ: ft, index: index})
+					continue
+				}
+				if sf.PkgPath != "" { // unexported
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				if seen[name] || atDepth[name] {
+					continue
+				}
+				atDepth[name] = true
+				fields = append(fields, field{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+				})
+			}
+		}
+		for name := range atDepth {
+			seen[name] = true
+		}
+		current = next
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields
+}
+
+func parseTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+// fieldByName finds the field for a dict key, an exact match is preferred but
+// like encoding/json it falls back to ignoring case.
+func fieldByName(fields []field, key string) *field {
+	i := sort.Search(len(fields), func(i int) bool { return fields[i].name >= key })
+	if i < len(fields) && fields[i].name == key {
+		return &fields[i]
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
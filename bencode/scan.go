@@ -0,0 +1,280 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Limits bound what a Decoder will accept, they matter most for data coming
+// off the network. Zero means no limit.
+type Limits struct {
+	MaxSize         int64 // bytes in a single value, including everything nested in it
+	MaxStringLength int64
+	MaxDepth        int // lists and dicts nested inside each other
+}
+
+// DefaultLimits are generous enough for any real torrent file
+var DefaultLimits = Limits{
+	MaxSize:         64 << 20,
+	MaxStringLength: 32 << 20,
+	MaxDepth:        64,
+}
+
+// maxIntLength is long enough for any int64 and a sign
+const maxIntLength = 20
+
+// maxLengthDigits is long enough for any string length that fits an int64
+const maxLengthDigits = 19
+
+// SyntaxError is malformed or, in strict mode, non canonical input
+type SyntaxError struct {
+	msg    string
+	Offset int64 // byte offset in the input the problem was found at
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// scanner reads exactly one value off r, checking it as it goes, and keeps
+// the bytes it read.
+type scanner struct {
+	r      *bufio.Reader
+	offset int64 // offset in the whole stream
+	start  int64 // where the current value started
+	buf    []byte
+	strict bool
+	limits Limits
+}
+
+func (s *scanner) error(format string, args ...interface{}) error {
+	return s.errorAt(s.offset, format, args...)
+}
+
+func (s *scanner) errorAt(offset int64, format string, args ...interface{}) error {
+	return &SyntaxError{msg: fmt.Sprintf(format, args...), Offset: offset}
+}
+
+func (s *scanner) readByte() (byte, error) {
+	c, err := s.r.ReadByte()
+	if err == io.EOF {
+		return 0, s.error("unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := s.grow(1); err != nil {
+		return 0, err
+	}
+	s.buf = append(s.buf, c)
+	s.offset++
+	return c, nil
+}
+
+func (s *scanner) peekByte() (byte, error) {
+	b, err := s.r.Peek(1)
+	if err == io.EOF {
+		return 0, s.error("unexpected end of input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// grow checks that n more bytes keep the value under MaxSize
+func (s *scanner) grow(n int64) error {
+	if s.limits.MaxSize > 0 && int64(len(s.buf))+n > s.limits.MaxSize {
+		return s.error("value larger than %d bytes", s.limits.MaxSize)
+	}
+	return nil
+}
+
+// next reads the next whole value. It returns io.EOF if the input ends
+// cleanly before the value starts.
+func (s *scanner) next() ([]byte, error) {
+	s.buf = nil
+	s.start = s.offset
+	if _, err := s.r.Peek(1); err != nil {
+		return nil, err
+	}
+	if err := s.value(0); err != nil {
+		return nil, err
+	}
+	return s.buf, nil
+}
+
+func (s *scanner) value(depth int) error {
+	c, err := s.peekByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		if _, err := s.readByte(); err != nil {
+			return err
+		}
+		return s.integer()
+	case c >= '0' && c <= '9':
+		_, err := s.str()
+		return err
+	case c == 'l':
+		return s.list(depth + 1)
+	case c == 'd':
+		return s.dict(depth + 1)
+	default:
+		return s.error("invalid character %q looking for a value", c)
+	}
+}
+
+// integer reads the rest of an integer after the 'i'
+func (s *scanner) integer() error {
+	begin := len(s.buf)
+	digitsAt := s.offset
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		if len(s.buf)-begin > maxIntLength {
+			return s.errorAt(digitsAt, "integer too long")
+		}
+		if c == '-' && len(s.buf)-begin == 1 {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return s.errorAt(s.offset-1, "invalid character %q in integer", c)
+		}
+	}
+	digits := s.buf[begin : len(s.buf)-1]
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if s.strict && len(digits) > 0 && digits[0] == '0' {
+			return s.errorAt(digitsAt, "negative zero or leading zero in integer")
+		}
+	}
+	if len(digits) == 0 {
+		return s.errorAt(digitsAt, "integer has no digits")
+	}
+	if s.strict && len(digits) > 1 && digits[0] == '0' {
+		return s.errorAt(digitsAt, "leading zero in integer")
+	}
+	return nil
+}
+
+// str reads a whole string and returns its contents
+func (s *scanner) str() ([]byte, error) {
+	begin := len(s.buf)
+	lengthAt := s.offset
+	var length int64
+	for {
+		c, err := s.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return nil, s.errorAt(s.offset-1, "invalid character %q in string length", c)
+		}
+		// the byte just read is in buf too
+		if len(s.buf)-begin > maxLengthDigits || length > (math.MaxInt64-9)/10 {
+			return nil, s.errorAt(lengthAt, "string length too long")
+		}
+		length = length*10 + int64(c-'0')
+	}
+	if len(s.buf)-begin == 1 {
+		return nil, s.errorAt(lengthAt, "string has no length")
+	}
+	if s.strict && s.buf[begin] == '0' && len(s.buf)-begin > 2 {
+		return nil, s.errorAt(lengthAt, "leading zero in string length")
+	}
+	if s.limits.MaxStringLength > 0 && length > s.limits.MaxStringLength {
+		return nil, s.errorAt(lengthAt, "string longer than %d bytes", s.limits.MaxStringLength)
+	}
+	if s.grow(length) != nil {
+		return nil, s.errorAt(lengthAt, "value larger than %d bytes", s.limits.MaxSize)
+	}
+	// don't trust the length enough to allocate it all up front
+	b := bytes.NewBuffer(s.buf)
+	n, err := io.CopyN(b, s.r, length)
+	s.buf = b.Bytes()
+	s.offset += n
+	if err == io.EOF {
+		return nil, s.error("unexpected end of input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.buf[len(s.buf)-int(length):], nil
+}
+
+func (s *scanner) list(depth int) error {
+	if s.limits.MaxDepth > 0 && depth > s.limits.MaxDepth {
+		return s.error("nested deeper than %d", s.limits.MaxDepth)
+	}
+	if _, err := s.readByte(); err != nil { // 'l'
+		return err
+	}
+	for {
+		c, err := s.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := s.readByte()
+			return err
+		}
+		if err := s.value(depth); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *scanner) dict(depth int) error {
+	if s.limits.MaxDepth > 0 && depth > s.limits.MaxDepth {
+		return s.error("nested deeper than %d", s.limits.MaxDepth)
+	}
+	if _, err := s.readByte(); err != nil { // 'd'
+		return err
+	}
+	var prev []byte
+	for i := 0; ; i++ {
+		c, err := s.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err := s.readByte()
+			return err
+		}
+		if c < '0' || c > '9' {
+			return s.error("dict key must be a string, found %q", c)
+		}
+		keyOffset := s.offset
+		key, err := s.str()
+		if err != nil {
+			return err
+		}
+		if s.strict && i > 0 {
+			switch cmp := bytes.Compare(prev, key); {
+			case cmp == 0:
+				return s.errorAt(keyOffset, "duplicate dict key %q", key)
+			case cmp > 0:
+				return s.errorAt(keyOffset, "dict key %q out of order", key)
+			}
+		}
+		// key points into buf which may move as it grows
+		prev = append(prev[:0], key...)
+		if err := s.value(depth); err != nil {
+			return err
+		}
+	}
+}
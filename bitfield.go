@@ -0,0 +1,35 @@
+package torgo
+
+// Bitfield is a set of pieces laid out the same way as a BITFLD payload,
+// the high bit of the first byte is piece 0.
+type Bitfield []byte
+
+func newBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	b[index/8] |= 0x80 >> uint(index%8)
+}
+
+func (b Bitfield) Clear(index int) {
+	b[index/8] &^= 0x80 >> uint(index%8)
+}
+
+// Count is the number of pieces set
+func (b Bitfield) Count() int {
+	n := 0
+	for _, by := range b {
+		for ; by != 0; by &= by - 1 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,383 @@
+package torgo
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// CACHE_SIZE is how many bytes of blocks each torrent keeps in memory
+	CACHE_SIZE = 64 << 20
+	// DISK_WORKERS is how many pieces each torrent writes out at once
+	DISK_WORKERS = 4
+)
+
+// blockCache sits in front of a torrent's Piecer. Blocks are kept in memory
+// until their piece is complete and has been hashed, then the whole piece is
+// queued to be written out in one go by a pool of disk workers. Pieces that
+// are read are kept as well, so pieces being streamed or seeded aren't read
+// off disk a block at a time.
+//
+// Queued pieces are still counted against size, so the queue can't outgrow
+// the cache. Once half of it is waiting on the disk the cache is backlogged
+// and the torrent stops asking peers for more until the workers catch up.
+type blockCache struct {
+	store       Piecer // where pieces end up
+	pieceLength int
+	pieceCount  int
+	length      int64
+	size        int64       // the most bytes kept at once
+	failed      func(error) // told about pieces that couldn't be written out
+
+	hits   int64 // atomic, reads served from memory
+	misses int64 // atomic, reads that went to the store
+
+	mu      sync.Mutex
+	idle    *sync.Cond // broadcast each time a write finishes
+	work    *sync.Cond // signalled each time a piece is queued
+	pieces  map[int]*cachedPiece
+	lru     *list.List // clean pieces, least recently used first
+	used    int64
+	through map[int]bool // pieces written straight to the store for want of room
+	queue   []*cachedPiece
+	writing int   // pieces queued or being written out
+	dirty   int64 // bytes of them and of unwritten
+	err     error // the first write that failed, kept until unwritten is empty
+	closed  bool
+
+	unwritten []*cachedPiece // pieces whose write failed, waiting for retry
+}
+
+type pieceState int
+
+const (
+	pieceFilling pieceState = iota // blocks are still coming in
+	pieceDirty                     // verified, waiting to be written out
+	pieceClean                     // the same as what's in the store
+)
+
+type cachedPiece struct {
+	index int
+	data  []byte
+	state pieceState
+	elem  *list.Element // in lru while it's clean
+}
+
+func newBlockCache(store Piecer, info StorageInfo, size int64, workers int, failed func(error)) *blockCache {
+	c := &blockCache{
+		store:       store,
+		failed:      failed,
+		pieceLength: info.PieceLength,
+		pieceCount:  info.PieceCount,
+		length:      info.length(),
+		size:        size,
+		pieces:      make(map[int]*cachedPiece),
+		lru:         list.New(),
+		through:     make(map[int]bool),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	c.work = sync.NewCond(&c.mu)
+	for i := 0; i < workers; i++ {
+		go c.writeLoop()
+	}
+	return c
+}
+
+func (c *blockCache) pieceLen(index int) int {
+	if rest := c.length - int64(index)*int64(c.pieceLength); rest < int64(c.pieceLength) {
+		return int(rest)
+	}
+	return c.pieceLength
+}
+
+// makeRoom evicts clean pieces until n more bytes fit, it's false if they
+// can't. c has to be locked.
+func (c *blockCache) makeRoom(n int) bool {
+	for c.used+int64(n) > c.size && c.lru.Len() > 0 {
+		c.drop(c.pieces[c.lru.Front().Value.(int)])
+	}
+	return c.used+int64(n) <= c.size
+}
+
+// drop forgets a piece, c has to be locked
+func (c *blockCache) drop(p *cachedPiece) {
+	if p.elem != nil {
+		c.lru.Remove(p.elem)
+		p.elem = nil
+	}
+	c.used -= int64(len(p.data))
+	delete(c.pieces, p.index)
+}
+
+// Write keeps the block until its piece is marked complete. If there's no
+// room for the piece, or the block doesn't fit in one, it goes straight to
+// the store.
+func (c *blockCache) Write(index int, begin int, data []byte) error {
+	c.mu.Lock()
+	if index < 0 || index >= c.pieceCount || begin < 0 || begin+len(data) > c.pieceLen(index) {
+		// anything cached for the pieces it spans would go stale
+		for i := index; i <= index+(begin+len(data))/c.pieceLength; i++ {
+			if p := c.pieces[i]; p != nil && p.state != pieceDirty {
+				c.drop(p)
+			}
+		}
+		c.mu.Unlock()
+		return c.store.Write(index, begin, data)
+	}
+	p := c.pieces[index]
+	if p == nil && !c.through[index] && c.makeRoom(c.pieceLen(index)) {
+		p = &cachedPiece{index: index, data: make([]byte, c.pieceLen(index))}
+		c.pieces[index] = p
+		c.used += int64(len(p.data))
+	}
+	if p == nil {
+		// the rest of the piece has to follow so the store has all of it
+		c.through[index] = true
+		c.mu.Unlock()
+		return c.store.Write(index, begin, data)
+	}
+	if p.elem != nil {
+		c.lru.Remove(p.elem)
+		p.elem = nil
+	}
+	p.state = pieceFilling
+	copy(p.data[begin:], data)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *blockCache) Read(index int, begin int, data []byte) error {
+	offset := int64(index)*int64(c.pieceLength) + int64(begin)
+	if index < 0 || begin < 0 || offset+int64(len(data)) > c.length {
+		return io.ErrUnexpectedEOF
+	}
+	for len(data) > 0 {
+		n, err := c.readPiece(int(offset/int64(c.pieceLength)), int(offset%int64(c.pieceLength)), data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// readPiece fills as much of data as there is in piece index from off on. A
+// piece that isn't cached is read whole from the store and kept if there's
+// room.
+func (c *blockCache) readPiece(index, off int, data []byte) (int, error) {
+	length := c.pieceLen(index)
+	n := length - off
+	if n > len(data) {
+		n = len(data)
+	}
+	c.mu.Lock()
+	if p := c.pieces[index]; p != nil {
+		if p.elem != nil {
+			c.lru.MoveToBack(p.elem)
+		}
+		copy(data[:n], p.data[off:])
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return n, nil
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	buf := make([]byte, length)
+	if err := c.store.Read(index, 0, buf); err != nil {
+		// some of the piece may be missing, a skipped file say, but not the
+		// part we were asked for
+		return n, c.store.Read(index, off, data[:n])
+	}
+	copy(data[:n], buf[off:])
+	c.mu.Lock()
+	// a write that went to the store while we were reading makes buf stale
+	if c.pieces[index] == nil && !c.through[index] && c.makeRoom(length) {
+		p := &cachedPiece{index: index, data: buf, state: pieceClean}
+		p.elem = c.lru.PushBack(index)
+		c.pieces[index] = p
+		c.used += int64(length)
+	}
+	c.mu.Unlock()
+	return n, nil
+}
+
+// MarkComplete queues the piece to be written out, the store marks it once
+// it's there. It never waits on the disk.
+func (c *blockCache) MarkComplete(index int) error {
+	c.mu.Lock()
+	delete(c.through, index)
+	p := c.pieces[index]
+	if p == nil || p.state != pieceFilling {
+		c.mu.Unlock()
+		return c.store.MarkComplete(index)
+	}
+	p.state = pieceDirty
+	c.queue = append(c.queue, p)
+	c.writing++
+	c.dirty += int64(len(p.data))
+	c.work.Signal()
+	c.mu.Unlock()
+	return nil
+}
+
+// backlogged is true once half the cache is waiting to be written out, the
+// torrent doesn't ask for anything more until the disk catches up.
+func (c *blockCache) backlogged() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dirty >= c.size/2
+}
+
+// next waits for a piece to write out, it's nil once the cache is closed
+func (c *blockCache) next() *cachedPiece {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) == 0 && !c.closed {
+		c.work.Wait()
+	}
+	if len(c.queue) == 0 {
+		return nil
+	}
+	p := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	return p
+}
+
+func (c *blockCache) writeLoop() {
+	for p := c.next(); p != nil; p = c.next() {
+		err := c.store.Write(p.index, 0, p.data)
+		if err == nil {
+			err = c.store.MarkComplete(p.index)
+		}
+		c.mu.Lock()
+		if err != nil {
+			// it stays dirty so it can still be read, and so it's in
+			// memory to be written when it's retried
+			if c.err == nil {
+				c.err = err
+			}
+			c.unwritten = append(c.unwritten, p)
+		} else {
+			if c.pieces[p.index] == p && p.state == pieceDirty {
+				p.state = pieceClean
+				p.elem = c.lru.PushBack(p.index)
+			}
+			c.dirty -= int64(len(p.data))
+			if len(c.unwritten) == 0 {
+				c.err = nil
+			}
+		}
+		c.writing--
+		c.idle.Broadcast()
+		c.mu.Unlock()
+		if err != nil && c.failed != nil {
+			// whoever's told may be waiting on a flush, so don't hold up the worker
+			go c.failed(err)
+		}
+	}
+}
+
+// discard drops what's been written of a piece that failed its hash check
+func (c *blockCache) discard(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.through, index)
+	if p := c.pieces[index]; p != nil && p.state == pieceFilling {
+		c.drop(p)
+	}
+}
+
+// wait blocks until every queued piece has been written out or failed. The
+// first write that failed is returned for as long as any piece is left
+// unwritten. c has to be locked.
+func (c *blockCache) wait() error {
+	for c.writing > 0 {
+		c.idle.Wait()
+	}
+	return c.err
+}
+
+// retry queues the pieces that couldn't be written to be tried again
+func (c *blockCache) retry() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.unwritten) == 0 {
+		return
+	}
+	c.queue = append(c.queue, c.unwritten...)
+	c.writing += len(c.unwritten)
+	c.unwritten = nil
+	c.work.Broadcast()
+}
+
+// flush blocks until every verified piece has been written out
+func (c *blockCache) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wait()
+}
+
+// Sync writes out every verified piece before syncing the store, pieces
+// that failed before are tried again.
+func (c *blockCache) Sync() error {
+	c.retry()
+	err := c.flush()
+	if serr := c.store.Sync(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Close writes out every verified piece and stops the disk workers before
+// closing the store.
+func (c *blockCache) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.store.Close()
+	}
+	err := c.wait()
+	// the workers stop once there's nothing left and it's closed
+	c.closed = true
+	c.work.Broadcast()
+	c.mu.Unlock()
+	if cerr := c.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *blockCache) allocate(mode Allocation) error {
+	if a, ok := c.store.(allocator); ok {
+		return a.allocate(mode)
+	}
+	return nil
+}
+
+// move writes out every verified piece before the store's files are moved
+func (c *blockCache) move(to StorageInfo) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if m, ok := c.store.(mover); ok {
+		return m.move(to)
+	}
+	return nil
+}
+
+func (c *blockCache) Completed() Bitfield {
+	return c.store.Completed()
+}
+
+// paths are the store's, if it's on disk
+func (c *blockCache) paths() []string {
+	if p, ok := c.store.(interface{ paths() []string }); ok {
+		return p.paths()
+	}
+	return nil
+}
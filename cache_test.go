@@ -0,0 +1,212 @@
+package torgo
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingPiecer keeps pieces in memory and counts the writes that reach it
+type countingPiecer struct {
+	Piecer
+	mu     sync.Mutex
+	writes int
+	stall  chan struct{} // writes wait for it to be closed, if it's set
+	fail   error         // what writes return instead, if it's set
+}
+
+func (p *countingPiecer) Write(index int, begin int, data []byte) error {
+	if p.stall != nil {
+		<-p.stall
+	}
+	p.mu.Lock()
+	p.writes++
+	fail := p.fail
+	p.mu.Unlock()
+	if fail != nil {
+		return fail
+	}
+	return p.Piecer.Write(index, begin, data)
+}
+
+func (p *countingPiecer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writes
+}
+
+func newTestCache(t *testing.T, size int64) (*blockCache, *countingPiecer) {
+	info := StorageInfo{
+		Files:       []StorageFile{{Path: "data", Length: 10}},
+		PieceCount:  3,
+		PieceLength: 4,
+	}
+	mem, err := NewMemoryStorage().Open(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingPiecer{Piecer: mem}
+	return newBlockCache(store, info, size, 2, nil), store
+}
+
+func Test_blockCacheRetriesFailedWrites(t *testing.T) {
+	c, store := newTestCache(t, 8)
+	defer c.Close()
+	full := errors.New("disk full")
+	store.fail = full
+
+	c.Write(0, 0, []byte("abcd"))
+	c.MarkComplete(0)
+	for i := 0; i < 2; i++ {
+		if err := c.Sync(); err != full {
+			t.Fatalf("sync %d got %v; want %v", i, err, full)
+		}
+	}
+	if c.Completed().Has(0) {
+		t.Fatal("piece marked complete without being written")
+	}
+	got := make([]byte, 4)
+	if err := c.Read(0, 0, got); err != nil || string(got) != "abcd" {
+		t.Fatalf("got %q, %v; want the unwritten piece", got, err)
+	}
+
+	store.mu.Lock()
+	store.fail = nil
+	store.mu.Unlock()
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Completed().Has(0) {
+		t.Error("piece not marked complete once it was written")
+	}
+	got = make([]byte, 4)
+	if err := store.Piecer.Read(0, 0, got); err != nil || string(got) != "abcd" {
+		t.Errorf("store has %q, %v; want %q", got, err, "abcd")
+	}
+	if c.backlogged() || c.dirty != 0 {
+		t.Errorf("%d bytes still dirty", c.dirty)
+	}
+}
+
+func Test_blockCacheCoalescesWrites(t *testing.T) {
+	c, store := newTestCache(t, 8)
+	defer c.Close()
+
+	c.Write(0, 0, []byte("ab"))
+	c.Write(0, 2, []byte("cd"))
+	got := make([]byte, 4)
+	if err := c.Read(0, 0, got); err != nil || string(got) != "abcd" {
+		t.Fatalf("got %q, %v; want %q", got, err, "abcd")
+	}
+	if store.count() != 0 {
+		t.Fatal("blocks were written before the piece was complete")
+	}
+	if err := c.MarkComplete(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if store.count() != 1 {
+		t.Errorf("piece took %d writes; want 1", store.count())
+	}
+	stored := make([]byte, 4)
+	store.Read(0, 0, stored)
+	if string(stored) != "abcd" || !store.Completed().Has(0) {
+		t.Errorf("store has %q, complete %v", stored, store.Completed().Has(0))
+	}
+	if c.hits != 1 || c.misses != 0 {
+		t.Errorf("got %d hits and %d misses; want 1 and 0", c.hits, c.misses)
+	}
+}
+
+func Test_blockCacheBounded(t *testing.T) {
+	c, store := newTestCache(t, 4)
+	defer c.Close()
+
+	// piece 0 fills the cache, so piece 1 goes straight through
+	c.Write(0, 0, []byte("abcd"))
+	c.Write(1, 0, []byte("ef"))
+	if store.count() != 1 {
+		t.Fatalf("got %d writes to the store; want 1", store.count())
+	}
+	c.Write(1, 2, []byte("gh"))
+	if store.count() != 2 || c.used != 4 {
+		t.Fatalf("the rest of a piece written through was cached")
+	}
+
+	// once piece 0 is written out it's clean and can make way
+	c.MarkComplete(0)
+	c.Sync()
+	got := make([]byte, 10)
+	c.Write(2, 0, []byte("ij"))
+	if err := c.Read(0, 0, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdefghij" {
+		t.Errorf("got %q; want %q", got, "abcdefghij")
+	}
+	if c.used > c.size {
+		t.Errorf("%d bytes cached; the most is %d", c.used, c.size)
+	}
+	if c.misses != 2 {
+		t.Errorf("got %d misses; want 2, for pieces 0 and 1", c.misses)
+	}
+}
+
+func Test_blockCacheDiscard(t *testing.T) {
+	c, store := newTestCache(t, 8)
+	defer c.Close()
+
+	c.Write(1, 0, []byte("bad!"))
+	c.discard(1)
+	got := make([]byte, 4)
+	c.Read(1, 0, got)
+	if !bytes.Equal(got, make([]byte, 4)) {
+		t.Errorf("read %q after discarding the piece", got)
+	}
+	c.Sync()
+	if store.count() != 0 {
+		t.Error("a discarded piece was written out")
+	}
+}
+
+func Test_blockCacheSlowDisk(t *testing.T) {
+	c, store := newTestCache(t, 12)
+	defer c.Close()
+	store.stall = make(chan struct{})
+
+	// more pieces than there are workers, none of them can be written yet
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, data := range []string{"abcd", "efgh", "ij"} {
+			c.Write(i, 0, []byte(data))
+			if err := c.MarkComplete(i); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MarkComplete waited on the disk")
+	}
+	if !c.backlogged() {
+		t.Error("not backlogged with the whole cache waiting on the disk")
+	}
+
+	close(store.stall)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if c.backlogged() {
+		t.Error("still backlogged once everything's written")
+	}
+	got := make([]byte, 10)
+	if err := store.Read(0, 0, got); err != nil || string(got) != "abcdefghij" {
+		t.Errorf("store has %q, %v", got, err)
+	}
+}
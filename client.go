@@ -0,0 +1,371 @@
+package torgo
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	LISTEN_ADDR           = ":6881"
+	MAX_CONNS             = 200
+	MAX_CONNS_PER_TORRENT = 50
+	HANDSHAKE_TIMEOUT     = 10 * time.Second
+	TRACKER_TIMEOUT       = 30 * time.Second
+	TRACKER_STOP_TIMEOUT  = 5 * time.Second // for telling trackers we've stopped
+	PEER_ID_PREFIX        = "-TG0001-"
+)
+
+var (
+	ErrClientClosed   = errors.New("client is closed")
+	ErrTorrentExists  = errors.New("torrent already added")
+	ErrUnknownTorrent = errors.New("no such torrent")
+
+	errTooManyConns    = errors.New("too many connections")
+	errTorrentNotReady = errors.New("torrent isn't running")
+	errTorrentRunning  = errors.New("torrent is already running")
+	errDuplicatePeer   = errors.New("already connected to peer")
+)
+
+// ClientConfig is everything shared by the torrents in a Client, zero values
+// get the defaults.
+type ClientConfig struct {
+	ListenAddr         string     // where peers can reach us, "" doesn't listen
+	DownloadDir        string     // torrents are stored under here once they're complete
+	IncompleteDir      string     // torrents are stored under here until they're complete, DownloadDir if ""
+	IncompleteSuffix   string     // added to the names of files until the torrent is complete, like PART_SUFFIX
+	ResumeDir          string     // resume files are kept here
+	MaxConns           int        // open peer connections across every torrent
+	MaxConnsPerTorrent int        // open peer connections for any one torrent
+	PeerID             [20]byte   // random if left empty
+	MaxHalfOpen        int        // peers being dialed at once
+	ExternalIP         net.IP     // our address as peers see it, for BEP 40 priorities
+	CheckPeerIDs       bool       // refuse peers whose handshake id isn't the one the tracker gave
+	Storage            Storage    // where torrents are kept, FileStorage if nil
+	CacheSize          int64      // bytes of blocks each torrent keeps in memory, -1 turns the cache off
+	DiskWorkers        int        // pieces each torrent writes out at once
+	Allocation         Allocation // how space is set aside for files on disk
+	RefuseLowSpace     bool       // refuse torrents that won't fit on disk rather than warn
+
+	// Rate limits are in bytes a second, 0 is no limit
+	DownloadLimit     int64     // across every torrent
+	UploadLimit       int64     // across every torrent
+	PeerDownloadLimit int64     // for each peer
+	PeerUploadLimit   int64     // for each peer
+	AltSpeed          *AltSpeed // limits that replace the first two on a schedule
+}
+
+// Client runs any number of torrents in one process. It owns what they share:
+// the listen socket, our peer id, the http client trackers are called with,
+// and the limits on open peer connections and bandwidth.
+type Client struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	config   ClientConfig
+	peerID   [20]byte
+	listener net.Listener
+	tracker  *http.Client
+	logger   log.Logger
+	down     *limiter
+	up       *limiter
+
+	halfOpen chan struct{} // a slot for each dial in progress
+
+	sync.Mutex
+	torrents map[[20]byte]*Torrent
+	conns    int
+	localIP  net.IP // our end of the first connection we made
+	closed   bool
+
+	closeOnce sync.Once
+}
+
+// NewClient starts a client, it runs until ctx is done or it's closed
+func NewClient(ctx context.Context, config ClientConfig, logger log.Logger) (*Client, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if config.DownloadDir == "" {
+		config.DownloadDir = DL_FILE
+	}
+	if config.ResumeDir == "" {
+		config.ResumeDir = RESUME_DIR
+	}
+	if config.MaxConns <= 0 {
+		config.MaxConns = MAX_CONNS
+	}
+	if config.MaxConnsPerTorrent <= 0 {
+		config.MaxConnsPerTorrent = MAX_CONNS_PER_TORRENT
+	}
+	if config.MaxHalfOpen <= 0 {
+		config.MaxHalfOpen = MAX_HALF_OPEN
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = CACHE_SIZE
+	}
+	if config.DiskWorkers <= 0 {
+		config.DiskWorkers = DISK_WORKERS
+	}
+	c := &Client{
+		config:   config,
+		peerID:   config.PeerID,
+		tracker:  &http.Client{Timeout: TRACKER_TIMEOUT},
+		logger:   logger,
+		torrents: make(map[[20]byte]*Torrent),
+		halfOpen: make(chan struct{}, config.MaxHalfOpen),
+		down:     newLimiter(0),
+		up:       newLimiter(0),
+	}
+	c.applyLimits(time.Now())
+	if c.peerID == [20]byte{} {
+		var err error
+		if c.peerID, err = newPeerID(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ListenAddr != "" {
+		l, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		c.listener = l
+		go c.acceptLoop()
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	go func() {
+		<-c.ctx.Done()
+		c.Close()
+	}()
+	go c.scheduleLimits()
+	return c, nil
+}
+
+// newPeerID makes an Azureus style id, our prefix then random bytes
+func newPeerID() ([20]byte, error) {
+	var id [20]byte
+	copy(id[:], PEER_ID_PREFIX)
+	_, err := rand.Read(id[len(PEER_ID_PREFIX):])
+	return id, err
+}
+
+// Addr is where the client is listening, nil if it isn't
+func (c *Client) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+// AddTorrentFile reads a .torrent file and adds it to the client
+func (c *Client) AddTorrentFile(path string, opts ...AddOption) (*Torrent, error) {
+	ti, err := ReadTorrentFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.AddTorrent(ti, opts...)
+}
+
+// AddTorrent adds ti to the client and starts it
+func (c *Client) AddTorrent(ti *TorrentInfo, opts ...AddOption) (*Torrent, error) {
+	var infoHash [20]byte
+	copy(infoHash[:], ti.InfoHash)
+
+	c.Lock()
+	err := c.addable(infoHash)
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// opening the torrent can mean hashing all its data, nothing else in the
+	// client should wait on that
+	info := *ti
+	info.PeerId = append([]byte(nil), c.peerID[:]...)
+	info.logger = log.With(c.logger, "component", "TorrentInfo", "torrent", info.Name)
+	t, err := newTorrent(info, c, log.With(c.logger, "component", "Torrent", "torrent", info.Name), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	// it might have been added or the client closed while we were opening it
+	if err := c.addable(infoHash); err != nil {
+		c.Unlock()
+		t.close()
+		return nil, err
+	}
+	c.torrents[infoHash] = t
+	t.start()
+	c.Unlock()
+	return t, nil
+}
+
+// addable is nil if a torrent with infoHash can be added, c has to be locked
+func (c *Client) addable(infoHash [20]byte) error {
+	if c.closed {
+		return ErrClientClosed
+	}
+	if _, ok := c.torrents[infoHash]; ok {
+		return ErrTorrentExists
+	}
+	return nil
+}
+
+// Torrent finds a torrent by its info hash
+func (c *Client) Torrent(infoHash [20]byte) (*Torrent, bool) {
+	c.Lock()
+	defer c.Unlock()
+	t, ok := c.torrents[infoHash]
+	return t, ok
+}
+
+func (c *Client) Torrents() []*Torrent {
+	c.Lock()
+	defer c.Unlock()
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Remove stops a torrent and forgets about it, its data stays on disk
+func (c *Client) Remove(infoHash [20]byte) error {
+	c.Lock()
+	t, ok := c.torrents[infoHash]
+	delete(c.torrents, infoHash)
+	c.Unlock()
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	t.stop()
+	return t.close()
+}
+
+// Pause disconnects a torrent's peers and saves its resume data, it stays in
+// the client until it's removed.
+func (c *Client) Pause(infoHash [20]byte) error {
+	t, ok := c.Torrent(infoHash)
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	t.stop()
+	return nil
+}
+
+// Resume starts a paused torrent again. Pieces that couldn't be written out
+// when it was paused, for a full disk say, are tried again.
+func (c *Client) Resume(infoHash [20]byte) error {
+	t, ok := c.Torrent(infoHash)
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	t.start()
+	return nil
+}
+
+// Close stops listening and stops every torrent, saving their resume data.
+// Closing it again waits for the first Close to finish and returns nil.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.close()
+	})
+	return err
+}
+
+func (c *Client) close() error {
+	c.Lock()
+	c.closed = true
+	torrents := c.torrents
+	c.torrents = make(map[[20]byte]*Torrent)
+	c.Unlock()
+	c.cancel()
+
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(torrents))
+	for _, t := range torrents {
+		go func(t *Torrent) {
+			defer wg.Done()
+			t.stop()
+			if cerr := t.close(); cerr != nil {
+				level.Error(c.logger).Log("torrent", t.ti.Name, "err", cerr)
+			}
+		}(t)
+	}
+	wg.Wait()
+	return err
+}
+
+// acquireConn takes one of the client's connection slots, it's false when
+// they're all in use.
+func (c *Client) acquireConn() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed || c.conns >= c.config.MaxConns {
+		return false
+	}
+	c.conns++
+	return true
+}
+
+func (c *Client) releaseConn() {
+	c.Lock()
+	defer c.Unlock()
+	c.conns--
+}
+
+func (c *Client) acceptLoop() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			level.Debug(c.logger).Log("accept", err)
+			return
+		}
+		go func() {
+			if err := c.handleIncoming(conn); err != nil {
+				level.Debug(c.logger).Log("incoming", conn.RemoteAddr(), "err", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// handleIncoming reads the handshake off a connection a peer made to us and
+// passes it to the torrent it's for.
+func (c *Client) handleIncoming(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	hs, err := Unmarshal(conn)
+	if err != nil {
+		return err
+	}
+	t, ok := c.Torrent(hs.InfoHash)
+	if !ok {
+		return fmt.Errorf("%x: %v", hs.InfoHash, ErrUnknownTorrent)
+	}
+	if hs.PeerId == c.peerID {
+		// answer so the end that dialed sees it's talking to itself too
+		conn.Write(t.Handshake.Marshall())
+		return errSelfConnection
+	}
+	if !c.acquireConn() {
+		return errTooManyConns
+	}
+	conn.SetDeadline(time.Time{})
+	if err := t.acceptPeer(conn, hs); err != nil {
+		c.releaseConn()
+		return err
+	}
+	return nil
+}
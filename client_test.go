@@ -0,0 +1,419 @@
+package torgo
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func newTestClient(t *testing.T, dir string) *Client {
+	c, err := NewClient(context.Background(), ClientConfig{
+		ListenAddr:  "127.0.0.1:0",
+		DownloadDir: dir,
+		ResumeDir:   dir,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// dialClient connects to c as a peer of the torrent with infoHash and returns
+// the handshake c answers with.
+func dialClient(t *testing.T, c *Client, infoHash [20]byte) (net.Conn, *Handshake, error) {
+	conn, err := net.Dial("tcp", c.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := Handshake{InfoHash: infoHash}
+	copy(hs.PeerId[:], "-XX0000-abcdefghijkl")
+	if _, err := conn.Write(hs.Marshall()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := Unmarshal(conn)
+	return conn, reply, err
+}
+
+func peerCount(tor *Torrent) int {
+	tor.Lock()
+	defer tor.Unlock()
+	return len(tor.peerConns)
+}
+
+func Test_ClientTorrents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+
+	ti := newTestTorrent(t, dir, []byte("some data for the client to seed"), 8).ti
+	ti.Name = "data"
+	var infoHash [20]byte
+	copy(infoHash[:], ti.InfoHash)
+
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddTorrent(&ti); err != ErrTorrentExists {
+		t.Errorf("got %v adding the torrent twice; want %v", err, ErrTorrentExists)
+	}
+	if string(tor.ti.PeerId) != string(c.peerID[:]) {
+		t.Errorf("torrent has peer id %q; want the client's %q", tor.ti.PeerId, c.peerID)
+	}
+
+	conn, reply, err := dialClient(t, c, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply.InfoHash != infoHash || reply.PeerId != c.peerID {
+		t.Errorf("got handshake %x %q", reply.InfoHash, reply.PeerId)
+	}
+	for i := 0; peerCount(tor) != 1; i++ {
+		if i == 100 {
+			t.Fatal("incoming peer never added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.Pause(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	if n := peerCount(tor); n != 0 {
+		t.Errorf("paused torrent still has %d peers", n)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from a paused torrent; want EOF", err)
+	}
+	if _, err := os.Stat(tor.resumePath); err != nil {
+		t.Errorf("pausing didn't save resume data: %v", err)
+	}
+
+	if err := c.Resume(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	conn2, _, err := dialClient(t, c, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2.Close()
+
+	if err := c.Remove(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Torrent(infoHash); ok {
+		t.Error("removed torrent is still there")
+	}
+	if err := c.Remove(infoHash); err != ErrUnknownTorrent {
+		t.Errorf("got %v removing twice; want %v", err, ErrUnknownTorrent)
+	}
+}
+
+func Test_ClientAddTorrentRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data for two adds to race over"), 8).ti
+	ti.Name = "data"
+
+	const adds = 4
+	errs := make(chan error, adds)
+	for i := 0; i < adds; i++ {
+		go func() {
+			_, err := c.AddTorrent(&ti)
+			errs <- err
+		}()
+	}
+	added := 0
+	for i := 0; i < adds; i++ {
+		switch err := <-errs; err {
+		case nil:
+			added++
+		case ErrTorrentExists:
+		default:
+			t.Errorf("got %v adding the torrent", err)
+		}
+	}
+	if added != 1 || len(c.Torrents()) != 1 {
+		t.Errorf("added it %d times, the client has %d torrents; want 1 of each", added, len(c.Torrents()))
+	}
+}
+
+// A bitfield sent straight after the handshake isn't lost to the peer not
+// having been added yet.
+func Test_ClientEarlyBitfield(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data for a peer to say it has"), 8).ti
+	ti.Name = "data"
+	var infoHash [20]byte
+	copy(infoHash[:], ti.InfoHash)
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := dialClient(t, c, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bitfield, _ := Bitfield{0xf8}.MarshalBinary()
+	if _, err := conn.Write(bitfield); err != nil {
+		t.Fatal(err)
+	}
+	logged := func() bool {
+		tor.PeerPieceLog.RLock()
+		defer tor.PeerPieceLog.RUnlock()
+		_, ok := tor.PeerPieceLog.vector[4]["-XX0000-abcdefghijkl"]
+		return ok
+	}
+	for i := 0; !logged(); i++ {
+		if i == 100 {
+			t.Fatal("bitfield sent straight after the handshake was never logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ClientRefusesBadPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data"), 4).ti
+	ti.PieceLength = 0
+	if _, err := c.AddTorrent(&ti); err != errPieceLength {
+		t.Errorf("got %v adding a torrent with no piece length; want %v", err, errPieceLength)
+	}
+	ti.PieceLength = 4
+	ti.Pieces = ti.Pieces[:25]
+	if _, err := c.AddTorrent(&ti); err != errPieceHashes {
+		t.Errorf("got %v adding a torrent with a partial hash; want %v", err, errPieceHashes)
+	}
+}
+
+func Test_ClientRefusesUnknownTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+
+	conn, _, err := dialClient(t, c, [20]byte{1, 2, 3})
+	if err == nil {
+		t.Error("got a handshake back for a torrent the client doesn't have")
+	}
+	conn.Close()
+}
+
+func Test_ClientContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewClient(ctx, ClientConfig{DownloadDir: dir, ResumeDir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data's all there already so it's complete as soon as it's added
+	ti := newTestTorrent(t, dir, []byte("already downloaded"), 8).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tor.Complete():
+	default:
+		t.Fatal("torrent with all its data isn't complete")
+	}
+	st := tor.Stats()
+	if st.State != StateSeeding || st.PiecesDone != 3 || st.Completed != 18 || st.Progress() != 1 {
+		t.Errorf("got %+v", st)
+	}
+
+	cancel()
+	// whichever Close gets there second waits for the first and is fine too
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("got %v closing a client that's closing anyway; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context didn't close the client")
+	}
+	if st := tor.Stats(); st.State != StatePaused {
+		t.Errorf("got state %v once the client is closed", st.State)
+	}
+	if _, err := c.AddTorrent(&ti); err != ErrClientClosed {
+		t.Errorf("got %v adding to a closed client; want %v", err, ErrClientClosed)
+	}
+}
+
+func Test_TorrentRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data for the torrent to run with"), 8).ti
+	ti.Name = "data"
+	var infoHash [20]byte
+	copy(infoHash[:], ti.InfoHash)
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.Run(context.Background()); err != errTorrentRunning {
+		t.Errorf("got %v running it twice; want %v", err, errTorrentRunning)
+	}
+	tor.stop()
+
+	running := func() bool {
+		tor.Lock()
+		defer tor.Unlock()
+		return tor.running()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- tor.Run(ctx) }()
+	for i := 0; !running(); i++ {
+		if i == 100 {
+			t.Fatal("never started running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, _, err := dialClient(t, c, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; peerCount(tor) != 1; i++ {
+		if i == 100 {
+			t.Fatal("peer never added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return once its context was done")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Errorf("got %v; want the peer hung up on", err)
+	}
+	if running() {
+		t.Error("still running after Run returned")
+	}
+
+	// and it'll go again
+	tor.start()
+	if !running() {
+		t.Error("didn't start again after Run")
+	}
+}
+
+func Test_TorrentShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var events []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data to stop downloading"), 8).ti
+	ti.Name = "data"
+	ti.Announce = tracker.URL
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(seen()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("never announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tor.stop()
+	if got := seen(); !reflect.DeepEqual(got, []string{"started", "stopped"}) {
+		t.Errorf("tracker heard %q; want started then stopped", got)
+	}
+	if _, err := os.Stat(tor.resumePath); err != nil {
+		t.Errorf("no resume data after stopping: %v", err)
+	}
+	tor.Lock()
+	announced := len(tor.announced)
+	tor.Unlock()
+	if announced != 0 {
+		t.Error("still thinks the tracker knows about it")
+	}
+}
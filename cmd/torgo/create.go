@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/zanadar/torgo"
+)
+
+// stringsFlag collects a flag that can be given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// createCmd makes a torrent from a file or directory:
+//
+//	torgo create [flags] <path>
+func createCmd(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	var announce, urlList stringsFlag
+	flags.Var(&announce, "a", "Tracker announce url, repeat for more tiers and separate trackers in the same tier with commas")
+	flags.Var(&urlList, "w", "Web seed url, can be repeated")
+	out := flags.String("o", "", "Where to write the torrent, defaults to <name>.torrent")
+	comment := flags.String("c", "", "Comment")
+	createdBy := flags.String("created-by", torgo.DEFAULT_CREATED_BY, "Created by")
+	noDate := flags.Bool("no-date", false, "Leave out the creation date")
+	private := flags.Bool("private", false, "Set the private flag")
+	pieceLength := flags.Int64("piece-length", 0, "Piece length in bytes, picked from the size if not set")
+	pad := flags.Bool("pad", false, "Add padding files so files start on piece boundaries")
+	workers := flags.Int("workers", runtime.NumCPU(), "Number of pieces to hash at once")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: torgo create [flags] <path>")
+		return 2
+	}
+
+	opts := torgo.CreateOptions{
+		Path:        flags.Arg(0),
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		URLList:     urlList,
+		Pad:         *pad,
+		Workers:     *workers,
+	}
+	for _, tier := range announce {
+		opts.Announce = append(opts.Announce, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	outPath := *out
+	if outPath == "" {
+		outPath = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	f, err := os.Create(outPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	infoHash, err := torgo.CreateTorrent(f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outPath)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s %x\n", outPath, infoHash)
+	return 0
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/zanadar/torgo"
+)
+
+// dirFlags say where the commands that download put torrents
+type dirFlags struct {
+	download   string
+	incomplete string
+	part       bool
+}
+
+func (d *dirFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&d.download, "dir", torgo.DL_FILE, "Put complete torrents in this directory")
+	fs.StringVar(&d.incomplete, "incomplete-dir", "", "Keep torrents in this directory until they're complete")
+	fs.BoolVar(&d.part, "part", false, "Add "+torgo.PART_SUFFIX+" to the names of files until the torrent is complete")
+}
+
+// apply sets the directories in config
+func (d *dirFlags) apply(config *torgo.ClientConfig) {
+	config.DownloadDir = d.download
+	config.IncompleteDir = d.incomplete
+	if d.part {
+		config.IncompleteSuffix = torgo.PART_SUFFIX
+	}
+}
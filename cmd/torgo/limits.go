@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zanadar/torgo"
+)
+
+// limitFlags are the rate limit flags shared by the commands that download,
+// limits are in KiB a second.
+type limitFlags struct {
+	download, upload         int64
+	peerDownload, peerUpload int64
+	altDownload, altUpload   int64
+	altHours, altDays        string
+}
+
+func (l *limitFlags) register(fs *flag.FlagSet) {
+	fs.Int64Var(&l.download, "download-limit", 0, "Limit downloads to this many KiB/s, 0 for no limit")
+	fs.Int64Var(&l.upload, "upload-limit", 0, "Limit uploads to this many KiB/s, 0 for no limit")
+	fs.Int64Var(&l.peerDownload, "peer-download-limit", 0, "Limit downloads from each peer to this many KiB/s")
+	fs.Int64Var(&l.peerUpload, "peer-upload-limit", 0, "Limit uploads to each peer to this many KiB/s")
+	fs.Int64Var(&l.altDownload, "alt-download-limit", 0, "Download limit in KiB/s while -alt-hours is on")
+	fs.Int64Var(&l.altUpload, "alt-upload-limit", 0, "Upload limit in KiB/s while -alt-hours is on")
+	fs.StringVar(&l.altHours, "alt-hours", "", "Use the alternative limits between these times, like 09:00-17:00")
+	fs.StringVar(&l.altDays, "alt-days", "", "Days the alternative limits start on, like mon,tue,wed (default every day)")
+}
+
+// apply sets the limits in config
+func (l *limitFlags) apply(config *torgo.ClientConfig) error {
+	config.DownloadLimit = l.download * 1024
+	config.UploadLimit = l.upload * 1024
+	config.PeerDownloadLimit = l.peerDownload * 1024
+	config.PeerUploadLimit = l.peerUpload * 1024
+	if l.altHours == "" {
+		return nil
+	}
+	alt, err := parseAltSpeed(l.altHours, l.altDays)
+	if err != nil {
+		return err
+	}
+	alt.DownloadLimit = l.altDownload * 1024
+	alt.UploadLimit = l.altUpload * 1024
+	config.AltSpeed = alt
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseAltSpeed reads a schedule like "22:00-06:00" and "mon,fri"
+func parseAltSpeed(hours, days string) (*torgo.AltSpeed, error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad hours %q, want something like 09:00-17:00", hours)
+	}
+	alt := &torgo.AltSpeed{}
+	for i, dst := range []*time.Duration{&alt.Start, &alt.End} {
+		tod, err := time.Parse("15:04", parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("bad hours %q: %v", hours, err)
+		}
+		*dst = time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute
+	}
+	if days == "" {
+		return alt, nil
+	}
+	for _, d := range strings.Split(days, ",") {
+		day, ok := weekdays[strings.ToLower(strings.TrimSpace(d))]
+		if !ok {
+			return nil, fmt.Errorf("bad day %q", d)
+		}
+		alt.Days = append(alt.Days, day)
+	}
+	return alt, nil
+}
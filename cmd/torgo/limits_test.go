@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zanadar/torgo"
+)
+
+func Test_parseAltSpeed(t *testing.T) {
+	cases := []struct {
+		hours, days string
+		expected    *torgo.AltSpeed
+	}{
+		{"09:00-17:30", "", &torgo.AltSpeed{Start: 9 * time.Hour, End: 17*time.Hour + 30*time.Minute}},
+		{"22:00-06:00", "Fri, sat", &torgo.AltSpeed{
+			Start: 22 * time.Hour,
+			End:   6 * time.Hour,
+			Days:  []time.Weekday{time.Friday, time.Saturday},
+		}},
+		{"09:00", "", nil},
+		{"9am-5pm", "", nil},
+		{"09:00-17:00", "someday", nil},
+	}
+	for _, tc := range cases {
+		got, err := parseAltSpeed(tc.hours, tc.days)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%q %q: expected an error, got %+v", tc.hours, tc.days, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", tc.hours, tc.days, err)
+		} else if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%q %q: got %+v; want %+v", tc.hours, tc.days, got, tc.expected)
+		}
+	}
+}
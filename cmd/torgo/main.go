@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	_ "net/http/pprof"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/zanadar/torgo"
+)
+
+const PROGRESS_INTERVAL = 5 * time.Second
+
+func errCheck(err error) {
+	if err != nil {
+		fmt.Printf("Problem: %v\n", err)
+	}
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "Print debug statements")
+	sequential := flag.Bool("sequential", false, "Download pieces in order instead of rarest first")
+	preallocate := flag.Bool("preallocate", false, "Reserve disk space for the whole torrent before downloading")
+	refuseLowSpace := flag.Bool("refuse-low-space", false, "Don't start torrents that won't fit on disk")
+	flag.Parse()
+	args := flag.Args()
+	var files, exclude stringsFlag
+	var limits limitFlags
+	var dirs dirFlags
+	if len(args) < 1 {
+		fmt.Println("You need to supply a torrent file!")
+		os.Exit(0)
+	}
+
+	var logger log.Logger
+	{
+		logLevel := level.AllowInfo()
+		if *debug {
+			logLevel = level.AllowAll()
+		}
+		logger = log.NewLogfmtLogger(os.Stdout)
+		logger = level.NewFilter(logger, logLevel)
+	}
+
+	switch args[0] {
+	case "create":
+		os.Exit(createCmd(args[1:], os.Stdout))
+	case "verify":
+		os.Exit(verifyCmd(args[1:], os.Stdout))
+	case "serve":
+		os.Exit(serveCmd(args[1:], log.With(logger, "component", "Client")))
+	case "download":
+		fs := flag.NewFlagSet("download", flag.ExitOnError)
+		fs.Var(&files, "files", "Only download files matching this glob, can be given more than once")
+		fs.Var(&exclude, "exclude", "Skip files matching this glob, can be given more than once")
+		fs.BoolVar(sequential, "sequential", *sequential, "Download pieces in order instead of rarest first")
+		fs.BoolVar(preallocate, "preallocate", *preallocate, "Reserve disk space for the whole torrent before downloading")
+		fs.BoolVar(refuseLowSpace, "refuse-low-space", *refuseLowSpace, "Don't start torrents that won't fit on disk")
+		limits.register(fs)
+		dirs.register(fs)
+		fs.Parse(args[1:])
+		args = fs.Args()
+		if len(args) < 1 {
+			fmt.Println("You need to supply a torrent file!")
+			os.Exit(0)
+		}
+	}
+
+	go func() {
+		fmt.Println(http.ListenAndServe("localhost:6060", nil))
+	}()
+
+	config := torgo.ClientConfig{ListenAddr: torgo.LISTEN_ADDR, RefuseLowSpace: *refuseLowSpace}
+	if *preallocate {
+		config.Allocation = torgo.AllocFull
+	}
+	dirs.apply(&config)
+	if err := limits.apply(&config); err != nil {
+		errCheck(err)
+		os.Exit(2)
+	}
+	ctx := signalContext()
+	client, err := torgo.NewClient(ctx, config, log.With(logger, "component", "Client"))
+	if err != nil {
+		errCheck(err)
+		os.Exit(1)
+	}
+
+	torrents := addTorrents(client, args, torgo.SelectFiles(files, exclude))
+	for _, t := range torrents {
+		t.SetSequential(*sequential)
+		go func(t *torgo.Torrent) {
+			select {
+			case <-t.Complete():
+				fmt.Printf("%s: complete\n", t.Name())
+			case <-ctx.Done():
+			}
+		}(t)
+	}
+
+	ticker := time.NewTicker(PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, t := range client.Torrents() {
+				st := t.Stats()
+				if st.Err != nil {
+					fmt.Printf("%s: %s: %v\n", t.Name(), st.State, st.Err)
+					continue
+				}
+				fmt.Printf("%s: %s %.1f%% (%d/%d pieces) %d peers\n",
+					t.Name(), st.State, st.Progress()*100, st.PiecesDone, st.Pieces, st.Peers)
+			}
+		case <-ctx.Done():
+			// the status is for what was done before we were interrupted, the
+			// client may already be closing and have let go of its torrents
+			status := exitStatus(torrents)
+			if err := client.Close(); err != nil {
+				errCheck(err)
+			}
+			os.Exit(status)
+		}
+	}
+}
+
+// exitStatus is 0 if every torrent finished downloading and 1 if any didn't
+func exitStatus(torrents []*torgo.Torrent) int {
+	for _, t := range torrents {
+		select {
+		case <-t.Complete():
+		default:
+			return 1
+		}
+	}
+	return 0
+}
+
+// signalContext is cancelled on an interrupt
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	quitCh := make(chan os.Signal, 1)
+	signal.Notify(quitCh, os.Interrupt)
+	go func() {
+		<-quitCh
+		fmt.Println("Shutdown received")
+		cancel()
+	}()
+	return ctx
+}
+
+// addTorrents adds each torrent file in args to client with opts, problems
+// are printed and skipped.
+func addTorrents(client *torgo.Client, args []string, opts ...torgo.AddOption) []*torgo.Torrent {
+	var torrents []*torgo.Torrent
+	for _, arg := range args {
+		t, err := client.AddTorrentFile(arg, opts...)
+		if err != nil {
+			errCheck(err)
+			continue
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
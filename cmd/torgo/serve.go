@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/zanadar/torgo"
+)
+
+// serveCmd downloads torrents and serves their files over HTTP while they
+// come in:
+//
+//	torgo serve [-addr host:port] [limits] <file.torrent>...
+func serveCmd(args []string, logger log.Logger) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:8080", "Address to serve files on")
+	var limits limitFlags
+	limits.register(flags)
+	var dirs dirFlags
+	dirs.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	config := torgo.ClientConfig{ListenAddr: torgo.LISTEN_ADDR}
+	dirs.apply(&config)
+	if err := limits.apply(&config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: torgo serve [-addr host:port] <file.torrent>...")
+		return 2
+	}
+
+	ctx := signalContext()
+	client, err := torgo.NewClient(ctx, config, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+	addTorrents(client, flags.Args())
+
+	srv := &http.Server{Addr: *addr, Handler: torgo.NewHandler(client)}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Printf("Serving on http://%s/\n", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
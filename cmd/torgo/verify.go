@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+
+	"github.com/zanadar/torgo"
+)
+
+// verifyCmd checks data on disk against a torrent file:
+//
+//	torgo verify [-incomplete-dir dir] [-part] <file.torrent> <dir>
+//
+// It exits non zero if anything is missing or corrupt.
+func verifyCmd(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	workers := flags.Int("workers", runtime.NumCPU(), "Number of pieces to hash at once")
+	incomplete := flags.String("incomplete-dir", "", "Look for a torrent that hasn't finished in this directory")
+	part := flags.Bool("part", false, "Look for a torrent that hasn't finished with "+torgo.PART_SUFFIX+" on its file names")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: torgo verify [-workers n] [-incomplete-dir dir] [-part] <file.torrent> <dir>")
+		return 2
+	}
+
+	ti, err := torgo.ReadTorrentFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	config := torgo.ClientConfig{DownloadDir: flags.Arg(1), IncompleteDir: *incomplete}
+	if *part {
+		config.IncompleteSuffix = torgo.PART_SUFFIX
+	}
+	result, err := torgo.Verify(ti, config, *workers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSIZE\tVERIFIED\tSTATUS")
+	for _, st := range result.Files {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", filepath.ToSlash(st.Path), st.Length, percent(st.Verified, st.Length), st)
+	}
+	tw.Flush()
+	fmt.Fprintf(stdout, "%d/%d pieces, %s complete\n", result.Verified, result.Pieces,
+		percent(int64(result.Verified), int64(result.Pieces)))
+
+	if !result.Complete() {
+		return 1
+	}
+	return 0
+}
+
+func percent(n, of int64) string {
+	if of == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(of))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zanadar/torgo"
+)
+
+func Test_verifyCmd(t *testing.T) {
+	cases := []struct {
+		name     string
+		mangle   func(dir string)
+		code     int
+		expected []string
+	}{
+		{"everything there", func(string) {}, 0, []string{
+			"FILE         SIZE   VERIFIED  STATUS",
+			"multi/a      20000  100.0%    complete",
+			"multi/sub/b  30000  100.0%    complete",
+			"4/4 pieces, 100.0% complete",
+		}},
+		{"corrupt piece spanning files", func(dir string) {
+			f, _ := os.OpenFile(filepath.Join(dir, "multi", "a"), os.O_WRONLY, 0)
+			f.WriteAt([]byte("X"), 19999)
+			f.Close()
+		}, 1, []string{
+			"multi/a      20000  81.9%     incomplete",
+			"multi/sub/b  30000  57.4%     incomplete",
+			"3/4 pieces, 75.0% complete",
+		}},
+		{"missing file", func(dir string) {
+			os.Remove(filepath.Join(dir, "multi", "sub", "b"))
+		}, 1, []string{
+			"multi/sub/b  30000  0.0%      missing",
+			"1/4 pieces, 25.0% complete",
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "torgo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			files := map[string]int{"a": 20000, filepath.Join("sub", "b"): 30000}
+			for name, size := range files {
+				path := filepath.Join(dir, "multi", name)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			torrentPath := filepath.Join(dir, "multi.torrent")
+			f, err := os.Create(torrentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = torgo.CreateTorrent(f, torgo.CreateOptions{Path: filepath.Join(dir, "multi"), PieceLength: 16 << 10})
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.mangle(dir)
+
+			var out bytes.Buffer
+			code := verifyCmd([]string{"-workers", "3", torrentPath, dir}, &out)
+			if code != tc.code {
+				t.Errorf("got exit code %d; want %d", code, tc.code)
+			}
+			for _, line := range tc.expected {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("output missing %q:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+}
+
+func Test_verifyCmdUsage(t *testing.T) {
+	if code := verifyCmd([]string{"only-one-arg"}, ioutil.Discard); code != 2 {
+		t.Errorf("got exit code %d; want 2", code)
+	}
+}
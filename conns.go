@@ -0,0 +1,353 @@
+package torgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// MAX_HALF_OPEN is how many peers the client dials at once
+	MAX_HALF_OPEN = 8
+	// DIAL_TIMEOUT is how long we wait for a peer to answer the phone
+	DIAL_TIMEOUT = 5 * time.Second
+	// CONNECT_INTERVAL is how often a torrent tops its connections up
+	CONNECT_INTERVAL = 10 * time.Second
+	// RETRY_BACKOFF is how long we wait before redialing a peer after its
+	// first failure, it doubles with each one after up to MAX_RETRY_BACKOFF
+	RETRY_BACKOFF     = 15 * time.Second
+	MAX_RETRY_BACKOFF = 30 * time.Minute
+	// MAX_PEER_FAILURES is how many times in a row a peer can fail before we
+	// forget about it
+	MAX_PEER_FAILURES = 8
+)
+
+// dialState is how dialing a peer has gone
+type dialState struct {
+	connecting bool
+	failures   int
+	next       time.Time // don't try again before this
+	self       bool      // it's us, so never dial it
+}
+
+// failed puts off the next try, longer each time it fails
+func (d *dialState) failed(now time.Time) {
+	d.failures++
+	backoff := RETRY_BACKOFF
+	for i := 1; i < d.failures && backoff < MAX_RETRY_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_RETRY_BACKOFF {
+		backoff = MAX_RETRY_BACKOFF
+	}
+	d.next = now.Add(backoff)
+}
+
+// dialState is how dialing the peer at addr has gone, t has to be locked
+func (t *Torrent) dialState(addr string) *dialState {
+	d, ok := t.dials[addr]
+	if !ok {
+		d = &dialState{}
+		t.dials[addr] = d
+	}
+	return d
+}
+
+// connectPeers starts dialing peers we know about and aren't connected to,
+// best first, until the torrent would be at its connection limit. Peers that
+// failed are left until their backoff is up. The dials run in the background
+// and the client only has so many half open at once.
+func (t *Torrent) connectPeers(ctx context.Context) {
+	now := time.Now()
+	ours := t.client.ourAddr()
+	t.Lock()
+	connected := make(map[string]bool)
+	for _, p := range t.peerConns {
+		connected[p.String()] = true
+	}
+	var candidates []*Peer
+	for _, p := range t.PeerList {
+		peer, ok := p.(*Peer)
+		if !ok {
+			continue
+		}
+		d := t.dialState(peer.String())
+		if connected[peer.String()] || d.connecting || d.self || now.Before(d.next) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	slots := t.client.config.MaxConnsPerTorrent - len(t.peerConns) - t.connecting
+	if slots <= 0 {
+		t.Unlock()
+		return
+	}
+	byPriority(ours, candidates)
+	if len(candidates) > slots {
+		candidates = candidates[:slots]
+	}
+	for _, p := range candidates {
+		t.dials[p.String()].connecting = true
+		t.connecting++
+	}
+	t.Unlock()
+
+	for _, p := range candidates {
+		go t.dial(ctx, p)
+	}
+}
+
+// dial connects to a fresh copy of known and tells the loop how it went
+func (t *Torrent) dial(ctx context.Context, known *Peer) {
+	p := newPeer(known.IP, known.Port, known.logger)
+	if t.client.config.CheckPeerIDs {
+		p.advertisedID = known.advertisedID
+	}
+	err := t.connect(ctx, p)
+	t.post(dialed{known, err, ctx.Err() != nil})
+}
+
+// handleDialed records how dialing known went, one that keeps failing is
+// forgotten.
+func (t *Torrent) handleDialed(known *Peer, err error, cancelled bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.connecting--
+	d := t.dialState(known.String())
+	d.connecting = false
+	switch {
+	case err == nil:
+		d.failures = 0
+	case err == errTooManyConns || err == errDuplicatePeer || cancelled:
+		// not the peer's fault
+	case err == errSelfConnection:
+		// the tracker handed us our own address
+		d.self = true
+		level.Debug(t.logger).Log("dial", known, "err", err)
+	default:
+		d.failed(time.Now())
+		level.Debug(t.logger).Log("dial", known, "failures", d.failures, "err", err)
+		if d.failures >= MAX_PEER_FAILURES {
+			t.forgetPeer(known.String())
+		}
+	}
+}
+
+// connect dials p and hands it to the torrent once it's shaken hands
+func (t *Torrent) connect(ctx context.Context, p *Peer) error {
+	if err := t.client.acquireHalfOpen(ctx); err != nil {
+		return err
+	}
+	defer t.client.releaseHalfOpen()
+	if !t.client.acquireConn() {
+		return errTooManyConns
+	}
+	t.limitPeer(ctx, p)
+	p.pieces = t.ti.pieceCount()
+	if err := p.Connect(t.Handshake); err != nil {
+		t.client.releaseConn()
+		return err
+	}
+	t.client.learnLocalIP(p.conn.LocalAddr())
+	if err := t.addPeer(p); err != nil {
+		p.conn.Close() // its loops never started
+		t.client.releaseConn()
+		return err
+	}
+	// it's only read from once it's a peer of the torrent, or the loop would
+	// throw away its bitfield
+	p.run(t.msgs)
+	return nil
+}
+
+// forgetPeer drops a peer that keeps failing from the ones we know about, t
+// has to be locked.
+func (t *Torrent) forgetPeer(addr string) {
+	for i, p := range t.PeerList {
+		if p.String() == addr {
+			t.PeerList = append(t.PeerList[:i:i], t.PeerList[i+1:]...)
+			break
+		}
+	}
+	delete(t.dials, addr)
+}
+
+// watchPeer drops p once its connection dies
+func (t *Torrent) watchPeer(p *Peer) {
+	<-p.dead
+	t.dropPeer(p)
+}
+
+// dropPeer disconnects p if it's still one of the torrent's peers, anything
+// we'd asked it for goes back to the picker.
+func (t *Torrent) dropPeer(p *Peer) {
+	t.post(peerDropped{p})
+}
+
+// handleDropPeer is dropPeer on the loop
+func (t *Torrent) handleDropPeer(p *Peer) {
+	t.Lock()
+	if cur, ok := t.peerConns[p.ID()]; !ok || cur != ConnPeer(p) {
+		t.Unlock()
+		return
+	}
+	t.removePeer(p.ID())
+	// give it a moment before we dial it again
+	t.dialState(p.String()).next = time.Now().Add(RETRY_BACKOFF)
+	t.Unlock()
+
+	// hanging up waits on whatever's still queued for it, not the loop
+	go func() {
+		p.Close()
+		t.client.releaseConn()
+	}()
+	level.Debug(t.logger).Log("dropped", p)
+	t.wakeup()
+}
+
+// removePeer forgets everything about a connected peer, t has to be locked
+func (t *Torrent) removePeer(id string) {
+	delete(t.peerConns, id)
+	delete(t.activity, id)
+	delete(t.peerRates, id)
+	t.releaseRequests(id)
+	t.PeerPieceLog.Forget(id)
+}
+
+// byPriority sorts peers by their BEP 40 priority with ours, highest first
+func byPriority(ours *net.TCPAddr, peers []*Peer) {
+	priorities := make(map[*Peer]uint32, len(peers))
+	for _, p := range peers {
+		priorities[p] = peerPriority(ours, p)
+	}
+	sort.SliceStable(peers, func(a, b int) bool {
+		return priorities[peers[a]] > priorities[peers[b]]
+	})
+}
+
+// peerPriority is p's BEP 40 priority with ours, 0 if we can't tell
+func peerPriority(ours *net.TCPAddr, p ConnPeer) uint32 {
+	host, port, err := net.SplitHostPort(p.String())
+	if err != nil {
+		return 0
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return 0
+	}
+	return canonicalPriority(ours, &net.TCPAddr{IP: ip, Port: portNum})
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// priorityMask is the BEP 40 mask for addresses that share their first
+// prefix bytes
+type priorityMask struct {
+	prefix int
+	mask   []byte
+}
+
+// most specific first, the last one is for everything else
+var (
+	v4Masks = []priorityMask{
+		{3, []byte{0xff, 0xff, 0xff, 0xff}},
+		{2, []byte{0xff, 0xff, 0xff, 0x55}},
+		{0, []byte{0xff, 0xff, 0x55, 0x55}},
+	}
+	v6Masks = []priorityMask{
+		{5, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{4, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55}},
+		{0, []byte{0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55}},
+	}
+)
+
+// canonicalPriority is BEP 40's priority for a connection between a and b,
+// both ends work out the same number. Peers at capacity are kept or dialed
+// highest priority first, which makes the swarm's connections hard to skew
+// from any one network.
+func canonicalPriority(a, b *net.TCPAddr) uint32 {
+	if a.IP.Equal(b.IP) {
+		ports := []int{a.Port, b.Port}
+		sort.Ints(ports)
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint16(buf, uint16(ports[0]))
+		binary.BigEndian.PutUint16(buf[2:], uint16(ports[1]))
+		return crc32.Checksum(buf, castagnoli)
+	}
+
+	ipA, ipB, masks := a.IP.To4(), b.IP.To4(), v4Masks
+	if ipA == nil || ipB == nil {
+		// IPv6 only looks at the network half of the address
+		ipA, ipB, masks = a.IP.To16()[:8], b.IP.To16()[:8], v6Masks
+	}
+	var mask []byte
+	for _, m := range masks {
+		if bytes.Equal(ipA[:m.prefix], ipB[:m.prefix]) {
+			mask = m.mask
+			break
+		}
+	}
+	maskedA, maskedB := make([]byte, len(mask)), make([]byte, len(mask))
+	for i := range mask {
+		maskedA[i] = ipA[i] & mask[i]
+		maskedB[i] = ipB[i] & mask[i]
+	}
+	if bytes.Compare(maskedA, maskedB) > 0 {
+		maskedA, maskedB = maskedB, maskedA
+	}
+	return crc32.Checksum(append(maskedA, maskedB...), castagnoli)
+}
+
+// acquireHalfOpen waits for one of the client's dialing slots
+func (c *Client) acquireHalfOpen(ctx context.Context) error {
+	select {
+	case c.halfOpen <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) releaseHalfOpen() {
+	<-c.halfOpen
+}
+
+// learnLocalIP remembers the local end of a connection we made, for working
+// out priorities when we haven't been told our external IP.
+func (c *Client) learnLocalIP(addr net.Addr) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.localIP == nil {
+		c.localIP = tcp.IP
+	}
+}
+
+// ourAddr is our end of connections for BEP 40: the external IP from the
+// config or the one we've seen on our own connections, and our listen port.
+func (c *Client) ourAddr() *net.TCPAddr {
+	c.Lock()
+	defer c.Unlock()
+	addr := &net.TCPAddr{IP: c.config.ExternalIP}
+	if addr.IP == nil {
+		addr.IP = c.localIP
+	}
+	if addr.IP == nil {
+		addr.IP = net.IPv4zero
+	}
+	if tcp, ok := c.Addr().(*net.TCPAddr); ok {
+		addr.Port = tcp.Port
+	}
+	return addr
+}
@@ -0,0 +1,513 @@
+package torgo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/zanadar/torgo/bencode"
+)
+
+func Test_canonicalPriority(t *testing.T) {
+	addr := func(s string) *net.TCPAddr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	// the examples from BEP 40
+	cases := []struct {
+		a, b     string
+		expected uint32
+	}{
+		{"123.213.32.10:6881", "98.76.54.32:6881", 0xec2d7224},
+		{"123.213.32.10:6881", "123.213.32.234:6881", 0x99568189},
+	}
+	for _, tc := range cases {
+		if got := canonicalPriority(addr(tc.a), addr(tc.b)); got != tc.expected {
+			t.Errorf("%s %s: got %x; want %x", tc.a, tc.b, got, tc.expected)
+		}
+		if got := canonicalPriority(addr(tc.b), addr(tc.a)); got != tc.expected {
+			t.Errorf("%s %s: got %x the other way round; want %x", tc.b, tc.a, got, tc.expected)
+		}
+	}
+
+	same := canonicalPriority(addr("10.0.0.1:1000"), addr("10.0.0.1:2000"))
+	if same != canonicalPriority(addr("10.0.0.1:2000"), addr("10.0.0.1:1000")) {
+		t.Error("priority on the same IP depends on which end works it out")
+	}
+	v6 := canonicalPriority(addr("[2001:db8::1]:6881"), addr("[2001:db9::1]:6881"))
+	if v6 != canonicalPriority(addr("[2001:db9::1]:6881"), addr("[2001:db8::1]:6881")) {
+		t.Error("IPv6 priority depends on which end works it out")
+	}
+}
+
+func Test_dialStateBackoff(t *testing.T) {
+	now := time.Now()
+	d := &dialState{}
+	for i, expected := range []time.Duration{RETRY_BACKOFF, 2 * RETRY_BACKOFF, 4 * RETRY_BACKOFF} {
+		d.failed(now)
+		if got := d.next.Sub(now); got != expected {
+			t.Errorf("failure %d: backed off %v; want %v", i+1, got, expected)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		d.failed(now)
+	}
+	if got := d.next.Sub(now); got != MAX_RETRY_BACKOFF {
+		t.Errorf("backed off %v; want at most %v", got, MAX_RETRY_BACKOFF)
+	}
+}
+
+// listenPeer answers one connection with a handshake from id and hands it
+// back to the test.
+func listenPeer(t *testing.T, infoHash [20]byte, id string) (*net.TCPAddr, chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if _, err := Unmarshal(conn); err != nil {
+			conn.Close()
+			return
+		}
+		hs := Handshake{InfoHash: infoHash}
+		copy(hs.PeerId[:], id)
+		conn.Write(hs.Marshall())
+		conns <- conn
+	}()
+	return l.Addr().(*net.TCPAddr), conns
+}
+
+func Test_connectPeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data to connect over"), 8).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, conns := listenPeer(t, tor.InfoHash(), "-XX0000-good-peer-id")
+	// nothing listens on a port we've just closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	logger := log.NewNopLogger()
+	tor.Lock()
+	tor.PeerList = []ConnPeer{newPeer("127.0.0.1", good.Port, logger), newPeer("127.0.0.1", bad.Port, logger)}
+	ctx := tor.ctx
+	tor.Unlock()
+	tor.connectPeers(ctx)
+
+	var conn net.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("good peer was never dialed")
+	}
+	for i := 0; peerCount(tor) != 1; i++ {
+		if i == 100 {
+			t.Fatal("good peer never added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	failures := func() (int, bool) {
+		tor.Lock()
+		defer tor.Unlock()
+		d := tor.dialState(bad.String())
+		return d.failures, d.connecting || time.Now().Before(d.next)
+	}
+	for i := 0; ; i++ {
+		n, waiting := failures()
+		if n == 1 && waiting {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("bad peer has %d failures", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// it's backing off, so isn't dialed again yet
+	tor.connectPeers(ctx)
+	if n, _ := failures(); n != 1 {
+		t.Errorf("bad peer redialed during its backoff, %d failures", n)
+	}
+
+	// the good peer hangs up and is dropped
+	conn.Close()
+	for i := 0; peerCount(tor) != 0; i++ {
+		if i == 100 {
+			t.Fatal("dead peer never dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Lock()
+	open := c.conns
+	c.Unlock()
+	if open != 0 {
+		t.Errorf("%d connections still counted after the peer went", open)
+	}
+}
+
+func Test_acquireHalfOpen(t *testing.T) {
+	c := &Client{halfOpen: make(chan struct{}, 1)}
+	if err := c.acquireHalfOpen(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.acquireHalfOpen(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v with every slot taken; want the context's error", err)
+	}
+	c.releaseHalfOpen()
+	if err := c.acquireHalfOpen(context.Background()); err != nil {
+		t.Errorf("got %v after a slot was released", err)
+	}
+}
+
+func Test_addPeerPrefersPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewClient(context.Background(), ClientConfig{
+		DownloadDir:        dir,
+		ResumeDir:          dir,
+		MaxConnsPerTorrent: 1,
+		ExternalIP:         net.ParseIP("123.213.32.10"),
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data to connect over"), 8).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer in the same /24 has the lower priority, see Test_canonicalPriority
+	low := &fakePeer{id: "123.213.32.234:0"}
+	high := &fakePeer{id: "98.76.54.32:0"}
+	ours := c.ourAddr()
+	if peerPriority(ours, low) >= peerPriority(ours, high) {
+		t.Fatal("test peers are the wrong way round")
+	}
+
+	if err := tor.addPeer(high); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.addPeer(low); err != errTooManyConns {
+		t.Errorf("got %v adding a lower priority peer when full; want %v", err, errTooManyConns)
+	}
+	tor.Lock()
+	delete(tor.peerConns, high.id)
+	tor.Unlock()
+	if err := tor.addPeer(low); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.addPeer(high); err != nil {
+		t.Errorf("got %v adding a higher priority peer when full", err)
+	}
+	tor.Lock()
+	_, hasLow := tor.peerConns[low.id]
+	_, hasHigh := tor.peerConns[high.id]
+	tor.Unlock()
+	if hasLow || !hasHigh {
+		t.Errorf("got low %v high %v; want the higher priority peer kept", hasLow, hasHigh)
+	}
+}
+
+func Test_UnmarshalHandshake(t *testing.T) {
+	hs := Handshake{}
+	copy(hs.InfoHash[:], "an info hash 20 long")
+	copy(hs.PeerId[:], "-XX0000-abcdefghijkl")
+	got, err := Unmarshal(bytes.NewReader(hs.Marshall()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != hs {
+		t.Errorf("got %+v; want %+v", *got, hs)
+	}
+
+	wrongName := hs.Marshall()
+	copy(wrongName[1:], "BitTorrent protocoI")
+	wrongLength := hs.Marshall()
+	wrongLength[0] = 18
+	cases := []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"wrong protocol", wrongName, errBadProtocol},
+		{"wrong length", wrongLength, errBadProtocol},
+		{"short", hs.Marshall()[:40], io.ErrUnexpectedEOF},
+		{"empty", nil, io.EOF},
+	}
+	for _, tc := range cases {
+		if _, err := Unmarshal(bytes.NewReader(tc.data)); err != tc.expected {
+			t.Errorf("%s: got %v; want %v", tc.name, err, tc.expected)
+		}
+	}
+}
+
+func Test_checkReply(t *testing.T) {
+	ours := Handshake{}
+	copy(ours.InfoHash[:], "an info hash 20 long")
+	copy(ours.PeerId[:], "-TG0001-ourownpeerid")
+	reply := func(infoHash, id string) *Handshake {
+		h := &Handshake{}
+		copy(h.InfoHash[:], infoHash)
+		copy(h.PeerId[:], id)
+		return h
+	}
+	cases := []struct {
+		reply      *Handshake
+		advertised string
+		expected   error
+	}{
+		{reply("an info hash 20 long", "-XX0000-theirpeerid0"), "", nil},
+		{reply("an info hash 20 long", "-XX0000-theirpeerid0"), "-XX0000-theirpeerid0", nil},
+		{reply("another info hash 20", "-XX0000-theirpeerid0"), "", errInfoHashMismatch},
+		{reply("an info hash 20 long", "-TG0001-ourownpeerid"), "", errSelfConnection},
+		{reply("an info hash 20 long", "-XX0000-theirpeerid0"), "-XX0000-someoneelse0", errPeerIDMismatch},
+	}
+	for i, tc := range cases {
+		if got := checkReply(ours, tc.reply, tc.advertised); got != tc.expected {
+			t.Errorf("%d: got %v; want %v", i, got, tc.expected)
+		}
+	}
+}
+
+func Test_ConnectChecksInfoHash(t *testing.T) {
+	var wrong [20]byte
+	copy(wrong[:], "another info hash 20")
+	addr, _ := listenPeer(t, wrong, "-XX0000-good-peer-id")
+	hs := Handshake{}
+	copy(hs.InfoHash[:], "an info hash 20 long")
+	p := newPeer("127.0.0.1", addr.Port, log.NewNopLogger())
+	if err := p.Connect(hs); err != errInfoHashMismatch {
+		t.Errorf("got %v; want %v", err, errInfoHashMismatch)
+	}
+}
+
+func Test_selfConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+	ti := newTestTorrent(t, dir, []byte("some data to connect over"), 8).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tracker hands us our own address
+	us := c.Addr().(*net.TCPAddr)
+	tor.Lock()
+	tor.PeerList = []ConnPeer{newPeer("127.0.0.1", us.Port, log.NewNopLogger())}
+	ctx := tor.ctx
+	tor.Unlock()
+	tor.connectPeers(ctx)
+
+	self := func() bool {
+		tor.Lock()
+		defer tor.Unlock()
+		d := tor.dialState(us.String())
+		return d.self && !d.connecting
+	}
+	for i := 0; !self(); i++ {
+		if i == 100 {
+			t.Fatal("never noticed it dialed itself")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := peerCount(tor); n != 0 {
+		t.Errorf("got %d peers after dialing ourselves", n)
+	}
+	// and it isn't dialed again
+	tor.connectPeers(ctx)
+	tor.Lock()
+	connecting := tor.connecting
+	tor.Unlock()
+	if connecting != 0 {
+		t.Error("dialed ourselves again")
+	}
+}
+
+func Test_keepNewer(t *testing.T) {
+	low, high := "-XX0000-aaaaaaaaaaaa", "-XX0000-bbbbbbbbbbbb"
+	conn := func(id string, outgoing bool) *Peer {
+		p := newPeer("10.0.0.1", 6881, nil)
+		p.id, p.outgoing = id, outgoing
+		return p
+	}
+	torrent := func(id string) *Torrent {
+		tor := &Torrent{}
+		copy(tor.PeerId[:], id)
+		return tor
+	}
+
+	// both ends connect to each other at once, each ends up with a
+	// connection it made and one the other end made
+	a, b := torrent(low), torrent(high)
+	aKeeps := func(old, newer *Peer) *Peer {
+		if a.keepNewer(old, newer) {
+			return newer
+		}
+		return old
+	}
+	bKeeps := func(old, newer *Peer) *Peer {
+		if b.keepNewer(old, newer) {
+			return newer
+		}
+		return old
+	}
+	aOut, aIn := conn(high, true), conn(high, false)
+	bOut, bIn := conn(low, true), conn(low, false)
+	for _, keep := range []*Peer{aKeeps(aOut, aIn), aKeeps(aIn, aOut)} {
+		if keep != aOut {
+			t.Error("the lower id didn't keep the connection it made")
+		}
+	}
+	for _, keep := range []*Peer{bKeeps(bOut, bIn), bKeeps(bIn, bOut)} {
+		if keep != bIn {
+			t.Error("the higher id didn't keep the connection the lower one made")
+		}
+	}
+
+	// made the same way the first one stays
+	if a.keepNewer(conn(high, false), conn(high, false)) {
+		t.Error("replaced a connection with one made the same way")
+	}
+}
+
+func Test_parsePeers(t *testing.T) {
+	compact, err := bencode.Marshal(string([]byte{10, 0, 0, 1, 0x1a, 0xe1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := bencode.Marshal([]trackerPeer{
+		{IP: "10.0.0.2", Port: 6881, PeerID: "-XX0000-theirpeerid0"},
+		{IP: "10.0.0.3", Port: 6882},
+		{IP: "10.0.0.4", Port: 0}, // no use to us
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		raw      []byte
+		expected []string
+		ids      []string
+	}{
+		{compact, []string{"10.0.0.1:6881"}, []string{""}},
+		{long, []string{"10.0.0.2:6881", "10.0.0.3:6882"}, []string{"-XX0000-theirpeerid0", ""}},
+		{nil, nil, nil},
+	}
+	for i, tc := range cases {
+		peers, err := parsePeers(tc.raw, log.NewNopLogger())
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(peers) != len(tc.expected) {
+			t.Fatalf("%d: got %d peers; want %d", i, len(peers), len(tc.expected))
+		}
+		for j, p := range peers {
+			if p.String() != tc.expected[j] || p.(*Peer).advertisedID != tc.ids[j] {
+				t.Errorf("%d: got %v with id %q; want %v with %q", i, p, p.(*Peer).advertisedID, tc.expected[j], tc.ids[j])
+			}
+		}
+	}
+}
+
+func Test_peerOutbox(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	p := newPeer("10.0.0.1", 6881, log.NewNopLogger())
+	p.setConn(ours)
+
+	// nothing's sending, so the messages pile up
+	for i := 0; i < MAX_OUTBOX/2; i++ {
+		if p.backlogged() {
+			t.Fatalf("backlogged after %d messages", i)
+		}
+		p.Message(Have{Index: i})
+	}
+	if !p.backlogged() {
+		t.Error("not backlogged with half an outbox waiting")
+	}
+	for i := MAX_OUTBOX / 2; i < MAX_OUTBOX; i++ {
+		p.Message(Have{Index: i})
+	}
+
+	// one more is too many, and Message mustn't wait for room
+	done := make(chan struct{})
+	go func() {
+		p.Message(Have{Index: MAX_OUTBOX})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message waited on a full outbox")
+	}
+	theirs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := theirs.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from a peer that fell behind; want it hung up", err)
+	}
+}
+
+func Test_peerCloseStalled(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	p := newPeer("10.0.0.1", 6881, log.NewNopLogger())
+	p.setConn(ours)
+	go p.writeLoop()
+
+	// nothing reads from theirs, so the writer is stuck sending this
+	p.Message(Have{Index: 1})
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CLOSE_TIMEOUT + 5*time.Second):
+		t.Fatal("Close waited on a peer that isn't reading")
+	}
+}
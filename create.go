@@ -0,0 +1,352 @@
+package torgo
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zanadar/torgo/bencode"
+)
+
+const (
+	MIN_PIECE_LENGTH    = 16 << 10
+	MAX_PIECE_LENGTH    = 16 << 20
+	TARGET_PIECE_COUNT  = 1500
+	DEFAULT_CREATED_BY  = "torgo"
+	PAD_FILE_ATTRIBUTES = "p"
+)
+
+// CreateOptions describe a torrent for CreateTorrent to make
+type CreateOptions struct {
+	Path         string     // file or directory to make the torrent from
+	PieceLength  int64      // 0 picks one based on the total size
+	Announce     [][]string // tiers of trackers, the first is also "announce"
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // left out if zero
+	Private      bool
+	URLList      []string // web seeds
+	Pad          bool     // add padding files so each file starts on a piece boundary
+	Workers      int      // goroutines hashing pieces, defaults to the number of CPUs
+}
+
+// createFile is a file going into a new torrent
+type createFile struct {
+	diskPath string
+	path     []string
+	length   int64
+	pad      bool
+}
+
+// CreateTorrent hashes the data at opts.Path and writes a .torrent for it to
+// w, returning its info hash.
+func CreateTorrent(w io.Writer, opts CreateOptions) ([]byte, error) {
+	name, files, single, err := walkCreateFiles(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s is empty", opts.Path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = pickPieceLength(total)
+	}
+	if pieceLength < MIN_PIECE_LENGTH || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d must be a power of two of at least %d", pieceLength, MIN_PIECE_LENGTH)
+	}
+	if opts.Pad && !single {
+		files = padFiles(files, pieceLength)
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	pieces, err := hashFiles(files, pieceLength, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       string(pieces),
+	}
+	if single {
+		info["length"] = files[0].length
+	} else {
+		list := make([]interface{}, len(files))
+		for i, f := range files {
+			path := make([]interface{}, len(f.path))
+			for j, part := range f.path {
+				path[j] = part
+			}
+			entry := map[string]interface{}{"length": f.length, "path": path}
+			if f.pad {
+				entry["attr"] = PAD_FILE_ATTRIBUTES
+			}
+			list[i] = entry
+		}
+		info["files"] = list
+	}
+	if opts.Private {
+		info["private"] = int64(1)
+	}
+
+	meta := map[string]interface{}{}
+	if len(opts.Announce) > 0 && len(opts.Announce[0]) > 0 {
+		meta["announce"] = opts.Announce[0][0]
+		if len(opts.Announce) > 1 || len(opts.Announce[0]) > 1 {
+			tiers := make([]interface{}, len(opts.Announce))
+			for i, tier := range opts.Announce {
+				urls := make([]interface{}, len(tier))
+				for j, u := range tier {
+					urls[j] = u
+				}
+				tiers[i] = urls
+			}
+			meta["announce-list"] = tiers
+		}
+	}
+	if opts.Comment != "" {
+		meta["comment"] = opts.Comment
+	}
+	createdBy := opts.CreatedBy
+	if createdBy == "" {
+		createdBy = DEFAULT_CREATED_BY
+	}
+	meta["created by"] = createdBy
+	if !opts.CreationDate.IsZero() {
+		meta["creation date"] = opts.CreationDate.Unix()
+	}
+	if len(opts.URLList) > 0 {
+		urls := make([]interface{}, len(opts.URLList))
+		for i, u := range opts.URLList {
+			urls[i] = u
+		}
+		meta["url-list"] = urls
+	}
+
+	// the info hash is taken over exactly the bytes that go in the file
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	meta["info"] = bencode.RawMessage(rawInfo)
+	if err := bencode.NewEncoder(w).Encode(meta); err != nil {
+		return nil, err
+	}
+	infoHash := sha1.Sum(rawInfo)
+	return infoHash[:], nil
+}
+
+// walkCreateFiles finds the files under path in the order they go in the
+// torrent. single is true if path is a plain file.
+func walkCreateFiles(path string) (name string, files []createFile, single bool, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, false, err
+	}
+	name = filepath.Base(filepath.Clean(path))
+	if !fi.IsDir() {
+		return name, []createFile{{diskPath: path, path: []string{name}, length: fi.Size()}}, true, nil
+	}
+
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{
+			diskPath: p,
+			path:     strings.Split(filepath.ToSlash(rel), "/"),
+			length:   fi.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", nil, false, err
+	}
+	if len(files) == 0 {
+		return "", nil, false, fmt.Errorf("%s has no files in it", path)
+	}
+	// Walk is lexical on the OS path, keep the order stable across platforms
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Join(files[i].path, "/") < strings.Join(files[j].path, "/")
+	})
+	return name, files, false, nil
+}
+
+// pickPieceLength aims for around TARGET_PIECE_COUNT pieces
+func pickPieceLength(total int64) int64 {
+	length := int64(MIN_PIECE_LENGTH)
+	for length < MAX_PIECE_LENGTH && total/length > TARGET_PIECE_COUNT {
+		length *= 2
+	}
+	return length
+}
+
+// padFiles puts a BEP 47 padding file after every file but the last that
+// doesn't end on a piece boundary
+func padFiles(files []createFile, pieceLength int64) []createFile {
+	var padded []createFile
+	var offset int64
+	for i, f := range files {
+		padded = append(padded, f)
+		offset += f.length
+		if i == len(files)-1 || offset%pieceLength == 0 {
+			continue
+		}
+		pad := pieceLength - offset%pieceLength
+		padded = append(padded, createFile{
+			path:   []string{".pad", strconv.FormatInt(pad, 10)},
+			length: pad,
+			pad:    true,
+		})
+		offset += pad
+	}
+	return padded
+}
+
+var errFileChanged = errors.New("file changed while hashing")
+
+// createReader reads files one after another as if they were one, padding
+// files read as zeros
+type createReader struct {
+	files []createFile
+	cur   io.Reader
+	f     *os.File
+	want  int64
+}
+
+func (r *createReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.files) == 0 {
+				return 0, io.EOF
+			}
+			next := r.files[0]
+			r.files = r.files[1:]
+			r.want = next.length
+			if next.pad {
+				r.cur = io.LimitReader(zeros{}, next.length)
+				continue
+			}
+			f, err := os.Open(next.diskPath)
+			if err != nil {
+				return 0, err
+			}
+			r.f = f
+			r.cur = io.LimitReader(f, next.length)
+		}
+		n, err := r.cur.Read(b)
+		r.want -= int64(n)
+		if err == io.EOF {
+			r.Close()
+			if r.want != 0 {
+				return n, errFileChanged
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *createReader) Close() error {
+	r.cur = nil
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// hashFiles reads the files a piece at a time and hashes the pieces on workers
+// goroutines, only a few pieces per worker are held in memory at once.
+func hashFiles(files []createFile, pieceLength int64, workers int) ([]byte, error) {
+	var total int64
+	for _, f := range files {
+		total += f.length
+	}
+	count := int((total + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, count*sha1.Size)
+
+	type job struct {
+		index int
+		buf   []byte
+	}
+	jobs := make(chan job, workers)
+	free := make(chan []byte, workers*2)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, pieceLength)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				sum := sha1.Sum(j.buf)
+				copy(pieces[j.index*sha1.Size:], sum[:])
+				free <- j.buf[:cap(j.buf)]
+			}
+		}()
+	}
+
+	r := &createReader{files: files}
+	defer r.Close()
+	var err error
+	for i := 0; i < count; i++ {
+		buf := <-free
+		var n int
+		n, err = io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF && i == count-1 {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+		jobs <- job{index: i, buf: buf[:n]}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errFileChanged
+	}
+
+	return pieces, err
+}
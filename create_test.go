@@ -0,0 +1,104 @@
+package torgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func Test_pickPieceLength(t *testing.T) {
+	cases := []struct {
+		total    int64
+		expected int64
+	}{
+		{1, 16 << 10},
+		{1500 * 16 << 10, 16 << 10},
+		{1501 * 16 << 10, 32 << 10},
+		{700 << 20, 512 << 10},
+		{1 << 40, 16 << 20},
+	}
+	for _, tc := range cases {
+		if got := pickPieceLength(tc.total); got != tc.expected {
+			t.Errorf("pickPieceLength(%d): got %d; want %d", tc.total, got, tc.expected)
+		}
+	}
+}
+
+func Test_CreateTorrent(t *testing.T) {
+	cases := []struct {
+		name   string
+		pad    bool
+		single bool
+	}{
+		{"single file", false, true},
+		{"directory", false, false},
+		{"directory with padding", true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "torgo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src := filepath.Join(dir, "src")
+			os.MkdirAll(filepath.Join(src, "sub"), 0755)
+			ioutil.WriteFile(filepath.Join(src, "b"), bytes.Repeat([]byte("b"), 40000), 0644)
+			ioutil.WriteFile(filepath.Join(src, "sub", "a"), bytes.Repeat([]byte("a"), 20000), 0644)
+			ioutil.WriteFile(filepath.Join(src, "c"), []byte("c"), 0644)
+			path := src
+			if tc.single {
+				path = filepath.Join(src, "b")
+			}
+
+			var buf bytes.Buffer
+			infoHash, err := CreateTorrent(&buf, CreateOptions{
+				Path:         path,
+				Announce:     [][]string{{"http://one/announce", "http://two/announce"}, {"udp://three"}},
+				Comment:      "a comment",
+				CreationDate: time.Unix(1500000000, 0),
+				Private:      true,
+				URLList:      []string{"http://seed/"},
+				Pad:          tc.pad,
+				Workers:      3,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			torrent := buf.String()
+			for _, want := range []string{"8:announce19:http://one/announce", "13:announce-listll19:http://one/announce19:http://two/announceel11:udp://threeee",
+				"7:comment9:a comment", "10:created by5:torgo", "13:creation datei1500000000e", "7:privatei1e", "8:url-listl12:http://seed/e"} {
+				if !strings.Contains(torrent, want) {
+					t.Errorf("torrent is missing %q", want)
+				}
+			}
+			if strings.Contains(torrent, "4:attr1:p") != tc.pad {
+				t.Errorf("padding files present: %v; want %v", !tc.pad, tc.pad)
+			}
+
+			ti, err := parseTorrent(bytes.NewReader(buf.Bytes()), log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ti.InfoHash, infoHash) {
+				t.Fatalf("parsed info hash %x; created %x", ti.InfoHash, infoHash)
+			}
+
+			// the data it was made from should check out completely
+			result, err := Verify(ti, ClientConfig{DownloadDir: filepath.Dir(path)}, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Complete() {
+				t.Errorf("verify found %d/%d pieces: %+v", result.Verified, result.Pieces, result.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package torgo
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Allocation is how space is set aside for a torrent's files on disk
+type Allocation int
+
+const (
+	// AllocSparse grows files to their full length without writing them, the
+	// filesystem only finds room for blocks as they're written
+	AllocSparse Allocation = iota
+	// AllocFull reserves every block up front with fallocate on Linux, so a
+	// torrent that's started can't run out of space. Other platforms get
+	// sparse files.
+	AllocFull
+)
+
+func (a Allocation) String() string {
+	switch a {
+	case AllocSparse:
+		return "sparse"
+	case AllocFull:
+		return "full"
+	}
+	return "unknown"
+}
+
+var ErrNotEnoughSpace = errors.New("not enough free space for torrent")
+
+// allocator is a Piecer that can set aside space for a torrent's files
+type allocator interface {
+	allocate(mode Allocation) error
+}
+
+// allocateFile grows f to length, reserving its blocks if mode is AllocFull
+func allocateFile(f *os.File, length int64, mode Allocation) error {
+	if mode == AllocFull {
+		err := fallocate(f, length)
+		if err == nil || isNoSpace(err) {
+			return err
+		}
+		// the filesystem can't do it, settle for sparse
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < length {
+		return f.Truncate(length)
+	}
+	return nil
+}
+
+// isNoSpace is true for errors from writing to a full disk, or to one the
+// user's quota has run out on
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// onDisk is true for storages that keep torrents under the download directory
+func onDisk(s Storage) bool {
+	switch s.(type) {
+	case FileStorage, MmapStorage:
+		return true
+	}
+	return false
+}
+
+// spaceNeeded is how many more bytes the files a torrent wants will take up
+// and how many are free where they're going, ok is false if we can't tell.
+func spaceNeeded(info StorageInfo) (need, free int64, ok bool) {
+	for _, f := range info.Files {
+		if f.Pad || f.Skip {
+			continue
+		}
+		need += f.Length
+		if fi, err := os.Stat(filepath.Join(info.Dir, f.Path)); err == nil {
+			need -= diskUsage(fi)
+		}
+	}
+	if need < 0 {
+		need = 0
+	}
+	// the directory may not have been made yet, what it'll go in has to do
+	dir := info.Dir
+	if dir == "" {
+		dir = "."
+	}
+	for {
+		if free, ok = freeSpace(dir); ok || filepath.Dir(dir) == dir {
+			return need, free, ok
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// moveFiles moves each of from to the same place in to, putting back the
+// ones it's moved if one of them fails. Directories under root that are left
+// empty are removed.
+func moveFiles(root string, from, to []string) error {
+	for i := range from {
+		if err := moveFile(from[i], to[i]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				moveFile(to[j], from[j])
+			}
+			return err
+		}
+	}
+	for _, path := range from {
+		pruneDirs(root, path)
+	}
+	return nil
+}
+
+// moveFile renames src to dst, making the directories dst goes in. It's
+// linked to dst before src is removed, so something already at dst is never
+// replaced, the move fails instead, even if it turns up while we're at it.
+// Across filesystems, or onto one without hard links, it's copied, see
+// copyFile.
+func moveFile(src, dst string) error {
+	if src == dst {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if os.IsExist(err) {
+		return &os.LinkError{Op: "move", Old: src, New: dst, Err: os.ErrExist}
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to a hidden file next to dst that's linked to dst once
+// it's all there, so nothing ever sees dst half written. Where there are no
+// hard links it's copied again into a dst only we can have created. Either
+// way something already at dst is never replaced.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeCopy(tmp, in, fi); err != nil {
+		return err
+	}
+	err = os.Link(tmp.Name(), dst)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if err := writeCopy(out, in, fi); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// writeCopy copies in to out and closes out, giving it in's mode and
+// modification time.
+func writeCopy(out, in *os.File, fi os.FileInfo) error {
+	_, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), fi.Mode())
+	}
+	if err == nil {
+		// the resume data goes by modification times
+		err = os.Chtimes(out.Name(), fi.ModTime(), fi.ModTime())
+	}
+	return err
+}
+
+// pruneDirs removes the directories between path and root that are empty
+func pruneDirs(root, path string) {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); dir != root && dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return // it still has something in it
+		}
+	}
+}
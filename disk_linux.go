@@ -0,0 +1,34 @@
+package torgo
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, length); err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// freeSpace is how many bytes we can write under dir
+func freeSpace(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+// diskUsage is how much space a file takes up, less than its length if it's
+// sparse
+func diskUsage(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
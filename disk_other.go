@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package torgo
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFallocate = errors.New("fallocate isn't supported on this platform")
+
+func fallocate(f *os.File, length int64) error {
+	return errNoFallocate
+}
+
+// freeSpace can't tell how much room there is here
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
+
+func diskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
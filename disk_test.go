@@ -0,0 +1,329 @@
+package torgo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func Test_allocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []Allocation{AllocSparse, AllocFull} {
+		t.Run(mode.String(), func(t *testing.T) {
+			entries := []fileEntry{
+				{path: mode.String() + "/wanted", length: 1 << 16},
+				{path: mode.String() + "/skipped", length: 1 << 16, offset: 1 << 16, skip: true},
+			}
+			p, err := newPiecerFS(dir, entries, 2, 1<<16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			if err := p.allocate(mode); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(filepath.Join(dir, mode.String(), "wanted"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 1<<16 {
+				t.Errorf("file is %d bytes; want %d", fi.Size(), 1<<16)
+			}
+			if mode == AllocFull && runtime.GOOS == "linux" && diskUsage(fi) < 1<<16 {
+				t.Errorf("only %d bytes were reserved", diskUsage(fi))
+			}
+			if _, err := os.Stat(filepath.Join(dir, mode.String(), "skipped")); !os.IsNotExist(err) {
+				t.Error("a skipped file was allocated")
+			}
+		})
+	}
+}
+
+func Test_spaceNeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "half"), make([]byte, 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := StorageInfo{
+		Dir: filepath.Join(dir, "not", "made", "yet"),
+		Files: []StorageFile{
+			{Path: "../../../half", Length: 1 << 17},
+			{Path: "pad", Length: 1 << 20, Pad: true},
+			{Path: "skipped", Length: 1 << 20, Skip: true},
+		},
+	}
+	need, _, ok := spaceNeeded(info)
+	if runtime.GOOS == "linux" && !ok {
+		t.Error("couldn't tell how much space there is")
+	}
+	if need != 1<<16 {
+		t.Errorf("need %d bytes; want %d", need, 1<<16)
+	}
+}
+
+func Test_RefuseLowSpace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("free space is only known on linux")
+	}
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewClient(context.Background(), ClientConfig{
+		DownloadDir:    dir,
+		ResumeDir:      dir,
+		RefuseLowSpace: true,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	huge := &TorrentInfo{
+		Info:     Info{Name: "huge", Length: 1 << 60, PieceLength: 1 << 58, Pieces: strings.Repeat("x", 4*20)},
+		InfoHash: []byte("a-very-big-torrent!!"),
+	}
+	if _, err := c.AddTorrent(huge); err != ErrNotEnoughSpace {
+		t.Errorf("got %v; want %v", err, ErrNotEnoughSpace)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "huge")); !os.IsNotExist(err) {
+		t.Error("the refused torrent's file was created")
+	}
+}
+
+func Test_diskFailedPauses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor := newTestTorrent(t, dir, []byte("some data"), 4)
+	tor.start()
+	defer tor.stop()
+	running := func() bool {
+		tor.Lock()
+		defer tor.Unlock()
+		return tor.running()
+	}
+
+	tor.diskFailed(&os.PathError{Op: "write", Path: "data", Err: syscall.EIO})
+	if !running() || tor.Stats().State == StateError {
+		t.Fatal("paused for an error that isn't running out of space")
+	}
+	full := &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}
+	tor.diskFailed(full)
+	if running() {
+		t.Error("torrent kept running with a full disk")
+	}
+	if st := tor.Stats(); st.State != StateError || st.Err != full {
+		t.Errorf("got state %v, %v; want %v, %v", st.State, st.Err, StateError, full)
+	}
+}
+
+// Pieces the cache couldn't write for want of space are written once the
+// torrent is resumed
+func Test_resumeRetriesFullDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor := newTestTorrent(t, dir, []byte("some data"), 4)
+	full := &os.PathError{Op: "write", Path: "data", Err: syscall.ENOSPC}
+	store := &countingPiecer{Piecer: tor.Piecer, fail: full}
+	info := StorageInfo{Files: []StorageFile{{Path: "data", Length: 9}}, PieceCount: 3, PieceLength: 4}
+	tor.cache = newBlockCache(store, info, 64, 1, tor.diskFailed)
+	tor.Piecer = tor.cache
+	tor.start()
+	defer tor.stop()
+
+	tor.cache.Write(0, 0, []byte("emos"))
+	tor.cache.MarkComplete(0)
+	for i := 0; i < 100 && tor.Stats().State != StateError; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := tor.Stats(); st.State != StateError || st.Err != full {
+		t.Fatalf("got state %v, %v; want %v, %v", st.State, st.Err, StateError, full)
+	}
+
+	// room's been made
+	tor.stop()
+	store.mu.Lock()
+	store.fail = nil
+	store.mu.Unlock()
+	tor.start()
+	if err := tor.cache.flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "data"))
+	if err != nil || string(got[:4]) != "emos" {
+		t.Errorf("got %q, %v; want the piece written", got, err)
+	}
+}
+
+func Test_IncompleteDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := ClientConfig{
+		DownloadDir:      filepath.Join(dir, "done"),
+		IncompleteDir:    filepath.Join(dir, "incomplete"),
+		IncompleteSuffix: PART_SUFFIX,
+		ResumeDir:        dir,
+	}
+	c, err := NewClient(context.Background(), config, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ti, data := multiFileInfo()
+	tor, err := c.AddTorrent(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := filepath.Join(dir, "incomplete", "multi", "a.mkv"+PART_SUFFIX)
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("in progress file isn't in the incomplete directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done")); !os.IsNotExist(err) {
+		t.Error("something was put in the download directory before the torrent was complete")
+	}
+
+	for i := 0; i < 3; i++ {
+		tor.handlePiece(pieceMsg(data, 8, i))
+	}
+	select {
+	case <-tor.Complete():
+	case <-time.After(5 * time.Second):
+		t.Fatal("torrent never completed")
+	}
+	for _, f := range []string{"a.mkv", "b.txt", "sub/c.nfo"} {
+		if _, err := os.Stat(filepath.Join(dir, "done", "multi", f)); err != nil {
+			t.Errorf("%s wasn't moved: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "incomplete", "multi")); !os.IsNotExist(err) {
+		t.Error("the torrent's directory was left behind in the incomplete directory")
+	}
+	// it's read from where it's been moved to
+	got := make([]byte, len(data))
+	if err := tor.Piecer.Read(0, 0, got); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q, %v after moving; want %q", got, err, data)
+	}
+
+	// added again it's found where it was moved to
+	if err := c.Remove(tor.InfoHash()); err != nil {
+		t.Fatal(err)
+	}
+	tor, err = c.AddTorrent(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tor.Complete():
+	default:
+		t.Error("torrent wasn't complete when it was added again")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Error("adding the torrent again made a new incomplete file")
+	}
+}
+
+func Test_copyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("some data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(src, mtime, mtime)
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dst); string(b) != "some data" {
+		t.Errorf("copied %q", b)
+	}
+	if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("copy has mode %v and mtime %v; want %v and %v", fi.Mode(), fi.ModTime(), os.FileMode(0640), mtime)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("got %d files after copying; want 2", len(files))
+	}
+}
+
+func Test_copyFileKeepsExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	ioutil.WriteFile(src, []byte("new"), 0644)
+	ioutil.WriteFile(dst, []byte("already here"), 0644)
+	if err := copyFile(src, dst); !os.IsExist(err) {
+		t.Errorf("got %v copying over a file that was already there; want it to exist", err)
+	}
+	if b, _ := ioutil.ReadFile(dst); string(b) != "already here" {
+		t.Errorf("got %q in the file that was there; want it left alone", b)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("got %d files after copying; want 2", len(files))
+	}
+}
+
+func Test_moveFileKeepsExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	ioutil.WriteFile(src, []byte("new"), 0644)
+	ioutil.WriteFile(dst, []byte("already here"), 0644)
+	if err := moveFile(src, dst); err == nil {
+		t.Error("moved over a file that was already there")
+	}
+	if b, _ := ioutil.ReadFile(dst); string(b) != "already here" {
+		t.Errorf("got %q in the file that was there; want it left alone", b)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("file that couldn't be moved is gone: %v", err)
+	}
+}
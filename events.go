@@ -0,0 +1,132 @@
+package torgo
+
+import "time"
+
+// An event is a change to the torrent's state from outside its loop. While
+// the loop runs it's the only thing that changes the peers and the ones we
+// know about, the piece logs, the priorities, the deadlines and the limits,
+// everything else posts it an event.
+type event interface{}
+
+// peerAdded hands the torrent a peer that's shaken hands
+type peerAdded struct{ p ConnPeer }
+
+// peerDropped is sent once a peer's connection has died
+type peerDropped struct{ p *Peer }
+
+// readerWaiting is what a Reader is waiting for, its pieces come first
+type readerWaiting struct {
+	r  *Reader
+	rr readRange
+}
+
+// readerClosed forgets a Reader
+type readerClosed struct{ r *Reader }
+
+// priorityChanged sets the priority of the file at index file in the layout
+type priorityChanged struct {
+	file int
+	p    FilePriority
+}
+
+// sequentialChanged turns downloading pieces in order on or off
+type sequentialChanged struct{ on bool }
+
+// deadlineChanged sets the deadline for piece index, a zero d clears it
+type deadlineChanged struct {
+	index int
+	d     time.Time
+}
+
+// peerRatesChanged sets the limits each peer gets, see SetPeerRateLimits
+type peerRatesChanged struct{ down, up int64 }
+
+// dialed is how dialing a peer we know about went, cancelled if the torrent
+// stopped while it was at it
+type dialed struct {
+	known     *Peer
+	err       error
+	cancelled bool
+}
+
+// diskFailure is storage failing to write something
+type diskFailure struct{ err error }
+
+// moved is a complete torrent's files having been written out and moved, see
+// finish
+type moved struct{ written, err error }
+
+// posted is an event on its way to the loop, err hears how it went
+type posted struct {
+	ev  event
+	err chan error
+}
+
+// post hands ev to the loop and waits for it to be handled. If the loop isn't
+// running there's nothing to race with and it's handled straight away.
+func (t *Torrent) post(ev event) error {
+	t.Lock()
+	done := t.loopDone
+	t.Unlock()
+	if done != nil {
+		p := posted{ev: ev, err: make(chan error, 1)}
+		select {
+		case t.events <- p:
+			return <-p.err
+		case <-done:
+		}
+	}
+	return t.handleEvent(ev)
+}
+
+// handleEvent makes the change ev asks for, only the loop calls it while the
+// loop is running.
+func (t *Torrent) handleEvent(ev event) error {
+	switch ev := ev.(type) {
+	case peerAdded:
+		return t.handleAddPeer(ev.p)
+	case peerDropped:
+		t.handleDropPeer(ev.p)
+	case readerWaiting:
+		t.Lock()
+		t.readers[ev.r] = ev.rr
+		t.Unlock()
+		t.wakeup()
+	case readerClosed:
+		t.Lock()
+		delete(t.readers, ev.r)
+		t.Unlock()
+	case priorityChanged:
+		t.Lock()
+		t.filePriorities[ev.file] = ev.p
+		t.updatePiecePriorities()
+		t.checkComplete()
+		t.Unlock()
+		t.wakeup()
+	case sequentialChanged:
+		t.Lock()
+		t.sequential = ev.on
+		t.Unlock()
+		t.wakeup()
+	case deadlineChanged:
+		t.Lock()
+		if ev.d.IsZero() {
+			delete(t.deadlines, ev.index)
+		} else {
+			t.deadlines[ev.index] = ev.d
+		}
+		t.Unlock()
+		t.wakeup()
+	case peerRatesChanged:
+		t.handlePeerRates(ev.down, ev.up)
+	case dialed:
+		t.handleDialed(ev.known, ev.err, ev.cancelled)
+	case diskFailure:
+		t.handleDiskFailed(ev.err)
+	case moved:
+		t.Lock()
+		t.finishComplete(ev.written, ev.err)
+		t.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package torgo
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FilePriority is how much we want one of a torrent's files
+type FilePriority int
+
+const (
+	FileSkip FilePriority = iota
+	FileLow
+	FileNormal
+	FileHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case FileSkip:
+		return "skip"
+	case FileLow:
+		return "low"
+	case FileNormal:
+		return "normal"
+	case FileHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// AddOption changes a torrent as it's added to a Client, before anything is
+// opened on disk.
+type AddOption func(*Torrent) error
+
+// FilePriorities sets the priorities of files by their paths from
+// Torrent.Files, the rest are left normal.
+func FilePriorities(priorities map[string]FilePriority) AddOption {
+	return func(t *Torrent) error {
+		for file, p := range priorities {
+			i, ok := t.fileIndex(file)
+			if !ok {
+				return &os.PathError{Op: "priority", Path: file, Err: os.ErrNotExist}
+			}
+			t.filePriorities[i] = p
+		}
+		return nil
+	}
+}
+
+// SelectFiles skips every file that doesn't match one of the include globs
+// or does match an exclude glob. No includes means every file is included.
+// Globs are matched against the whole path from Torrent.Files, the path
+// inside the torrent's directory, and if they have no slash, the file name.
+func SelectFiles(include, exclude []string) AddOption {
+	return func(t *Torrent) error {
+		for _, glob := range append(append([]string(nil), include...), exclude...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("bad glob %q: %v", glob, err)
+			}
+		}
+		for i, file := range t.filePaths() {
+			if file == "" {
+				continue // padding
+			}
+			if (len(include) > 0 && !t.matchFile(include, file)) || t.matchFile(exclude, file) {
+				t.filePriorities[i] = FileSkip
+			}
+		}
+		return nil
+	}
+}
+
+// matchFile is true if any of globs matches file
+func (t *Torrent) matchFile(globs []string, file string) bool {
+	inner := file
+	if i := strings.IndexByte(file, '/'); i >= 0 && len(t.ti.Files) > 0 {
+		inner = file[i+1:] // the torrent's directory is the first name
+	}
+	for _, glob := range globs {
+		candidates := []string{file, inner}
+		if !strings.Contains(glob, "/") {
+			candidates = append(candidates, path.Base(file))
+		}
+		for _, c := range candidates {
+			if ok, _ := path.Match(glob, c); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filePaths are the slash separated paths of every entry in the layout, ""
+// for padding. The layout never changes so t doesn't have to be locked.
+func (t *Torrent) filePaths() []string {
+	paths := make([]string, len(t.layout))
+	for i, e := range t.layout {
+		if !e.pad {
+			paths[i] = filepath.ToSlash(e.path)
+		}
+	}
+	return paths
+}
+
+func (t *Torrent) fileIndex(file string) (int, bool) {
+	for i, p := range t.filePaths() {
+		if p != "" && p == file {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// FilePriority is the priority of one of the paths from Files
+func (t *Torrent) FilePriority(file string) (FilePriority, error) {
+	t.Lock()
+	defer t.Unlock()
+	i, ok := t.fileIndex(file)
+	if !ok {
+		return FileSkip, &os.PathError{Op: "priority", Path: file, Err: os.ErrNotExist}
+	}
+	return t.filePriorities[i], nil
+}
+
+// SetFilePriority changes a file's priority while the torrent runs. Skipped
+// files aren't created on disk unless a piece we want spills into them.
+func (t *Torrent) SetFilePriority(file string, p FilePriority) error {
+	t.Lock()
+	i, ok := t.fileIndex(file)
+	t.Unlock()
+	if !ok {
+		return &os.PathError{Op: "priority", Path: file, Err: os.ErrNotExist}
+	}
+	return t.post(priorityChanged{i, p})
+}
+
+// updatePiecePriorities works out each piece's priority from the files it
+// covers, a piece straddling two files gets the higher of their priorities.
+// t has to be locked.
+func (t *Torrent) updatePiecePriorities() {
+	pieceLength := t.ti.PieceLength
+	priorities := make([]FilePriority, t.ti.pieceCount())
+	covered := make([]bool, len(priorities))
+	for i, e := range t.layout {
+		if e.pad || e.length == 0 {
+			continue
+		}
+		first := int(e.offset / pieceLength)
+		last := int((e.offset + e.length - 1) / pieceLength)
+		for piece := first; piece <= last; piece++ {
+			if !covered[piece] || t.filePriorities[i] > priorities[piece] {
+				priorities[piece] = t.filePriorities[i]
+			}
+			covered[piece] = true
+		}
+	}
+	for i := range priorities {
+		if !covered[i] {
+			priorities[i] = FileNormal
+		}
+	}
+	t.piecePriorities = priorities
+}
+
+// wanted is false for pieces only in skipped files, unless something is
+// reading them or they have a deadline. t has to be locked.
+func (t *Torrent) wanted(index int) bool {
+	if t.piecePriorities[index] != FileSkip {
+		return true
+	}
+	if _, ok := t.deadlines[index]; ok {
+		return true
+	}
+	return t.piecePriority(index) > PRIORITY_NORMAL
+}
@@ -0,0 +1,164 @@
+package torgo
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// multiFileInfo is a torrent of three files over three 8 byte pieces, the
+// middle piece straddles a.mkv and b.txt.
+func multiFileInfo() (*TorrentInfo, []byte) {
+	data := []byte("aaaaaaaaaabbbbbbbbbbcccc")
+	var pieces []byte
+	for i := 0; i < len(data); i += 8 {
+		sum := sha1.Sum(data[i : i+8])
+		pieces = append(pieces, sum[:]...)
+	}
+	return &TorrentInfo{
+		Info: Info{
+			Name:        "multi",
+			Pieces:      string(pieces),
+			PieceLength: 8,
+			Files: []File{
+				{Length: 10, Path: []string{"a.mkv"}},
+				{Length: 10, Path: []string{"b.txt"}},
+				{Length: 4, Path: []string{"sub", "c.nfo"}},
+			},
+		},
+		InfoHash: []byte("multifile-info-hash!"),
+	}, data
+}
+
+func Test_SelectFiles(t *testing.T) {
+	ti, _ := multiFileInfo()
+	cases := []struct {
+		include, exclude []string
+		expected         []FilePriority
+	}{
+		{nil, nil, []FilePriority{FileNormal, FileNormal, FileNormal}},
+		{[]string{"*.mkv"}, nil, []FilePriority{FileNormal, FileSkip, FileSkip}},
+		{nil, []string{"*.nfo"}, []FilePriority{FileNormal, FileNormal, FileSkip}},
+		{[]string{"sub/*"}, nil, []FilePriority{FileSkip, FileSkip, FileNormal}},
+		{[]string{"multi/b.txt", "*.nfo"}, []string{"c.*"}, []FilePriority{FileSkip, FileNormal, FileSkip}},
+	}
+	for _, tc := range cases {
+		tor := &Torrent{
+			ti:             *ti,
+			layout:         ti.fileLayout(),
+			filePriorities: []FilePriority{FileNormal, FileNormal, FileNormal},
+		}
+		if err := SelectFiles(tc.include, tc.exclude)(tor); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tor.filePriorities, tc.expected) {
+			t.Errorf("include %q exclude %q: got %v; want %v", tc.include, tc.exclude, tor.filePriorities, tc.expected)
+		}
+	}
+
+	tor := &Torrent{ti: *ti, layout: ti.fileLayout()}
+	if err := SelectFiles([]string{"["}, nil)(tor); err == nil {
+		t.Error("expected a bad glob to fail")
+	}
+}
+
+func Test_FilePriorities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+
+	ti, data := multiFileInfo()
+	if _, err := c.AddTorrent(ti, FilePriorities(map[string]FilePriority{"multi/nope": FileHigh})); err == nil {
+		t.Error("expected a priority for a missing file to fail")
+	}
+	tor, err := c.AddTorrent(ti, FilePriorities(map[string]FilePriority{
+		"multi/b.txt":     FileSkip,
+		"multi/sub/c.nfo": FileSkip,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := func() []int {
+		tor.Lock()
+		defer tor.Unlock()
+		return tor.pickOrder()
+	}
+	// piece 1 is wanted for the end of a.mkv
+	if got := order(); !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("got pick order %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi", "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("skipped file was created: %v", err)
+	}
+
+	tor.handlePiece(pieceMsg(data, 8, 0))
+	tor.handlePiece(pieceMsg(data, 8, 1))
+	select {
+	case <-tor.Complete():
+	case <-time.After(5 * time.Second):
+		t.Fatal("torrent never completed its wanted files")
+	}
+	if st := tor.Stats(); st.Progress() != 1 || st.SelectedDone != 16 {
+		t.Errorf("got stats %+v", st)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "multi", "b.txt"))
+	if err != nil || string(b[:6]) != "bbbbbb" {
+		t.Errorf("got %q %v for the straddling piece in the skipped file", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi", "sub", "c.nfo")); !os.IsNotExist(err) {
+		t.Errorf("skipped file was created: %v", err)
+	}
+
+	if err := tor.SetFilePriority("multi/sub/c.nfo", FileHigh); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := tor.FilePriority("multi/sub/c.nfo"); p != FileHigh {
+		t.Errorf("got priority %v; want high", p)
+	}
+	if got := order(); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("got pick order %v after selecting c.nfo", got)
+	}
+	if err := tor.SetFilePriority("multi/nope", FileHigh); err == nil {
+		t.Error("expected setting a missing file's priority to fail")
+	}
+}
+
+func Test_pickOrderFilePriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+
+	ti, _ := multiFileInfo()
+	tor, err := c.AddTorrent(ti, FilePriorities(map[string]FilePriority{
+		"multi/a.mkv":     FileLow,
+		"multi/sub/c.nfo": FileHigh,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.Lock()
+	// piece 1 takes b.txt's normal priority over a.mkv's low one
+	expected := []FilePriority{FileLow, FileNormal, FileHigh}
+	if !reflect.DeepEqual(tor.piecePriorities, expected) {
+		t.Errorf("got piece priorities %v; want %v", tor.piecePriorities, expected)
+	}
+	if got := tor.pickOrder(); !reflect.DeepEqual(got, []int{2, 1, 0}) {
+		t.Errorf("got pick order %v", got)
+	}
+	tor.Unlock()
+}
@@ -1,13 +1,12 @@
 //go:generate stringer -type=msgID
-package main
+package torgo
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 type msgID int
@@ -22,8 +21,22 @@ const (
 	BITFLD
 	REQ
 	PIECE
-	CNCL // we can give these payload methods that know how to parse their payload
+	CNCL
+	PORT
 )
+
+// the fast extension's messages, BEP 6
+const (
+	SUGGEST msgID = iota + 13
+	HAVEALL
+	HAVENONE
+	REJECT
+	ALLOWEDFAST
+)
+
+// EXTENDED carries the extension protocol's messages, BEP 10
+const EXTENDED msgID = 20
+
 const (
 	pstrlen = 19
 	pstr    = "BitTorrent protocol"
@@ -31,24 +44,14 @@ const (
 
 var reserved = [8]byte{}
 
+// message is a message a peer sent, on its way to the torrent
 type message struct {
-	source  string
-	length  int
-	kind    msgID
-	payload []byte
-}
-
-func (m message) Unmarshal() []byte {
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, uint32(m.length))
-	binary.Write(&buf, binary.BigEndian, uint8(m.kind))
-	binary.Write(&buf, binary.BigEndian, m.payload)
-
-	return buf.Bytes()
+	source string // the peer's id
+	WireMessage
 }
 
 func (m message) String() string {
-	return fmt.Sprintf("source: %v len: %v, kind: %v payload len: %v\n", m.source, m.length, m.kind, len(m.payload))
+	return fmt.Sprintf("source: %v kind: %v len: %v", m.source, m.Kind(), frameLen(m.WireMessage))
 }
 
 type Handshake struct {
@@ -59,10 +62,42 @@ type Handshake struct {
 	PeerId   [20]byte
 }
 
+var (
+	errBadProtocol      = errors.New("not the BitTorrent protocol")
+	errInfoHashMismatch = errors.New("peer answered for a different torrent")
+	errSelfConnection   = errors.New("connected to ourselves")
+	errPeerIDMismatch   = errors.New("peer id isn't the one the tracker gave")
+)
+
+// Unmarshal reads a handshake, anything that isn't opening the BitTorrent
+// protocol is refused.
 func Unmarshal(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, 1+pstrlen+len(reserved)+20+20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != pstrlen || string(buf[1:1+pstrlen]) != pstr {
+		return nil, errBadProtocol
+	}
 	h := &Handshake{}
-	err := binary.Read(r, binary.BigEndian, h)
-	return h, err
+	copy(h.InfoHash[:], buf[1+pstrlen+len(reserved):])
+	copy(h.PeerId[:], buf[1+pstrlen+len(reserved)+20:])
+	return h, nil
+}
+
+// checkReply vets the handshake a peer we dialed answered ours with. It has to
+// be for the same torrent and not from us, and if the tracker told us the
+// peer's id it has to be that one.
+func checkReply(ours Handshake, reply *Handshake, advertised string) error {
+	switch {
+	case reply.InfoHash != ours.InfoHash:
+		return errInfoHashMismatch
+	case reply.PeerId == ours.PeerId:
+		return errSelfConnection
+	case advertised != "" && string(reply.PeerId[:]) != advertised:
+		return errPeerIDMismatch
+	}
+	return nil
 }
 
 func (h Handshake) Marshall() []byte {
@@ -75,51 +110,78 @@ func (h Handshake) Marshall() []byte {
 	return handShake
 }
 
-func readMessage(r *bufio.ReadWriter) (message, error) {
-	msg := message{}
-	LEN_HEADER := 4
+const (
+	// MAX_MESSAGE_SIZE is the longest message we'll read off a peer, it fits
+	// a block well over BLOCK_SIZE or the bitfield of a torrent with two
+	// million pieces
+	MAX_MESSAGE_SIZE = 1 << 18
+	// KEEPALIVE_INTERVAL is how long we let a connection go quiet before
+	// sending a keepalive down it
+	KEEPALIVE_INTERVAL = 2 * time.Minute
+	// IDLE_TIMEOUT is how long a peer can go without sending us anything,
+	// not even a keepalive, before we hang up
+	IDLE_TIMEOUT = 3 * time.Minute
+	// WRITE_TIMEOUT is how long a peer gets to take what we send it before
+	// we hang up, so a stalled peer can't hold up its writer forever
+	WRITE_TIMEOUT = 30 * time.Second
+	// CLOSE_TIMEOUT is how long a peer we're hanging up on gets to take the
+	// messages still queued for it
+	CLOSE_TIMEOUT = 2 * time.Second
+)
 
-	lenBytes := make([]byte, LEN_HEADER, LEN_HEADER)
-	n, err := r.Read(lenBytes[:LEN_HEADER])
-	if err != nil {
-		return message{}, err
+var (
+	errMessageTooBig = errors.New("message is too big")
+	errBadBitfield   = errors.New("bitfield doesn't match the torrent")
+)
+
+// readMessage reads a whole message off r. pieces is how many pieces the
+// torrent has for checking HAVE and BITFLD messages, 0 if we don't know yet.
+func readMessage(r io.Reader, pieces int) (WireMessage, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(r, lenBytes[:]); err != nil {
+		return nil, err
 	}
-	if n != LEN_HEADER {
-		return msg, errors.New("problem with the length")
+	mlen := binary.BigEndian.Uint32(lenBytes[:])
+	if mlen == 0 {
+		return KeepAlive{}, nil
 	}
-
-	mlen := binary.BigEndian.Uint32(lenBytes)
-	msg.length = int(mlen) // TODO handle the special case of a keepalive
-
-	mkind, err := r.ReadByte()
-	errCheck(err)
-	msg.kind = msgID(mkind)
-
-	payload := make([]byte, mlen-1, mlen-1)
-	n, err = io.ReadFull(r, payload)
-	if n != int(mlen-1) {
-		fmt.Printf("expected %v bytes but read %v", mlen, n)
+	if mlen > MAX_MESSAGE_SIZE {
+		return nil, errMessageTooBig
 	}
-	errCheck(err)
 
-	msg.payload = payload
-
-	return msg, nil
+	buf := make([]byte, mlen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	msg, err := decodeMessage(msgID(buf[0]), buf[1:])
+	if err != nil {
+		return nil, err
+	}
+	return msg, checkPieces(msg, pieces)
 }
 
-func buildRequest(id string, idx int, offset int, blockSize int) message {
-	fmt.Printf("offset: %v\n", offset)
-	fmt.Printf("Blocksize: %v\n", blockSize)
-	fmt.Printf("Blocksize: %v\n", int32(blockSize))
-	var payload bytes.Buffer
-	binary.Write(&payload, binary.BigEndian, int32(idx))
-	binary.Write(&payload, binary.BigEndian, int32(offset))
-	binary.Write(&payload, binary.BigEndian, int32(blockSize))
-
-	return message{
-		kind:    REQ,
-		source:  id,
-		length:  13,
-		payload: payload.Bytes(),
+// checkPieces makes sure a message about pieces fits a torrent with that
+// many, anything goes if we don't know how many there are.
+func checkPieces(msg WireMessage, pieces int) error {
+	if pieces == 0 {
+		return nil
+	}
+	switch m := msg.(type) {
+	case Have:
+		if m.Index >= pieces {
+			return fmt.Errorf("HAVE for piece %d of %d", m.Index, pieces)
+		}
+	case Bitfield:
+		if len(m) != (pieces+7)/8 {
+			return errBadBitfield
+		}
+		// the spare bits at the end have to be clear
+		if spare := uint(len(m)*8 - pieces); m[len(m)-1]&(1<<spare-1) != 0 {
+			return errBadBitfield
+		}
 	}
+	return nil
 }
@@ -0,0 +1,90 @@
+package torgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// frame puts a length in front of kind and payload like the wire does
+func frame(kind msgID, payload ...byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = byte(kind)
+	return append(buf, payload...)
+}
+
+func Test_readMessage(t *testing.T) {
+	tooBig := make([]byte, 4)
+	binary.BigEndian.PutUint32(tooBig, MAX_MESSAGE_SIZE+1)
+	cases := []struct {
+		name     string
+		data     []byte
+		kind     msgID
+		wantErr  bool
+		expected error
+	}{
+		{"keepalive", []byte{0, 0, 0, 0}, KPALIVE, false, nil},
+		{"choke", frame(CHOKE), CHOKE, false, nil},
+		{"choke with a payload", frame(CHOKE, 1), 0, true, nil},
+		{"have", frame(HAVE, 0, 0, 0, 9), HAVE, false, nil},
+		{"short have", frame(HAVE, 0, 9), 0, true, nil},
+		{"have past the last piece", frame(HAVE, 0, 0, 0, 10), 0, true, nil},
+		{"request", frame(REQ, make([]byte, 12)...), REQ, false, nil},
+		{"short request", frame(REQ, make([]byte, 11)...), 0, true, nil},
+		{"cancel", frame(CNCL, make([]byte, 13)...), 0, true, nil},
+		{"piece", frame(PIECE, make([]byte, 8+4)...), PIECE, false, nil},
+		{"short piece", frame(PIECE, make([]byte, 7)...), 0, true, nil},
+		{"bitfield", frame(BITFLD, 0xff, 0xc0), BITFLD, false, nil},
+		{"bitfield too long", frame(BITFLD, 0xff, 0xc0, 0), 0, true, errBadBitfield},
+		{"bitfield spare bits", frame(BITFLD, 0xff, 0xe0), 0, true, errBadBitfield},
+		{"unknown kind", frame(20, 1, 2, 3), 20, false, nil},
+		{"too big", tooBig, 0, true, errMessageTooBig},
+		{"cut short", frame(HAVE, 0, 0, 0, 9)[:6], 0, true, io.ErrUnexpectedEOF},
+		{"nothing", nil, 0, true, io.EOF},
+	}
+	for _, tc := range cases {
+		// a byte at a time, so nothing relies on a read filling its buffer
+		msg, err := readMessage(iotest.OneByteReader(bytes.NewReader(tc.data)), 10)
+		if tc.wantErr {
+			if err == nil || (tc.expected != nil && err != tc.expected) {
+				t.Errorf("%s: got %v; want an error like %v", tc.name, err, tc.expected)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if msg.Kind() != tc.kind {
+			t.Errorf("%s: got a %v", tc.name, msg.Kind())
+		}
+	}
+
+	// a torrent without its metadata can't check bitfields yet
+	if _, err := readMessage(bytes.NewReader(frame(BITFLD, 0xff, 0xff, 0xff)), 0); err != nil {
+		t.Errorf("got %v with no piece count", err)
+	}
+}
+
+func Test_keepAliveRoundTrip(t *testing.T) {
+	data, _ := KeepAlive{}.MarshalBinary()
+	if !bytes.Equal(data, []byte{0, 0, 0, 0}) {
+		t.Fatalf("keepalive is %x on the wire", data)
+	}
+	msg, err := readMessage(bytes.NewReader(data), 1)
+	if err != nil || msg.Kind() != KPALIVE {
+		t.Errorf("got %v, %v reading a keepalive back", msg, err)
+	}
+}
+
+func Test_LogFieldSpareBits(t *testing.T) {
+	log := newPieceLog(10)
+	log.LogField("a", []byte{0xff, 0xff, 0xff})
+	log.LogSingle("a", 10)
+	if got := log.String(); got != "1111111111" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -1,17 +1,31 @@
 // Code generated by "stringer -type=msgID"; DO NOT EDIT.
 
-package main
+package torgo
 
-import "fmt"
+import "strconv"
 
-const _msgID_name = "KPALIVECHOKEUNCHOKEINTERSTUNINTERSTHAVEBITFLDREQPIECECNCL"
+const (
+	_msgID_name_0 = "KPALIVECHOKEUNCHOKEINTERSTUNINTERSTHAVEBITFLDREQPIECECNCLPORT"
+	_msgID_name_1 = "SUGGESTHAVEALLHAVENONEREJECTALLOWEDFAST"
+	_msgID_name_2 = "EXTENDED"
+)
 
-var _msgID_index = [...]uint8{0, 7, 12, 19, 26, 35, 39, 45, 48, 53, 57}
+var (
+	_msgID_index_0 = [...]uint8{0, 7, 12, 19, 26, 35, 39, 45, 48, 53, 57, 61}
+	_msgID_index_1 = [...]uint8{0, 7, 14, 22, 28, 39}
+)
 
 func (i msgID) String() string {
-	i -= -1
-	if i < 0 || i >= msgID(len(_msgID_index)-1) {
-		return fmt.Sprintf("msgID(%d)", i+-1)
+	switch {
+	case -1 <= i && i <= 9:
+		i -= -1
+		return _msgID_name_0[_msgID_index_0[i]:_msgID_index_0[i+1]]
+	case 13 <= i && i <= 17:
+		i -= 13
+		return _msgID_name_1[_msgID_index_1[i]:_msgID_index_1[i+1]]
+	case i == 20:
+		return _msgID_name_2
+	default:
+		return "msgID(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _msgID_name[_msgID_index[i]:_msgID_index[i+1]]
 }
@@ -0,0 +1,90 @@
+package torgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/zanadar/torgo/bencode"
+)
+
+func Test_parseTorrentNonCanonicalInfo(t *testing.T) {
+	pieces := strings.Repeat("x", 20)
+	// keys out of order and a field we don't know about
+	info := "d4:name4:test6:lengthi5e12:piece lengthi16384e6:pieces20:" + pieces + "7:x-extra5:helloe"
+	torrent := "d8:announce16:http://localhost4:info" + info + "e"
+
+	ti, err := parseTorrent(strings.NewReader(torrent), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha1.Sum([]byte(info))
+	if !bytes.Equal(ti.InfoHash, want[:]) {
+		t.Errorf("got info hash %x; want %x", ti.InfoHash, want)
+	}
+	if string(ti.RawInfo()) != info {
+		t.Errorf("got raw info %q; want %q", ti.RawInfo(), info)
+	}
+	if ti.Name != "test" || ti.Length != 5 || ti.PieceLength != 16384 {
+		t.Errorf("fields not decoded: %+v", ti.Info)
+	}
+}
+
+func Test_parseTorrentBadPieces(t *testing.T) {
+	hash := strings.Repeat("x", 20)
+	cases := []struct {
+		name string
+		info string
+		err  error
+	}{
+		{"zero piece length", "d6:lengthi5e4:name4:test12:piece lengthi0e6:pieces20:" + hash + "e", errPieceLength},
+		{"negative piece length", "d6:lengthi5e4:name4:test12:piece lengthi-1e6:pieces20:" + hash + "e", errPieceLength},
+		{"partial hash", "d6:lengthi5e4:name4:test12:piece lengthi4e6:pieces30:" + hash + hash[:10] + "e", errPieceHashes},
+		{"too few pieces", "d6:lengthi5e4:name4:test12:piece lengthi4e6:pieces20:" + hash + "e", errPieceCount},
+		{"too many pieces", "d6:lengthi5e4:name4:test12:piece lengthi8e6:pieces40:" + hash + hash + "e", errPieceCount},
+		{"no pieces", "d6:lengthi5e4:name4:test12:piece lengthi8e6:pieces0:e", errPieceCount},
+		{"negative length", "d6:lengthi-5e4:name4:test12:piece lengthi8e6:pieces0:e", errFileLength},
+		{"negative file", "d5:filesld6:lengthi-5e4:pathl1:aeee4:name4:test12:piece lengthi8e6:pieces0:e", errFileLength},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			torrent := "d4:info" + tc.info + "e"
+			if _, err := parseTorrent(strings.NewReader(torrent), log.NewNopLogger()); err != tc.err {
+				t.Errorf("got %v; want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func Test_parseTorrentCanonicalFixture(t *testing.T) {
+	f, err := os.Open("fixtures/kali-linux-mini-2016.1-amd64.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ti, err := parseTorrent(f, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// for a canonical torrent the raw bytes and re-encoding have to agree
+	var decoded struct {
+		Info interface{} `bencode:"info"`
+	}
+	data, _ := ioutil.ReadFile("fixtures/kali-linux-mini-2016.1-amd64.torrent")
+	if err := bencode.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := bencode.Marshal(decoded.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha1.Sum(encoded)
+	if !bytes.Equal(ti.InfoHash, want[:]) {
+		t.Errorf("got info hash %x; want %x", ti.InfoHash, want)
+	}
+}
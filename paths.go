@@ -0,0 +1,128 @@
+package torgo
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// MAX_NAME_LENGTH is the longest file or directory name from a torrent we'll
+// create, in bytes. Filesystems mostly stop at 255, this leaves room for
+// IncompleteSuffix and the numbers added to tell duplicates apart.
+const MAX_NAME_LENGTH = 240
+
+var errUnsafePath = errors.New("path isn't inside the download directory")
+
+// reservedNames are the device names Windows won't create files with, with
+// or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName makes one name from a torrent, the torrent's own or a segment
+// of a file's path, safe to create anywhere. Separators and characters
+// Windows won't have become underscores, control characters are dropped,
+// invalid UTF-8 is replaced, and "." and ".." and names that end up empty
+// become "_".
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows drops trailing dots and spaces, which could make two names one
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = "_" + name
+	}
+	return truncateName(name, MAX_NAME_LENGTH)
+}
+
+// truncateName cuts name down to max bytes, keeping its extension if it's a
+// reasonable length and not splitting a character
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	cut := max - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + ext
+}
+
+// safeLayout sanitizes the path of every entry and renames any that would
+// land on the same file, or on a directory another entry needs, by adding a
+// number. Names are compared ignoring case, as they would be on Windows and
+// macOS.
+func safeLayout(entries []fileEntry) {
+	taken := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		for dir := filepath.Dir(e.path); dir != "."; dir = filepath.Dir(dir) {
+			dirs[strings.ToLower(dir)] = true
+		}
+	}
+	for i, e := range entries {
+		if e.pad {
+			continue // never stored
+		}
+		path := e.path
+		for n := 1; taken[strings.ToLower(path)] || dirs[strings.ToLower(path)]; n++ {
+			path = numbered(e.path, n)
+		}
+		taken[strings.ToLower(path)] = true
+		entries[i].path = path
+	}
+}
+
+// numbered is path with n added to the end of its name, before the extension
+func numbered(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// safePath joins the sanitized names into a relative path
+func safePath(names ...string) string {
+	for i, name := range names {
+		names[i] = sanitizeName(name)
+	}
+	return filepath.Join(names...)
+}
+
+// checkPaths makes sure none of info's files would end up outside its Dir,
+// whoever made the StorageInfo.
+func (info StorageInfo) checkPaths() error {
+	for _, f := range info.Files {
+		if f.Pad {
+			continue
+		}
+		path := filepath.Clean(f.Path)
+		if filepath.IsAbs(path) || filepath.VolumeName(path) != "" || path == ".." || path == "." ||
+			strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s: %v", f.Path, errUnsafePath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package torgo
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_sanitizeName(t *testing.T) {
+	cases := []struct {
+		name, expected string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"..", "_"},
+		{".", "_"},
+		{"", "_"},
+		{"../../etc/cron.d/x", ".._.._etc_cron.d_x"},
+		{"/etc/passwd", "_etc_passwd"},
+		{`C:\Windows\system32`, "C__Windows_system32"},
+		{"bell\x07and\nnewline", "bellandnewline"},
+		{"trailing dots...", "trailing dots"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"console.txt", "console.txt"},
+		{"bad\xffutf8", "bad\uFFFDutf8"},
+		{"wh?t*", "wh_t_"},
+	}
+	for _, tc := range cases {
+		if got := sanitizeName(tc.name); got != tc.expected {
+			t.Errorf("%q: got %q; want %q", tc.name, got, tc.expected)
+		}
+	}
+
+	long := strings.Repeat("é", 200) + ".mkv"
+	got := sanitizeName(long)
+	if len(got) > MAX_NAME_LENGTH || !strings.HasSuffix(got, ".mkv") || !strings.HasPrefix(long, strings.TrimSuffix(got, ".mkv")) {
+		t.Errorf("got %q, %d bytes, for a long name", got, len(got))
+	}
+}
+
+func Test_fileLayoutUntrusted(t *testing.T) {
+	ti := &TorrentInfo{Info: Info{
+		Name: "../../etc/cron.d",
+		Files: []File{
+			{Length: 1, Path: []string{"..", "..", "x"}},
+			{Length: 1, Path: []string{"/abs", "olute"}},
+			{Length: 1, Path: []string{"dup.txt"}},
+			{Length: 1, Path: []string{"DUP.txt"}},
+			{Length: 1, Path: []string{"dir"}},
+			{Length: 1, Path: []string{"dir", "inside"}},
+			{Length: 1, Path: []string{"garbled"}, PathUTF8: []string{"naïve"}},
+			{Length: 1, Path: []string{"pad"}, Attr: "p"},
+		},
+	}}
+	expected := []string{
+		".._.._etc_cron.d/_/_/x",
+		".._.._etc_cron.d/_abs/olute",
+		".._.._etc_cron.d/dup.txt",
+		".._.._etc_cron.d/DUP (1).txt",
+		".._.._etc_cron.d/dir (1)",
+		".._.._etc_cron.d/dir/inside",
+		".._.._etc_cron.d/naïve",
+	}
+	layout := ti.fileLayout()
+	for i, want := range expected {
+		if got := filepath.ToSlash(layout[i].path); got != want {
+			t.Errorf("file %d: got %q; want %q", i, got, want)
+		}
+	}
+
+	dir := filepath.Join("downloads", "here")
+	info := newStorageInfo(ti, dir, layout)
+	if err := info.checkPaths(); err != nil {
+		t.Error(err)
+	}
+	for _, f := range info.Files {
+		rel, err := filepath.Rel(dir, filepath.Join(dir, f.Path))
+		if err != nil || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Errorf("%q is outside %s", f.Path, dir)
+		}
+	}
+
+	ti.NameUTF8 = "名前"
+	if got := filepath.ToSlash(ti.fileLayout()[0].path); got != "名前/_/_/x" {
+		t.Errorf("got %q; want the name.utf-8 name", got)
+	}
+}
+
+func Test_checkPaths(t *testing.T) {
+	for _, path := range []string{"../x", "a/../../x", "/etc/passwd", ".."} {
+		info := StorageInfo{Dir: "downloads", Files: []StorageFile{{Path: path, Length: 1}}}
+		if err := info.checkPaths(); err == nil {
+			t.Errorf("%q was allowed", path)
+		}
+		if _, err := (FileStorage{}).Open(info); err == nil {
+			t.Errorf("file storage opened %q", path)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package torgo
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Piece priorities, higher ones are requested first
+const (
+	PRIORITY_NORMAL = iota
+	PRIORITY_READAHEAD
+	PRIORITY_NOW
+)
+
+const (
+	// DEADLINE_WINDOW is how close to its deadline a piece has to be before
+	// it's treated as urgent
+	DEADLINE_WINDOW = 5 * time.Second
+	// MAX_URGENT_REQUESTS is how many peers an urgent piece is asked for at once
+	MAX_URGENT_REQUESTS = 2
+	// PICK_INTERVAL is how often we look again at what to request, deadlines
+	// get closer without anything else happening
+	PICK_INTERVAL = time.Second
+	// RATE_WINDOW is roughly how far back a peer's rate looks, older data
+	// counts for less and less
+	RATE_WINDOW = 20 * time.Second
+)
+
+// SetSequential makes the torrent download its pieces in order instead of
+// rarest first, for media that's played while it downloads.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.post(sequentialChanged{sequential})
+}
+
+// SetPieceDeadline asks for a piece by d. Pieces with deadlines are
+// requested before anything else, and once they're within DEADLINE_WINDOW
+// of it they're asked for from the fastest peers we have, more than one at
+// once if needed. A zero d clears the deadline.
+func (t *Torrent) SetPieceDeadline(index int, d time.Time) {
+	t.post(deadlineChanged{index, d})
+}
+
+// piecePriority is how urgently a reader wants a piece, t has to be locked
+func (t *Torrent) piecePriority(index int) int {
+	priority := PRIORITY_NORMAL
+	for _, r := range t.readers {
+		switch {
+		case index >= r.first && index <= r.last:
+			return PRIORITY_NOW
+		case index > r.last && index <= r.readahead:
+			priority = PRIORITY_READAHEAD
+		}
+	}
+	return priority
+}
+
+// urgent is true for pieces a reader is blocked on or that are close to
+// their deadline, t has to be locked.
+func (t *Torrent) urgent(index int, now time.Time) bool {
+	if d, ok := t.deadlines[index]; ok && d.Sub(now) <= DEADLINE_WINDOW {
+		return true
+	}
+	return t.piecePriority(index) == PRIORITY_NOW
+}
+
+// pickOrder lists the pieces we still need, most wanted first: pieces with
+// deadlines by deadline, then what readers are waiting for, then by the
+// priority of their files, then either in order or rarest first. Pieces only
+// in skipped files are left out. t has to be locked.
+func (t *Torrent) pickOrder() []int {
+	type candidate struct {
+		index    int
+		deadline time.Time
+		priority int
+		file     FilePriority
+		holders  int
+	}
+	var candidates []candidate
+	for i, written := range t.WriteLog {
+		if written || !t.wanted(i) {
+			continue
+		}
+		c := candidate{
+			index:    i,
+			deadline: t.deadlines[i],
+			priority: t.piecePriority(i),
+			file:     t.piecePriorities[i],
+		}
+		if !t.sequential {
+			c.holders = len(t.PeerPieceLog.At(i))
+		}
+		candidates = append(candidates, c)
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		ca, cb := candidates[a], candidates[b]
+		if ca.deadline.IsZero() != cb.deadline.IsZero() {
+			return !ca.deadline.IsZero()
+		}
+		if !ca.deadline.Equal(cb.deadline) {
+			return ca.deadline.Before(cb.deadline)
+		}
+		if ca.priority != cb.priority {
+			return ca.priority > cb.priority
+		}
+		if ca.file != cb.file {
+			return ca.file > cb.file
+		}
+		return ca.holders < cb.holders
+	})
+
+	order := make([]int, len(candidates))
+	for i, c := range candidates {
+		order[i] = c.index
+	}
+	return order
+}
+
+// peerRate is how fast a peer has been sending us data lately, bytes decays
+// away over RATE_WINDOW so a peer that's slowed down drops back.
+type peerRate struct {
+	bytes float64
+	at    time.Time
+}
+
+// decayed is bytes as of now
+func (r *peerRate) decayed(now time.Time) float64 {
+	elapsed := now.Sub(r.at)
+	if elapsed <= 0 {
+		return r.bytes
+	}
+	return r.bytes * math.Exp(-elapsed.Seconds()/RATE_WINDOW.Seconds())
+}
+
+func (r *peerRate) add(n int, now time.Time) {
+	r.bytes = r.decayed(now) + float64(n)
+	r.at = now
+}
+
+func (r *peerRate) rate(now time.Time) float64 {
+	return r.decayed(now) / RATE_WINDOW.Seconds()
+}
+
+// received counts data from a peer towards its rate and ends any snub, t has
+// to be locked.
+func (t *Torrent) received(id string, n int, now time.Time) {
+	r, ok := t.peerRates[id]
+	if !ok {
+		r = &peerRate{at: now}
+		t.peerRates[id] = r
+	}
+	r.add(n, now)
+	a := t.activityOf(id)
+	a.waiting = time.Time{}
+	a.snubbed = false
+}
+
+// fastestPeers sorts ids by how fast they've sent us data, fastest first. t
+// has to be locked.
+func (t *Torrent) fastestPeers(ids []string, now time.Time) {
+	rate := func(id string) float64 {
+		if r, ok := t.peerRates[id]; ok {
+			return r.rate(now)
+		}
+		return 0
+	}
+	sort.SliceStable(ids, func(a, b int) bool {
+		return rate(ids[a]) > rate(ids[b])
+	})
+}
+
+// wakeup gets the torrent's loop to look at what to request again, for when
+// priorities change.
+func (t *Torrent) wakeup() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,165 @@
+package torgo
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePeer records the messages sent to it
+type fakePeer struct {
+	id      string
+	choking bool
+	backlog bool
+	sync.Mutex
+	sent []WireMessage
+}
+
+func (p *fakePeer) Message(msg WireMessage) {
+	p.Lock()
+	defer p.Unlock()
+	p.sent = append(p.sent, msg)
+}
+
+// requested lists the pieces requested from the peer
+func (p *fakePeer) requested() []int {
+	p.Lock()
+	defer p.Unlock()
+	var pieces []int
+	for _, msg := range p.sent {
+		if req, ok := msg.(Request); ok {
+			pieces = append(pieces, req.Index)
+		}
+	}
+	return pieces
+}
+
+func (p *fakePeer) Connect(Handshake) error { return nil }
+func (p *fakePeer) ParseMsgs(chan message)  {}
+func (p *fakePeer) AmChoking(bool)          {}
+func (p *fakePeer) GetAmChoking() bool      { return true }
+func (p *fakePeer) AmInterested(bool)       {}
+func (p *fakePeer) GetAmInterested() bool   { return true }
+func (p *fakePeer) PeerChoking(choke bool)  { p.choking = choke }
+func (p *fakePeer) GetPeerChoking() bool    { return p.choking }
+func (p *fakePeer) PeerInterested(bool)     {}
+func (p *fakePeer) GetPeerInterested() bool { return false }
+func (p *fakePeer) state() string           { return p.id }
+func (p *fakePeer) backlogged() bool        { return p.backlog }
+func (p *fakePeer) ID() string              { return p.id }
+func (p *fakePeer) String() string          { return p.id }
+
+func newPickerTorrent(t *testing.T) (*Torrent, func()) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor := newTestTorrent(t, dir, []byte("the quick brown fox jumps over the lazy dog"), 8)
+	return tor, func() { os.RemoveAll(dir) }
+}
+
+func Test_pickOrder(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	// piece 0 is everywhere, 5 is the rarest
+	tor.PeerPieceLog.LogField("a", []byte{0xfc})
+	tor.PeerPieceLog.LogField("b", []byte{0xf0})
+	tor.PeerPieceLog.LogField("c", []byte{0x80})
+	tor.WriteLog[1] = true
+
+	order := func() []int {
+		tor.Lock()
+		defer tor.Unlock()
+		return tor.pickOrder()
+	}
+	if got := order(); !reflect.DeepEqual(got, []int{4, 5, 2, 3, 0}) {
+		t.Errorf("rarest first: got %v", got)
+	}
+
+	tor.SetSequential(true)
+	if got := order(); !reflect.DeepEqual(got, []int{0, 2, 3, 4, 5}) {
+		t.Errorf("sequential: got %v", got)
+	}
+
+	now := time.Now()
+	tor.SetPieceDeadline(5, now.Add(time.Minute))
+	tor.SetPieceDeadline(3, now.Add(time.Second))
+	if got := order(); !reflect.DeepEqual(got, []int{3, 5, 0, 2, 4}) {
+		t.Errorf("deadlines: got %v", got)
+	}
+	tor.Lock()
+	if !tor.urgent(3, now) || tor.urgent(5, now) || tor.urgent(0, now) {
+		t.Error("only the piece with a close deadline should be urgent")
+	}
+	tor.Unlock()
+
+	tor.SetPieceDeadline(5, time.Time{})
+	if got := order(); !reflect.DeepEqual(got, []int{3, 0, 2, 4, 5}) {
+		t.Errorf("cleared deadline: got %v", got)
+	}
+}
+
+func Test_sendRequest(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	fast := &fakePeer{id: "fast"}
+	slow := &fakePeer{id: "slow"}
+	choking := &fakePeer{id: "choking", choking: true}
+	for _, p := range []*fakePeer{fast, slow, choking} {
+		tor.peerConns[p.id] = p
+	}
+	// only the choking peer has piece 5, which keeps us out of end-game
+	tor.PeerPieceLog.LogField("fast", []byte{0xf8})
+	tor.PeerPieceLog.LogField("slow", []byte{0xf8})
+	tor.PeerPieceLog.LogField("choking", []byte{0xfc})
+	now := time.Now()
+	tor.peerRates["fast"] = &peerRate{bytes: 1 << 20, at: now.Add(-time.Second)}
+	tor.peerRates["slow"] = &peerRate{bytes: 1 << 10, at: now.Add(-time.Second)}
+	tor.SetPieceDeadline(2, now)
+
+	tor.sendRequest(message{})
+	if got := fast.requested(); !reflect.DeepEqual(got, []int{2, 0, 1, 3, 4}) {
+		t.Errorf("fast peer got requests for %v", got)
+	}
+	if got := slow.requested(); len(got) != 0 {
+		t.Errorf("slow peer got requests for %v before anything was urgent", got)
+	}
+
+	// the urgent piece hasn't come in, so it's asked for again elsewhere
+	tor.sendRequest(message{})
+	if got := slow.requested(); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("slow peer got requests for %v; want the urgent piece", got)
+	}
+	tor.sendRequest(message{})
+	if len(fast.requested()) != 5 || len(slow.requested()) != 1 || len(choking.requested()) != 0 {
+		t.Errorf("got more requests than MAX_URGENT_REQUESTS allows: %v %v %v",
+			fast.requested(), slow.requested(), choking.requested())
+	}
+}
+
+func Test_peerRate(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	now := time.Now()
+	// a peer that was fast a while ago drops behind one that's steady now
+	tor.received("was fast", 1<<20, now.Add(-5*RATE_WINDOW))
+	for i := 10; i > 0; i-- {
+		tor.received("steady", 1<<14, now.Add(-time.Duration(i)*time.Second))
+	}
+	ids := []string{"was fast", "steady"}
+	tor.fastestPeers(ids, now)
+	if ids[0] != "steady" {
+		t.Errorf("got %v; want the steady peer first", ids)
+	}
+
+	tor.removePeer("was fast")
+	if _, ok := tor.peerRates["was fast"]; ok {
+		t.Error("removed peer's rate is still kept")
+	}
+}
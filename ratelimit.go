@@ -0,0 +1,252 @@
+package torgo
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ALT_SPEED_CHECK is how often the client looks at whether the alternative
+// speed schedule has started or ended
+const ALT_SPEED_CHECK = time.Minute
+
+// limiter is a token bucket of bytes, it fills at rate a second and holds a
+// second's worth. A rate of 0 doesn't limit anything.
+type limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: rate}
+}
+
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+func (l *limiter) getRate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// fill adds the tokens earned since last, l has to be locked
+func (l *limiter) fill(now time.Time) {
+	if l.last.IsZero() {
+		l.tokens = float64(l.rate)
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and says
+// how long it'll be until the debt is paid off.
+func (l *limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.fill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// waitN blocks until n bytes are allowed through every one of limiters, or ctx
+// is done.
+func waitN(ctx context.Context, n int, limiters ...*limiter) error {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// traffic counts a torrent's bytes on the wire. Payload is the data in PIECE
+// messages, overhead is everything else. Piece data we download is counted
+// as the torrent's downloaded as soon as it arrives, whether it's then
+// written, dropped as a block we no longer want or fails its hash check.
+type traffic struct {
+	payloadUp    int64 // atomic
+	overheadUp   int64 // atomic
+	overheadDown int64 // atomic
+}
+
+// payload is how many of msg's bytes are piece data
+func payload(msg WireMessage) int {
+	if piece, ok := msg.(Piece); ok {
+		return len(piece.Block)
+	}
+	return 0
+}
+
+func (tr *traffic) sent(msg WireMessage, n int) {
+	if tr == nil {
+		return
+	}
+	p := payload(msg)
+	atomic.AddInt64(&tr.payloadUp, int64(p))
+	atomic.AddInt64(&tr.overheadUp, int64(n-p))
+}
+
+func (tr *traffic) received(msg WireMessage, n int) {
+	if tr == nil {
+		return
+	}
+	atomic.AddInt64(&tr.overheadDown, int64(n-payload(msg)))
+}
+
+// AltSpeed is a second pair of limits that takes over on a schedule, to keep
+// out of the way of other traffic at busy times.
+type AltSpeed struct {
+	DownloadLimit int64          // bytes a second, 0 for no limit
+	UploadLimit   int64          // bytes a second, 0 for no limit
+	Days          []time.Weekday // days it starts on, every day if empty
+	Start         time.Duration  // time of day it starts, from midnight
+	End           time.Duration  // time of day it ends, before Start runs it past midnight
+}
+
+// Active is true if now is in one of the schedule's periods
+func (a *AltSpeed) Active(now time.Time) bool {
+	y, m, d := now.Date()
+	sinceMidnight := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	day := now.Weekday()
+	switch {
+	case a.Start < a.End:
+		return sinceMidnight >= a.Start && sinceMidnight < a.End && a.startsOn(day)
+	case a.Start > a.End && sinceMidnight >= a.Start:
+		return a.startsOn(day)
+	case a.Start > a.End && sinceMidnight < a.End:
+		// started the day before
+		return a.startsOn((day + 6) % 7)
+	}
+	return false
+}
+
+func (a *AltSpeed) startsOn(day time.Weekday) bool {
+	if len(a.Days) == 0 {
+		return true
+	}
+	for _, d := range a.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRateLimits changes the client's download and upload limits in bytes a
+// second across every torrent, 0 is no limit. They're overridden while the
+// alternative speed schedule is active.
+func (c *Client) SetRateLimits(download, upload int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.config.DownloadLimit, c.config.UploadLimit = download, upload
+	c.applyLimits(time.Now())
+}
+
+// SetAltSpeed changes the alternative speed schedule, nil turns it off
+func (c *Client) SetAltSpeed(alt *AltSpeed) {
+	c.Lock()
+	defer c.Unlock()
+	c.config.AltSpeed = alt
+	c.applyLimits(time.Now())
+}
+
+// applyLimits sets the client's limiters from the config or the alternative
+// speed schedule if it's active, c has to be locked.
+func (c *Client) applyLimits(now time.Time) {
+	down, up := c.config.DownloadLimit, c.config.UploadLimit
+	if alt := c.config.AltSpeed; alt != nil && alt.Active(now) {
+		down, up = alt.DownloadLimit, alt.UploadLimit
+	}
+	c.down.setRate(down)
+	c.up.setRate(up)
+}
+
+// scheduleLimits switches between the normal and alternative limits as the
+// schedule says until the client is closed.
+func (c *Client) scheduleLimits() {
+	ticker := time.NewTicker(ALT_SPEED_CHECK)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.Lock()
+			c.applyLimits(now)
+			c.Unlock()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetRateLimits changes the torrent's download and upload limits in bytes a
+// second, 0 is no limit. The client's limits still apply on top.
+func (t *Torrent) SetRateLimits(download, upload int64) {
+	t.down.setRate(download)
+	t.up.setRate(upload)
+}
+
+// SetPeerRateLimits changes the download and upload limits for each of the
+// torrent's peers, including ones that connect later.
+func (t *Torrent) SetPeerRateLimits(download, upload int64) {
+	t.post(peerRatesChanged{download, upload})
+}
+
+// handlePeerRates is SetPeerRateLimits on the loop
+func (t *Torrent) handlePeerRates(download, upload int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.peerDown, t.peerUp = download, upload
+	for _, p := range t.peerConns {
+		if p, ok := p.(*Peer); ok && p.down != nil {
+			p.down[0].setRate(download)
+			p.up[0].setRate(upload)
+		}
+	}
+}
+
+// limitPeer puts a peer under its own limits, the torrent's and the
+// client's, before it's connected. ctx stops any wait for bandwidth.
+func (t *Torrent) limitPeer(ctx context.Context, p *Peer) {
+	t.Lock()
+	defer t.Unlock()
+	p.ctx = ctx
+	p.down = []*limiter{newLimiter(t.peerDown), t.down, t.client.down}
+	p.up = []*limiter{newLimiter(t.peerUp), t.up, t.client.up}
+	p.traffic = t.traffic
+}
@@ -0,0 +1,139 @@
+package torgo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_limiter(t *testing.T) {
+	start := time.Now()
+	l := newLimiter(1000)
+	cases := []struct {
+		n        int
+		at       time.Duration
+		expected time.Duration
+	}{
+		{1000, 0, 0}, // starts full
+		{500, 0, 500 * time.Millisecond},
+		{500, time.Second, 0},
+		{2000, 10 * time.Second, time.Second}, // holds a second's worth at most
+	}
+	for _, tc := range cases {
+		if got := l.reserve(tc.n, start.Add(tc.at)); got != tc.expected {
+			t.Errorf("%d bytes at %v: got a wait of %v; want %v", tc.n, tc.at, got, tc.expected)
+		}
+	}
+
+	l.setRate(0)
+	if got := l.reserve(1<<30, start.Add(11*time.Second)); got != 0 {
+		t.Errorf("got a wait of %v with no limit", got)
+	}
+}
+
+func Test_waitN(t *testing.T) {
+	l := newLimiter(10)
+	if err := waitN(context.Background(), 10, l, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := waitN(ctx, 100, newLimiter(0), l); err != context.DeadlineExceeded {
+		t.Errorf("got %v; want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v after the context was done", elapsed)
+	}
+}
+
+func Test_traffic(t *testing.T) {
+	tr := &traffic{}
+	piece := pieceMsg([]byte("0123456789"), 10, 0).WireMessage
+	tr.sent(piece, frameLen(piece))
+	tr.sent(Request{0, 0, 10}, 17)
+	tr.received(piece, frameLen(piece))
+	if tr.payloadUp != 10 || tr.overheadUp != 13+17 || tr.overheadDown != 13 {
+		t.Errorf("got %+v", *tr)
+	}
+	var none *traffic
+	none.sent(piece, frameLen(piece))
+}
+
+func Test_AltSpeedActive(t *testing.T) {
+	// 2 Jan 2006 was a Monday
+	at := func(day int, hour int) time.Time {
+		return time.Date(2006, 1, day, hour, 30, 0, 0, time.UTC)
+	}
+	office := &AltSpeed{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: 9 * time.Hour,
+		End:   17 * time.Hour,
+	}
+	overnight := &AltSpeed{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+	cases := []struct {
+		alt      *AltSpeed
+		now      time.Time
+		expected bool
+	}{
+		{office, at(2, 9), true},
+		{office, at(2, 8), false},
+		{office, at(2, 17), false},
+		{office, at(7, 12), false}, // saturday
+		{overnight, at(6, 23), true},
+		{overnight, at(7, 3), true}, // carried over from friday
+		{overnight, at(7, 23), false},
+		{overnight, at(6, 3), false},
+		{&AltSpeed{Start: time.Hour, End: time.Hour}, at(2, 1), false},
+	}
+	for _, tc := range cases {
+		if got := tc.alt.Active(tc.now); got != tc.expected {
+			t.Errorf("%+v at %v: got %v", tc.alt, tc.now.Format(time.RFC1123), got)
+		}
+	}
+}
+
+func Test_ClientRateLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestClient(t, dir)
+	defer c.Close()
+
+	c.SetRateLimits(1000, 500)
+	if down, up := c.down.getRate(), c.up.getRate(); down != 1000 || up != 500 {
+		t.Errorf("got limits %d and %d", down, up)
+	}
+	c.SetAltSpeed(&AltSpeed{DownloadLimit: 10, UploadLimit: 5, Start: 0, End: 24 * time.Hour})
+	if down, up := c.down.getRate(), c.up.getRate(); down != 10 || up != 5 {
+		t.Errorf("got limits %d and %d with the alternative speeds on", down, up)
+	}
+	c.SetAltSpeed(nil)
+	if down, up := c.down.getRate(), c.up.getRate(); down != 1000 || up != 500 {
+		t.Errorf("got limits %d and %d after turning the alternative speeds off", down, up)
+	}
+
+	ti := newTestTorrent(t, dir, []byte("rate limited"), 4).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.SetRateLimits(100, 50)
+	tor.SetPeerRateLimits(10, 5)
+	p := newPeer("10.0.0.1", 6881, nil)
+	tor.limitPeer(context.Background(), p)
+	limits := []int64{p.down[0].getRate(), p.down[1].getRate(), p.down[2].getRate(),
+		p.up[0].getRate(), p.up[1].getRate(), p.up[2].getRate()}
+	for i, expected := range []int64{10, 100, 1000, 5, 50, 500} {
+		if limits[i] != expected {
+			t.Errorf("got peer limits %v", limits)
+			break
+		}
+	}
+}
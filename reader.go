@@ -0,0 +1,169 @@
+package torgo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+const DEFAULT_READAHEAD = 1 << 20
+
+var errNegativeOffset = errors.New("negative offset")
+
+// readRange is the pieces a reader is waiting for, and the last piece of its
+// readahead past them.
+type readRange struct {
+	first     int
+	last      int
+	readahead int
+}
+
+// Reader reads one of a torrent's files while it downloads. Reads wait for
+// the pieces they cover, which are requested ahead of everything else along
+// with the readahead after them.
+type Reader struct {
+	t         *Torrent
+	ctx       context.Context
+	path      string
+	offset    int64 // where the file starts in the torrent
+	length    int64
+	pos       int64
+	readahead int64
+}
+
+// Files lists the paths of the torrent's files, slash separated and starting
+// with the torrent's name if it has more than one. Padding files are left out.
+func (t *Torrent) Files() []string {
+	var paths []string
+	for _, p := range t.filePaths() {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// OpenFile opens one of the paths from Files for reading. Reads give up with
+// ctx's error once it's done.
+func (t *Torrent) OpenFile(ctx context.Context, path string) (*Reader, error) {
+	i, ok := t.fileIndex(path)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &Reader{
+		t:         t,
+		ctx:       ctx,
+		path:      path,
+		offset:    t.layout[i].offset,
+		length:    t.layout[i].length,
+		readahead: DEFAULT_READAHEAD,
+	}, nil
+}
+
+func (r *Reader) Size() int64 {
+	return r.length
+}
+
+// SetReadahead sets how many bytes past each read are fetched early
+func (r *Reader) SetReadahead(n int64) {
+	r.readahead = n
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt blocks until the pieces under p have been downloaded and verified
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: r.path, Err: errNegativeOffset}
+	}
+	if off >= r.length {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > r.length-off {
+		n = r.length - off
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	pieceLength := r.t.ti.PieceLength
+	start := r.offset + off
+	end := start + n
+	ahead := end - 1 + r.readahead
+	if fileEnd := r.offset + r.length - 1; ahead > fileEnd {
+		ahead = fileEnd
+	}
+	rr := readRange{
+		first:     int(start / pieceLength),
+		last:      int((end - 1) / pieceLength),
+		readahead: int(ahead / pieceLength),
+	}
+	if err := r.t.waitPieces(r, rr); err != nil {
+		return 0, err
+	}
+	if err := r.t.Piecer.Read(int(start/pieceLength), int(start%pieceLength), p[:n]); err != nil {
+		return 0, err
+	}
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, &os.PathError{Op: "seek", Path: r.path, Err: os.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: r.path, Err: errNegativeOffset}
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close drops the reader's claim on the pieces it was reading
+func (r *Reader) Close() error {
+	r.t.post(readerClosed{r})
+	return nil
+}
+
+// waitPieces makes the pieces in rr the most urgent ones and blocks until
+// they've all been verified or r's context is done.
+func (t *Torrent) waitPieces(r *Reader, rr readRange) error {
+	t.post(readerWaiting{r, rr})
+	for {
+		t.Lock()
+		have := true
+		for i := rr.first; i <= rr.last; i++ {
+			if !t.WriteLog[i] {
+				have = false
+				break
+			}
+		}
+		pieceDone := t.pieceDone
+		t.Unlock()
+		if have {
+			return nil
+		}
+		select {
+		case <-pieceDone:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package torgo
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pieceMsg is a PIECE message carrying the whole of piece index
+func pieceMsg(data []byte, pieceLength, index int) message {
+	end := (index + 1) * pieceLength
+	if end > len(data) {
+		end = len(data)
+	}
+	return message{WireMessage: Piece{Index: index, Block: data[index*pieceLength : end]}}
+}
+
+func Test_ReaderWaitsForPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	tor := newTestTorrent(t, dir, data, 8)
+	r, err := tor.OpenFile(context.Background(), tor.Files()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetReadahead(8)
+
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, 4)
+	done := make(chan result)
+	go func() {
+		n, err := r.ReadAt(buf, 20)
+		done <- result{n, err}
+	}()
+
+	// the read's piece comes first, then its readahead, then the rest
+	for i := 0; ; i++ {
+		tor.Lock()
+		order := tor.pickOrder()
+		tor.Unlock()
+		if reflect.DeepEqual(order, []int{2, 3, 0, 1, 4, 5}) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("got pick order %v", order)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case res := <-done:
+		t.Fatalf("read returned %+v before its piece was there", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tor.handlePiece(pieceMsg(data, 8, 2))
+	res := <-done
+	if res.err != nil || res.n != 4 || string(buf) != string(data[20:24]) {
+		t.Errorf("got %d %q %v", res.n, buf, res.err)
+	}
+
+	r.Close()
+	tor.Lock()
+	order := tor.pickOrder()
+	tor.Unlock()
+	if !reflect.DeepEqual(order, []int{0, 1, 3, 4, 5}) {
+		t.Errorf("got pick order %v after closing the reader", order)
+	}
+}
+
+func Test_ReaderContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor := newTestTorrent(t, dir, []byte("nothing here has been verified"), 8)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r, err := tor.OpenFile(ctx, tor.Files()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 4)); err != context.DeadlineExceeded {
+		t.Errorf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := tor.OpenFile(ctx, "no/such/file"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a file that isn't in the torrent", err)
+	}
+}
+
+func Test_ReaderReadSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	tor := newTestTorrent(t, dir, data, 8)
+	tor.setHave(recheck(&tor.ti, tor.Piecer, 1, nil))
+	r, err := tor.OpenFile(context.Background(), tor.Files()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || string(got) != string(data) {
+		t.Errorf("got %q %v", got, err)
+	}
+
+	if pos, err := r.Seek(-8, io.SeekEnd); err != nil || pos != int64(len(data)-8) {
+		t.Fatalf("got %d %v seeking", pos, err)
+	}
+	buf := make([]byte, 16)
+	n, err := r.Read(buf)
+	if n != 8 || err != nil || string(buf[:n]) != "lazy dog" {
+		t.Errorf("got %d %q %v", n, buf[:n], err)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("got %v reading at the end; want EOF", err)
+	}
+	if n, err := r.ReadAt(buf, 40); n != 3 || err != io.EOF {
+		t.Errorf("got %d %v reading past the end", n, err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected seeking before the start to fail")
+	}
+}
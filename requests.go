@@ -0,0 +1,216 @@
+package torgo
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// BLOCK_SIZE is how much of a piece we ask a peer for at once, most
+	// clients refuse requests for more.
+	BLOCK_SIZE = 1 << 14
+	// REQUEST_TIMEOUT is how long a block can be outstanding before it's
+	// given back to the picker to ask someone else
+	REQUEST_TIMEOUT = 30 * time.Second
+	// SNUB_TIMEOUT is how long a peer can go without sending us anything
+	// while it has us unchoked and requests outstanding before it's snubbed
+	SNUB_TIMEOUT = 60 * time.Second
+	// MAX_QUEUED_REQUESTS is how many blocks we ask a peer for at once,
+	// SNUBBED_QUEUED_REQUESTS how many once it's snubbed us
+	MAX_QUEUED_REQUESTS     = 16
+	SNUBBED_QUEUED_REQUESTS = 1
+)
+
+// block is one request's worth of a piece
+type block struct {
+	index  int
+	begin  int
+	length int
+}
+
+// blocks splits a piece into the blocks we request it in
+func (ti *TorrentInfo) blocks(index int) []block {
+	pieceLen := int(ti.pieceLen(index))
+	blocks := make([]block, 0, (pieceLen+BLOCK_SIZE-1)/BLOCK_SIZE)
+	for begin := 0; begin < pieceLen; begin += BLOCK_SIZE {
+		length := BLOCK_SIZE
+		if begin+length > pieceLen {
+			length = pieceLen - begin
+		}
+		blocks = append(blocks, block{index: index, begin: begin, length: length})
+	}
+	return blocks
+}
+
+// missingBlocks are the blocks of a piece we haven't had yet, t has to be
+// locked.
+func (t *Torrent) missingBlocks(index int) []block {
+	var missing []block
+	for i, b := range t.ti.blocks(index) {
+		if got := t.partial[index]; got == nil || !got[i] {
+			missing = append(missing, b)
+		}
+	}
+	return missing
+}
+
+// endGame is true once every block of the pieces in order has been asked for
+// at least once. From then on the blocks still missing are asked for from
+// every peer that has them, so the last few don't wait on the slowest peer.
+// t has to be locked.
+func (t *Torrent) endGame(order []int) bool {
+	for _, i := range order {
+		for _, b := range t.missingBlocks(i) {
+			if len(t.requests[b]) == 0 {
+				return false
+			}
+		}
+	}
+	return len(order) > 0
+}
+
+// requested records that we've asked a peer for b, t has to be locked
+func (t *Torrent) requested(b block, id string, now time.Time) {
+	if t.requests[b] == nil {
+		t.requests[b] = make(map[string]time.Time)
+	}
+	t.requests[b][id] = now
+	if a := t.activityOf(id); a.waiting.IsZero() {
+		a.waiting = now
+	}
+}
+
+// queued counts the blocks each peer has outstanding, t has to be locked
+func (t *Torrent) queued() map[string]int {
+	queued := make(map[string]int)
+	for _, asked := range t.requests {
+		for id := range asked {
+			queued[id]++
+		}
+	}
+	return queued
+}
+
+// queueLimit is how many blocks we'll have outstanding with a peer at once, t
+// has to be locked.
+func (t *Torrent) queueLimit(id string) int {
+	if a, ok := t.activity[id]; ok && a.snubbed {
+		return SNUBBED_QUEUED_REQUESTS
+	}
+	return MAX_QUEUED_REQUESTS
+}
+
+// releaseRequests forgets everything we asked a peer for so the blocks go
+// back to the picker, for when it chokes us or goes away. t has to be locked.
+func (t *Torrent) releaseRequests(id string) {
+	for b, asked := range t.requests {
+		delete(asked, id)
+		if len(asked) == 0 {
+			delete(t.requests, b)
+		}
+	}
+}
+
+// expireRequests gives blocks that have been outstanding for longer than
+// REQUEST_TIMEOUT back to the picker and snubs peers that have gone quiet. It
+// returns the peers and blocks to send cancels for. t has to be locked.
+func (t *Torrent) expireRequests(now time.Time) ([]ConnPeer, []block) {
+	var peers []ConnPeer
+	var blocks []block
+	for b, asked := range t.requests {
+		for id, at := range asked {
+			if now.Sub(at) < REQUEST_TIMEOUT {
+				continue
+			}
+			delete(asked, id)
+			if p, ok := t.peerConns[id]; ok {
+				peers = append(peers, p)
+				blocks = append(blocks, b)
+			}
+			level.Debug(t.logger).Log("peer", id, "piece", b.index, "offset", b.begin, "err", "request timed out")
+		}
+		if len(asked) == 0 {
+			delete(t.requests, b)
+		}
+	}
+
+	for id, a := range t.activity {
+		if a.snubbed || a.unchoked.IsZero() || a.waiting.IsZero() {
+			continue
+		}
+		quiet := a.unchoked
+		if a.waiting.After(quiet) {
+			quiet = a.waiting
+		}
+		if now.Sub(quiet) >= SNUB_TIMEOUT {
+			a.snubbed = true
+			level.Info(t.logger).Log("peer", id, "snubbed", now.Sub(quiet))
+		}
+	}
+	return peers, blocks
+}
+
+// peerActivity is whether a peer is doing what we ask of it
+type peerActivity struct {
+	unchoked time.Time // when they unchoked us, zero while they're choking us
+	waiting  time.Time // when we asked for something, zero once they send data
+	snubbed  bool      // they've had us unchoked and sent nothing for SNUB_TIMEOUT
+}
+
+// activityOf is a peer's activity, t has to be locked
+func (t *Torrent) activityOf(id string) *peerActivity {
+	a, ok := t.activity[id]
+	if !ok {
+		a = &peerActivity{}
+		t.activity[id] = a
+	}
+	return a
+}
+
+// blockReceived marks b as had and returns the other peers we asked for it,
+// who should be sent a cancel. It's false if b isn't a block we want, either
+// because we already have it or it doesn't line up with our blocks. t has to
+// be locked.
+func (t *Torrent) blockReceived(b block, from string) ([]ConnPeer, bool) {
+	if b.index < 0 || b.index >= len(t.WriteLog) || t.WriteLog[b.index] || b.begin%BLOCK_SIZE != 0 {
+		return nil, false
+	}
+	blocks := t.ti.blocks(b.index)
+	i := b.begin / BLOCK_SIZE
+	if i >= len(blocks) || blocks[i] != b {
+		return nil, false
+	}
+	got := t.partial[b.index]
+	if got == nil {
+		got = make([]bool, len(blocks))
+		t.partial[b.index] = got
+	}
+	if got[i] {
+		return nil, false
+	}
+	got[i] = true
+
+	var others []ConnPeer
+	for id := range t.requests[b] {
+		if p, ok := t.peerConns[id]; ok && id != from {
+			others = append(others, p)
+		}
+	}
+	delete(t.requests, b)
+	return others, true
+}
+
+// pieceReceived is true once every block of a piece is in, t has to be locked
+func (t *Torrent) pieceReceived(index int) bool {
+	got := t.partial[index]
+	if got == nil {
+		return false
+	}
+	for _, ok := range got {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package torgo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_blocks(t *testing.T) {
+	ti := TorrentInfo{Info: Info{
+		PieceLength: 2*BLOCK_SIZE + 100,
+		Length:      3*BLOCK_SIZE + 200,
+		Pieces:      string(make([]byte, 40)),
+	}}
+	cases := []struct {
+		index    int
+		expected []block
+	}{
+		{0, []block{{0, 0, BLOCK_SIZE}, {0, BLOCK_SIZE, BLOCK_SIZE}, {0, 2 * BLOCK_SIZE, 100}}},
+		{1, []block{{1, 0, BLOCK_SIZE}, {1, BLOCK_SIZE, 100}}},
+	}
+	for _, tc := range cases {
+		if got := ti.blocks(tc.index); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("piece %d: got %v; want %v", tc.index, got, tc.expected)
+		}
+	}
+}
+
+// cancelled lists the pieces the peer was sent cancels for
+func (p *fakePeer) cancelled() []int {
+	p.Lock()
+	defer p.Unlock()
+	var pieces []int
+	for _, msg := range p.sent {
+		if cncl, ok := msg.(Cancel); ok {
+			pieces = append(pieces, cncl.Index)
+		}
+	}
+	return pieces
+}
+
+func Test_endGame(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	fast := &fakePeer{id: "fast"}
+	slow := &fakePeer{id: "slow"}
+	for _, p := range []*fakePeer{fast, slow} {
+		tor.peerConns[p.id] = p
+		tor.PeerPieceLog.LogField(p.id, []byte{0xfc})
+	}
+	now := time.Now()
+	tor.peerRates["fast"] = &peerRate{bytes: 1 << 20, at: now.Add(-time.Second)}
+	tor.peerRates["slow"] = &peerRate{bytes: 1 << 10, at: now.Add(-time.Second)}
+	tor.WriteLog[0] = true
+
+	tor.sendRequest(message{})
+	if got := slow.requested(); len(got) != 0 {
+		t.Errorf("slow peer got requests for %v before end-game", got)
+	}
+	tor.Lock()
+	endGame := tor.endGame(tor.pickOrder())
+	tor.Unlock()
+	if !endGame {
+		t.Fatal("not in end-game with every block requested")
+	}
+
+	// everything left goes to the slow peer as well
+	tor.sendRequest(message{})
+	if got := slow.requested(); !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("slow peer got requests for %v in end-game", got)
+	}
+	tor.sendRequest(message{})
+	if len(fast.requested()) != 5 || len(slow.requested()) != 5 {
+		t.Errorf("blocks asked for twice from the same peer: %v %v", fast.requested(), slow.requested())
+	}
+
+	msg := pieceMsg(data, 8, 3)
+	msg.source = "fast"
+	tor.handlePiece(msg)
+	if got := slow.cancelled(); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("slow peer got cancels for %v; want the piece fast sent", got)
+	}
+	if got := fast.cancelled(); len(got) != 0 {
+		t.Errorf("fast peer got cancels for %v", got)
+	}
+	msg.source = "slow"
+	tor.handlePiece(msg)
+	if !tor.WriteLog[3] || len(slow.cancelled()) != 1 {
+		t.Errorf("late copy of a block wasn't dropped")
+	}
+	tor.Lock()
+	_, pending := tor.requests[block{3, 0, 8}]
+	tor.Unlock()
+	if pending {
+		t.Error("received block is still marked as requested")
+	}
+}
+
+func Test_requestTimeouts(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	a := &fakePeer{id: "a", choking: true}
+	b := &fakePeer{id: "b", choking: true}
+	for _, p := range []*fakePeer{a, b} {
+		tor.peerConns[p.id] = p
+		tor.PeerPieceLog.LogField(p.id, []byte{0xfc})
+		tor.handleUnchoke(message{source: p.id, WireMessage: Unchoke{}})
+	}
+	tor.peerRates["a"] = &peerRate{bytes: 1 << 20, at: time.Now().Add(-time.Second)}
+
+	tor.sendRequest(message{})
+	if got := a.requested(); len(got) != 6 {
+		t.Fatalf("a got requests for %v", got)
+	}
+
+	// a goes quiet, its requests time out and it's snubbed
+	now := time.Now()
+	tor.Lock()
+	peers, blocks := tor.expireRequests(now.Add(REQUEST_TIMEOUT))
+	pending := len(tor.requests)
+	tor.Unlock()
+	if len(peers) != 6 || len(blocks) != 6 || pending != 0 {
+		t.Errorf("got %d cancels and %d blocks still requested after the timeout", len(peers), pending)
+	}
+	tor.Lock()
+	tor.requested(block{0, 0, 8}, "a", now)
+	tor.expireRequests(now.Add(SNUB_TIMEOUT))
+	snubbed := tor.activity["a"].snubbed
+	limit := tor.queueLimit("a")
+	tor.Unlock()
+	if !snubbed || limit != SNUBBED_QUEUED_REQUESTS {
+		t.Errorf("quiet peer snubbed %v with a queue of %d", snubbed, limit)
+	}
+
+	// data from it ends the snub
+	tor.Lock()
+	tor.received("a", 8, now)
+	snubbed = tor.activity["a"].snubbed
+	tor.Unlock()
+	if snubbed {
+		t.Error("peer still snubbed after sending data")
+	}
+}
+
+func Test_handleChoke(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	a := &fakePeer{id: "a"}
+	tor.peerConns[a.id] = a
+	tor.PeerPieceLog.LogField(a.id, []byte{0xfc})
+	tor.sendRequest(message{})
+	if got := a.requested(); len(got) != 6 {
+		t.Fatalf("a got requests for %v", got)
+	}
+
+	tor.handleChoke(message{source: "a", WireMessage: Choke{}})
+	tor.Lock()
+	pending := len(tor.requests)
+	tor.Unlock()
+	if pending != 0 || !a.GetPeerChoking() {
+		t.Errorf("%d blocks still requested from a peer that choked us", pending)
+	}
+
+	// once it unchokes us the blocks are asked for again
+	tor.handleUnchoke(message{source: "a", WireMessage: Unchoke{}})
+	tor.sendRequest(message{})
+	if got := a.requested(); len(got) != 12 {
+		t.Errorf("a got requests for %v after unchoking", got)
+	}
+}
+
+func Test_sendRequestSkipsBacklog(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	slow := &fakePeer{id: "slow", choking: true, backlog: true}
+	ok := &fakePeer{id: "ok", choking: true}
+	for _, p := range []*fakePeer{slow, ok} {
+		tor.peerConns[p.id] = p
+		tor.PeerPieceLog.LogField(p.id, []byte{0xfc})
+		tor.handleUnchoke(message{source: p.id, WireMessage: Unchoke{}})
+	}
+	tor.sendRequest(message{})
+	if got := slow.requested(); len(got) != 0 {
+		t.Errorf("backlogged peer was asked for %v", got)
+	}
+	if got := ok.requested(); len(got) == 0 {
+		t.Error("nothing asked of the peer keeping up")
+	}
+}
+
+func Test_handleShutdownCancels(t *testing.T) {
+	tor, cleanup := newPickerTorrent(t)
+	defer cleanup()
+
+	a := &fakePeer{id: "a", choking: true}
+	tor.peerConns[a.id] = a
+	tor.PeerPieceLog.LogField(a.id, []byte{0xfc})
+	tor.handleUnchoke(message{source: a.id, WireMessage: Unchoke{}})
+	tor.sendRequest(message{})
+	asked := a.requested()
+	if len(asked) == 0 {
+		t.Fatal("nothing requested")
+	}
+
+	tor.handleShutdown()
+	if got := a.cancelled(); len(got) != len(asked) {
+		t.Errorf("got cancels for %v; want one for each of %v", got, asked)
+	}
+	if len(tor.peerConns) != 0 || len(tor.requests) != 0 {
+		t.Error("peers or requests left after shutting down")
+	}
+}
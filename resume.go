@@ -0,0 +1,234 @@
+package torgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/zanadar/torgo/bencode"
+)
+
+var errResumeMismatch = errors.New("resume data doesn't belong to this torrent")
+
+// resumeData is what we persist between runs so a restart doesn't have to
+// download (or hash) everything again.
+type resumeData struct {
+	InfoHash   string       `bencode:"info-hash"`
+	Pieces     string       `bencode:"pieces"` // bitfield of verified pieces
+	Files      []resumeFile `bencode:"files"`
+	Downloaded int64        `bencode:"downloaded"`
+	Uploaded   int64        `bencode:"uploaded"`
+	Peers      string       `bencode:"peers"` // compact ip:port, same as the tracker sends
+}
+
+type resumeFile struct {
+	Length int64 `bencode:"length"`
+	Mtime  int64 `bencode:"mtime"`
+}
+
+func readResume(path string) (*resumeData, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := &resumeData{}
+	err = bencode.Unmarshal(data, rd)
+	return rd, err
+}
+
+func writeResume(path string, rd *resumeData) error {
+	data, err := bencode.Marshal(rd)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic goes through a temp file so a crash mid write can't leave
+// us with a half written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// dataPaths are the files on disk backing the torrent
+func (t *Torrent) dataPaths() []string {
+	if p, ok := t.Piecer.(interface{ paths() []string }); ok {
+		return p.paths()
+	}
+	return nil
+}
+
+func statFiles(paths []string) ([]resumeFile, error) {
+	files := make([]resumeFile, len(paths))
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue // skipped files may never be created
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[i] = resumeFile{Length: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	}
+	return files, nil
+}
+
+func (t *Torrent) saveResume() error {
+	// make sure the mtimes we record are for data that is actually on disk
+	if err := t.Piecer.Sync(); err != nil {
+		return err
+	}
+	files, err := statFiles(t.dataPaths())
+	if err != nil {
+		return err
+	}
+
+	have := newBitfield(len(t.WriteLog))
+	for i, written := range t.WriteLog {
+		if written {
+			have.Set(i)
+		}
+	}
+
+	rd := &resumeData{
+		InfoHash:   string(t.ti.InfoHash),
+		Pieces:     string(have),
+		Files:      files,
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded + atomic.LoadInt64(&t.traffic.payloadUp),
+	}
+	t.Lock()
+	rd.Peers = compactPeers(t.PeerList)
+	t.Unlock()
+	level.Debug(t.logger).Log("resume", t.resumePath, "have", have.Count())
+	return writeResume(t.resumePath, rd)
+}
+
+// loadResume restores state from the resume file if there is one. If the files
+// on disk have changed since it was written, only the pieces it claims are
+// rechecked rather than trusting them outright.
+func (t *Torrent) loadResume() error {
+	// a Piecer that keeps track of its complete pieces knows better than the
+	// resume file what it still has
+	stored := t.Piecer.Completed()
+	rd, err := readResume(t.resumePath)
+	if os.IsNotExist(err) {
+		if stored != nil {
+			t.setHave(stored)
+			return nil
+		}
+		// no resume data, but if there's something on disk already see what of it is good
+		if files, err := statFiles(t.dataPaths()); err == nil && anyData(files) {
+			level.Info(t.logger).Log("resume", "no resume data, rechecking existing files")
+			t.setHave(recheck(&t.ti, t.Piecer, runtime.NumCPU(), nil))
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	have := Bitfield(rd.Pieces)
+	if rd.InfoHash != string(t.ti.InfoHash) || len(have) != len(newBitfield(len(t.WriteLog))) {
+		return errResumeMismatch
+	}
+
+	if stored != nil {
+		have = stored
+	} else if files, err := statFiles(t.dataPaths()); err != nil || !sameFiles(files, rd.Files) {
+		level.Info(t.logger).Log("resume", "files changed since last run, rechecking")
+		have = recheck(&t.ti, t.Piecer, runtime.NumCPU(), have.Has)
+	}
+
+	t.setHave(have)
+	t.downloaded = rd.Downloaded
+	t.uploaded = rd.Uploaded
+	t.PeerList = mergePeers(t.PeerList, parseCompactPeers(rd.Peers, t.logger))
+	level.Info(t.logger).Log("resume", t.resumePath, "have", have.Count(), "of", len(t.WriteLog))
+
+	return nil
+}
+
+func (t *Torrent) setHave(have Bitfield) {
+	for i := range t.WriteLog {
+		t.WriteLog[i] = have.Has(i)
+	}
+}
+
+func anyData(files []resumeFile) bool {
+	for _, f := range files {
+		if f.Length > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func sameFiles(a, b []resumeFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compactPeers(peers []ConnPeer) string {
+	var buf bytes.Buffer
+	for _, cp := range peers {
+		p, ok := cp.(*Peer)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(p.IP).To4()
+		if ip == nil {
+			continue
+		}
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, uint16(p.Port))
+	}
+	return buf.String()
+}
+
+// mergePeers appends the peers in extra we don't already know about
+func mergePeers(peers []ConnPeer, extra []ConnPeer) []ConnPeer {
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		seen[p.String()] = true
+	}
+	for _, p := range extra {
+		if !seen[p.String()] {
+			seen[p.String()] = true
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
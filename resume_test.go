@@ -0,0 +1,131 @@
+package torgo
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// newTestTorrent writes data to a file in dir and returns a torrent for it
+// with nothing marked as written yet.
+func newTestTorrent(t *testing.T, dir string, data []byte, pieceLength int64) *Torrent {
+	var pieces []byte
+	for i := int64(0); i < int64(len(data)); i += pieceLength {
+		end := i + pieceLength
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sum := sha1.Sum(data[i:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	ti := TorrentInfo{
+		Info: Info{
+			Name:        "data",
+			Pieces:      string(pieces),
+			Length:      int64(len(data)),
+			PieceLength: pieceLength,
+		},
+		InfoHash: []byte("01234567890123456789"),
+	}
+	tor := openTestTorrent(t, dir, ti)
+	// only once it's open, or it'd find the data and check it off
+	if err := ioutil.WriteFile(filepath.Join(dir, "data"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tor
+}
+
+// openTestTorrent opens ti in dir the way a client adds it, but without
+// starting it. There's no cache, so what's written is on disk straight away.
+func openTestTorrent(t *testing.T, dir string, ti TorrentInfo, opts ...AddOption) *Torrent {
+	c, err := NewClient(context.Background(), ClientConfig{
+		DownloadDir: dir,
+		ResumeDir:   dir,
+		CacheSize:   -1,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	tor, err := newTorrent(ti, c, log.NewNopLogger(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor
+}
+
+func Test_resumeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	tor := newTestTorrent(t, dir, data, 8)
+	tor.WriteLog[0] = true
+	tor.WriteLog[2] = true
+	tor.WriteLog[5] = true
+	tor.downloaded = 24
+	tor.PeerList = []ConnPeer{newPeer("10.0.0.1", 6881, log.NewNopLogger())}
+	if err := tor.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		corrupt  bool
+		expected []bool
+	}{
+		{"unchanged files are trusted", false, []bool{true, false, true, false, false, true}},
+		{"changed files are rechecked", true, []bool{true, false, false, false, false, true}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.corrupt {
+				f, err := os.OpenFile(filepath.Join(dir, "data"), os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte("X"), 17) // lands in piece 2
+				f.Close()
+			}
+			// opening it again loads the resume data
+			fresh := openTestTorrent(t, dir, tor.ti)
+			defer fresh.close()
+			for i, want := range tc.expected {
+				if fresh.WriteLog[i] != want {
+					t.Errorf("piece %d: got %v; want %v", i, fresh.WriteLog[i], want)
+				}
+			}
+			if fresh.downloaded != 24 {
+				t.Errorf("got downloaded %d; want 24", fresh.downloaded)
+			}
+			if len(fresh.PeerList) != 1 || fresh.PeerList[0].String() != "10.0.0.1:6881" {
+				t.Errorf("got peers %v; want 10.0.0.1:6881", fresh.PeerList)
+			}
+		})
+	}
+}
+
+func Test_loadResumeWrongTorrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor := newTestTorrent(t, dir, []byte("some data"), 4)
+	if err := tor.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	tor.ti.InfoHash = []byte("98765432109876543210")
+	if err := tor.loadResume(); err != errResumeMismatch {
+		t.Fatalf("got %v; want %v", err, errResumeMismatch)
+	}
+}
@@ -0,0 +1,119 @@
+package torgo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SNIFF_LENGTH is how much of the start of a file is read to work out its
+// type when its name doesn't say
+const SNIFF_LENGTH = 512
+
+// Handler serves the files of a Client's torrents over HTTP while they
+// download, each at /<info hash>/<path from Torrent.Files>. Range and HEAD
+// requests work, a seek moves the torrent's downloading to wherever the
+// range starts. / lists every file the handler can serve.
+type Handler struct {
+	c *Client
+}
+
+func NewHandler(c *Client) *Handler {
+	return &Handler{c: c}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Path == "/" {
+		h.serveIndex(w, req)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	var infoHash [20]byte
+	if len(parts) != 2 || hex.DecodedLen(len(parts[0])) != len(infoHash) {
+		http.NotFound(w, req)
+		return
+	}
+	if _, err := hex.Decode(infoHash[:], []byte(parts[0])); err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	t, ok := h.c.Torrent(infoHash)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	r, err := t.OpenFile(req.Context(), parts[1])
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer r.Close()
+
+	// ServeContent does the ranges. It would sniff the type too, but only a
+	// GET of the whole file is going to read the start of it anyway. Reading
+	// it for anything else would hold up a HEAD or a seek on the first piece.
+	name := path.Base(parts[1])
+	sniff := req.Method == "GET" && req.Header.Get("Range") == ""
+	ctype, err := contentType(r, name, sniff)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, req, name, time.Time{}, r)
+}
+
+// contentType is the type of the file called name, from its extension or
+// failing that by sniffing the start of what r reads. Without sniff it's
+// left as plain bytes.
+func contentType(r io.ReaderAt, name string, sniff bool) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	if !sniff {
+		return "application/octet-stream", nil
+	}
+	buf := make([]byte, SNIFF_LENGTH)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// fileURL is where a torrent's file is served
+func fileURL(infoHash [20]byte, file string) string {
+	segments := strings.Split(file, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return fmt.Sprintf("/%x/%s", infoHash, strings.Join(segments, "/"))
+}
+
+func (h *Handler) serveIndex(w http.ResponseWriter, req *http.Request) {
+	var urls []string
+	for _, t := range h.c.Torrents() {
+		for _, file := range t.Files() {
+			urls = append(urls, fileURL(t.InfoHash(), file))
+		}
+	}
+	sort.Strings(urls)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, u := range urls {
+		fmt.Fprintln(w, u)
+	}
+}
@@ -0,0 +1,108 @@
+package torgo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_Handler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewClient(context.Background(), ClientConfig{DownloadDir: dir, ResumeDir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := "the quick brown fox jumps over the lazy dog"
+	ti := newTestTorrent(t, dir, []byte(data), 8).ti
+	ti.Name = "data"
+	tor, err := c.AddTorrent(&ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileURL := fmt.Sprintf("/%x/data", tor.InfoHash())
+
+	srv := httptest.NewServer(NewHandler(c))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+		body    string
+		expect  map[string]string
+	}{
+		{"whole file", "GET", fileURL, nil, 200, data, map[string]string{
+			"Content-Type":   "text/plain; charset=utf-8",
+			"Content-Length": "43",
+			"Accept-Ranges":  "bytes",
+		}},
+		{"range", "GET", fileURL, map[string]string{"Range": "bytes=4-8"}, 206, "quick", map[string]string{
+			"Content-Range":  "bytes 4-8/43",
+			"Content-Length": "5",
+			"Content-Type":   "application/octet-stream",
+		}},
+		{"open ended range", "GET", fileURL, map[string]string{"Range": "bytes=-3"}, 206, "dog", nil},
+		{"unsatisfiable range", "GET", fileURL, map[string]string{"Range": "bytes=50-60"}, 416, "", nil},
+		{"head", "HEAD", fileURL, nil, 200, "", map[string]string{
+			"Content-Type":   "application/octet-stream",
+			"Content-Length": "43",
+		}},
+		{"index", "GET", "/", nil, 200, fileURL + "\n", nil},
+		{"unknown file", "GET", fmt.Sprintf("/%x/nope", tor.InfoHash()), nil, 404, "", nil},
+		{"unknown torrent", "GET", "/0000000000000000000000000000000000000000/data", nil, 404, "", nil},
+		{"bad info hash", "GET", "/xyz/data", nil, 404, "", nil},
+		{"post", "POST", fileURL, nil, 405, "", map[string]string{"Allow": "GET, HEAD"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("got status %d; want %d", resp.StatusCode, tc.status)
+			}
+			if tc.body != "" && string(body) != tc.body {
+				t.Errorf("got body %q; want %q", body, tc.body)
+			}
+			if tc.method == "HEAD" && len(body) != 0 {
+				t.Errorf("got a body for HEAD: %q", body)
+			}
+			for k, v := range tc.expect {
+				if got := resp.Header.Get(k); got != v {
+					t.Errorf("got %s %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func Test_fileURL(t *testing.T) {
+	got := fileURL([20]byte{0xab}, "dir/a file?#.mkv")
+	if !strings.HasSuffix(got, "/dir/a%20file%3F%23.mkv") || !strings.HasPrefix(got, "/ab00") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,159 @@
+package torgo
+
+import (
+	"sync/atomic"
+)
+
+// TorrentState is what a torrent in a Client is doing
+type TorrentState int
+
+const (
+	StatePaused TorrentState = iota
+	StateDownloading
+	StateSeeding
+	StateError // paused by something going wrong, see TorrentStats.Err
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case StatePaused:
+		return "paused"
+	case StateDownloading:
+		return "downloading"
+	case StateSeeding:
+		return "seeding"
+	case StateError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// TorrentStats is a snapshot of a torrent's progress
+type TorrentStats struct {
+	State      TorrentState
+	Length     int64 // size of all the torrent's data
+	Completed  int64 // bytes in pieces we have and have verified
+	Pieces     int
+	PiecesDone int
+	Downloaded int64 // piece data received from peers, counting any that was dropped or failed to verify
+	Uploaded   int64
+	Peers      int
+	Err        error // why the torrent stopped, if it's in StateError
+
+	// Overhead is the bytes of protocol messages sent and received besides
+	// the piece data in Downloaded and Uploaded
+	DownloadOverhead int64
+	UploadOverhead   int64
+
+	// Selected is the bytes in pieces of files that aren't skipped, and
+	// SelectedDone how many of them we have
+	Selected     int64
+	SelectedDone int64
+
+	// CacheHits are reads of the torrent's data served from memory and
+	// CacheMisses the ones that went to storage
+	CacheHits   int64
+	CacheMisses int64
+}
+
+// Progress is the fraction of the files we want that's complete, from 0 to 1
+func (s TorrentStats) Progress() float64 {
+	if s.Selected == 0 {
+		return 1
+	}
+	return float64(s.SelectedDone) / float64(s.Selected)
+}
+
+func (t *Torrent) Name() string {
+	return t.ti.Name
+}
+
+func (t *Torrent) InfoHash() [20]byte {
+	var infoHash [20]byte
+	copy(infoHash[:], t.ti.InfoHash)
+	return infoHash
+}
+
+// Info is the torrent's metadata
+func (t *Torrent) Info() *TorrentInfo {
+	return &t.ti
+}
+
+// Stats is safe to call at any time from any goroutine
+func (t *Torrent) Stats() TorrentStats {
+	t.Lock()
+	defer t.Unlock()
+	stats := TorrentStats{
+		Length:     t.ti.totalLength(),
+		Pieces:     len(t.WriteLog),
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded + atomic.LoadInt64(&t.traffic.payloadUp),
+		Peers:      len(t.peerConns),
+
+		DownloadOverhead: atomic.LoadInt64(&t.traffic.overheadDown),
+		UploadOverhead:   atomic.LoadInt64(&t.traffic.overheadUp),
+	}
+	if t.cache != nil {
+		stats.CacheHits = atomic.LoadInt64(&t.cache.hits)
+		stats.CacheMisses = atomic.LoadInt64(&t.cache.misses)
+	}
+	for i, done := range t.WriteLog {
+		selected := t.piecePriorities[i] != FileSkip
+		if selected {
+			stats.Selected += t.ti.pieceLen(i)
+		}
+		if done {
+			stats.PiecesDone++
+			stats.Completed += t.ti.pieceLen(i)
+			if selected {
+				stats.SelectedDone += t.ti.pieceLen(i)
+			}
+		}
+	}
+	switch {
+	case t.err != nil:
+		stats.State = StateError
+		stats.Err = t.err
+	case !t.running():
+		stats.State = StatePaused
+	case t.completed:
+		stats.State = StateSeeding
+	default:
+		stats.State = StateDownloading
+	}
+	return stats
+}
+
+// Complete is closed once every piece of the files we want has been
+// downloaded and verified and the files have been moved out of the incomplete
+// directory, straight away if they were already there when the torrent was
+// added.
+func (t *Torrent) Complete() <-chan struct{} {
+	return t.complete
+}
+
+// allWritten is true once every piece we want is written, t has to be locked
+func (t *Torrent) allWritten() bool {
+	for i, done := range t.WriteLog {
+		if !done && t.piecePriorities[i] != FileSkip {
+			return false
+		}
+	}
+	return true
+}
+
+// checkComplete finishes the torrent if every piece we want is written, t
+// has to be locked. Complete promises the data is in storage, not just in the
+// cache, and that the files are where they belong. Getting them there is
+// done in the background and complete is closed once the loop hears it's
+// done.
+func (t *Torrent) checkComplete() {
+	if t.completed || !t.allWritten() {
+		return
+	}
+	t.completed = true
+	go func(to *StorageInfo) {
+		written, err := t.finish(to)
+		t.post(moved{written, err})
+	}(t.moveTo)
+}
@@ -0,0 +1,543 @@
+package torgo
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Piecer is where a torrent's data is kept while it's open, a Storage opens
+// one for each torrent.
+type Piecer interface {
+	Write(index int, begin int, data []byte) error
+	Read(index int, begin int, data []byte) error
+	// Sync makes sure everything written so far is kept
+	Sync() error
+	Close() error
+	// MarkComplete tells the Piecer a piece has been verified. It's a hint,
+	// a Piecer is free to ignore it and the file and mmap ones do, so
+	// nothing should count on it being kept.
+	MarkComplete(index int) error
+	// Completed is the pieces marked complete, nil if the Piecer doesn't keep
+	// track. Only a non-nil Completed is trusted over the resume file, nil
+	// always means falling back to the resume file or a recheck.
+	Completed() Bitfield
+}
+
+// Storage opens the Piecer for each torrent it's given. The client's Storage
+// is set in ClientConfig, UseStorage picks another for a single torrent.
+type Storage interface {
+	Open(info StorageInfo) (Piecer, error)
+}
+
+// StorageInfo is what a Storage is told about a torrent it's opening
+type StorageInfo struct {
+	InfoHash    [20]byte
+	Dir         string // the client's download directory
+	Files       []StorageFile
+	PieceCount  int
+	PieceLength int
+}
+
+// StorageFile is one of a torrent's files, laid end to end they make up the
+// torrent's data.
+type StorageFile struct {
+	Path   string // from Dir
+	Offset int64
+	Length int64
+	Pad    bool // padding is all zeros and never stored
+	Skip   bool // not wanted, only stored if a wanted piece spills into it
+}
+
+var errMmapUnsupported = errors.New("mmap storage isn't supported on this platform")
+
+// mover is a Piecer that can move a torrent's files somewhere else on disk
+type mover interface {
+	move(to StorageInfo) error
+}
+
+// UseStorage keeps the torrent in s instead of the client's Storage
+func UseStorage(s Storage) AddOption {
+	return func(t *Torrent) error {
+		t.storage = s
+		return nil
+	}
+}
+
+func newStorageInfo(ti *TorrentInfo, dir string, entries []fileEntry) StorageInfo {
+	info := StorageInfo{
+		Dir:         dir,
+		Files:       make([]StorageFile, len(entries)),
+		PieceCount:  ti.pieceCount(),
+		PieceLength: int(ti.PieceLength),
+	}
+	copy(info.InfoHash[:], ti.InfoHash)
+	for i, e := range entries {
+		info.Files[i] = StorageFile{Path: e.path, Offset: e.offset, Length: e.length, Pad: e.pad, Skip: e.skip}
+	}
+	return info
+}
+
+func (info StorageInfo) entries() []fileEntry {
+	entries := make([]fileEntry, len(info.Files))
+	for i, f := range info.Files {
+		entries[i] = fileEntry{path: f.Path, offset: f.Offset, length: f.Length, pad: f.Pad, skip: f.Skip}
+	}
+	return entries
+}
+
+// staged is where info's files are kept until the torrent is complete: under
+// dir, with suffix on the end of their names.
+func (info StorageInfo) staged(dir, suffix string) StorageInfo {
+	staged := info
+	staged.Dir = dir
+	staged.Files = append([]StorageFile(nil), info.Files...)
+	for i := range staged.Files {
+		if !staged.Files[i].Pad {
+			staged.Files[i].Path += suffix
+		}
+	}
+	return staged
+}
+
+// locate works out where the files of a torrent that ends up at info are on
+// disk under config. While it downloads they're kept under IncompleteDir with
+// IncompleteSuffix on their names, moveTo is then where they go once it's
+// complete. A torrent that was moved when it finished is found where it
+// ended up, moveTo is nil.
+func (config ClientConfig) locate(info StorageInfo) (at StorageInfo, moveTo *StorageInfo) {
+	if config.IncompleteDir == "" && config.IncompleteSuffix == "" {
+		return info, nil
+	}
+	dir := config.IncompleteDir
+	if dir == "" {
+		dir = config.DownloadDir
+	}
+	staged := info.staged(dir, config.IncompleteSuffix)
+	if staged.exists() || !info.exists() {
+		return staged, &info
+	}
+	return info, nil
+}
+
+// exists is true if any of info's files are on disk
+func (info StorageInfo) exists() bool {
+	for _, f := range info.Files {
+		if f.Pad {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(info.Dir, f.Path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// length is how much data the torrent has altogether
+func (info StorageInfo) length() int64 {
+	if len(info.Files) == 0 {
+		return 0
+	}
+	last := info.Files[len(info.Files)-1]
+	return last.Offset + last.Length
+}
+
+// eachEntry splits data at offset up between the entries it falls in and
+// calls fn with the index of each, its part of data and where in the entry
+// that part goes.
+func eachEntry(entries []fileEntry, offset int64, data []byte, fn func(int, []byte, int64) error) error {
+	for i, e := range entries {
+		if len(data) == 0 {
+			break
+		}
+		if e.length == 0 || offset >= e.offset+e.length {
+			continue
+		}
+		n := e.offset + e.length - offset
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if err := fn(i, data[:n], offset-e.offset); err != nil {
+			return err
+		}
+		data = data[n:]
+		offset += n
+	}
+	if len(data) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// entryPaths are where entries live under dir, padding left out
+func entryPaths(dir string, entries []fileEntry) []string {
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.pad {
+			paths = append(paths, filepath.Join(dir, e.path))
+		}
+	}
+	return paths
+}
+
+// FileStorage keeps each of a torrent's files in a file of its own under the
+// download directory. It's what torrents use unless they're told otherwise.
+type FileStorage struct{}
+
+func (FileStorage) Open(info StorageInfo) (Piecer, error) {
+	if err := info.checkPaths(); err != nil {
+		return nil, err
+	}
+	p, err := newPiecerFS(info.Dir, info.entries(), info.PieceCount, info.PieceLength)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// MmapStorage lays a torrent's files out on disk like FileStorage but reads
+// and writes them through memory maps. Files are grown to their full length
+// when they're mapped, anything that truncates them underneath a running
+// torrent will crash it.
+type MmapStorage struct{}
+
+func (MmapStorage) Open(info StorageInfo) (Piecer, error) {
+	if err := info.checkPaths(); err != nil {
+		return nil, err
+	}
+	return openMmap(info)
+}
+
+// MemoryStorage keeps torrents in memory, for tests and jobs that don't need
+// the data to outlive the process. A torrent opened again picks up the data
+// and completed pieces it had, until it's deleted.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	torrents map[[20]byte]*memPiecer
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{torrents: make(map[[20]byte]*memPiecer)}
+}
+
+func (s *MemoryStorage) Open(info StorageInfo) (Piecer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.torrents[info.InfoHash]; ok && p.length == info.length() && p.pieceLength == info.PieceLength {
+		return p, nil
+	}
+	p := &memPiecer{
+		pieces:      make([][]byte, info.PieceCount),
+		have:        newBitfield(info.PieceCount),
+		length:      info.length(),
+		pieceLength: info.PieceLength,
+	}
+	s.torrents[info.InfoHash] = p
+	return p, nil
+}
+
+// Delete lets go of everything kept for a torrent
+func (s *MemoryStorage) Delete(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// memPiecer holds a torrent's pieces in memory, they're only allocated once
+// something is written to them.
+type memPiecer struct {
+	mu          sync.Mutex
+	pieces      [][]byte
+	have        Bitfield
+	length      int64
+	pieceLength int
+}
+
+// span calls fn with each piece the n bytes at begin in piece index fall in,
+// where in the piece they start and how many of them there are.
+func (p *memPiecer) span(index, begin, n int, fn func(piece, off, n int)) error {
+	offset := int64(index)*int64(p.pieceLength) + int64(begin)
+	if index < 0 || begin < 0 || offset+int64(n) > p.length {
+		return io.ErrUnexpectedEOF
+	}
+	for n > 0 {
+		piece, off := int(offset/int64(p.pieceLength)), int(offset%int64(p.pieceLength))
+		m := p.pieceLength - off
+		if m > n {
+			m = n
+		}
+		fn(piece, off, m)
+		offset += int64(m)
+		n -= m
+	}
+	return nil
+}
+
+func (p *memPiecer) Write(index int, begin int, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.span(index, begin, len(data), func(piece, off, n int) {
+		if p.pieces[piece] == nil {
+			p.pieces[piece] = make([]byte, p.pieceLength)
+		}
+		copy(p.pieces[piece][off:], data[:n])
+		data = data[n:]
+	})
+}
+
+func (p *memPiecer) Read(index int, begin int, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.span(index, begin, len(data), func(piece, off, n int) {
+		if p.pieces[piece] == nil {
+			for i := range data[:n] {
+				data[i] = 0
+			}
+		} else {
+			copy(data, p.pieces[piece][off:off+n])
+		}
+		data = data[n:]
+	})
+}
+
+func (p *memPiecer) Sync() error  { return nil }
+func (p *memPiecer) Close() error { return nil } // the storage keeps the data
+
+func (p *memPiecer) MarkComplete(index int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.have.Set(index)
+	return nil
+}
+
+func (p *memPiecer) Completed() Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append(Bitfield(nil), p.have...)
+}
+
+// PiecerFS stores a torrent on disk with a file per file in the torrent,
+// pieces that span files are split between them.
+type PiecerFS struct {
+	io         sync.RWMutex // held for reading around reads and writes, move and Close take it to swap the files out
+	mu         sync.Mutex   // guards files, dir and entries, skipped files are opened on first write
+	files      []*os.File
+	entries    []fileEntry
+	dir        string
+	flag       int
+	blockSize  int
+	pieceCount int
+}
+
+func newPiecerFS(dir string, entries []fileEntry, pieceCount int, blockSize int) (*PiecerFS, error) {
+	// don't truncate, whatever is already there may be resumed
+	return openPiecerFS(dir, entries, pieceCount, blockSize, os.O_RDWR|os.O_CREATE)
+}
+
+// openPiecerFSReadOnly doesn't create anything, reads from missing files fail
+func openPiecerFSReadOnly(dir string, entries []fileEntry, pieceCount int, blockSize int) (*PiecerFS, error) {
+	return openPiecerFS(dir, entries, pieceCount, blockSize, os.O_RDONLY)
+}
+
+func openPiecerFS(dir string, entries []fileEntry, pieceCount int, blockSize int, flag int) (*PiecerFS, error) {
+	p := &PiecerFS{
+		files:      make([]*os.File, len(entries)),
+		entries:    entries,
+		dir:        dir,
+		flag:       flag,
+		blockSize:  blockSize,
+		pieceCount: pieceCount,
+	}
+	for i, e := range entries {
+		if e.pad {
+			continue
+		}
+		// skipped files are used if they're there but not created
+		create := flag&os.O_CREATE != 0 && !e.skip
+		f, err := p.open(e, create)
+		if os.IsNotExist(err) && !create {
+			continue
+		}
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.files[i] = f
+	}
+	return p, nil
+}
+
+func (p *PiecerFS) open(e fileEntry, create bool) (*os.File, error) {
+	path := filepath.Join(p.dir, e.path)
+	flag := p.flag &^ os.O_CREATE
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	return os.OpenFile(path, flag, 0644)
+}
+
+// file is the open file for entry i, nil for padding. If create is set a
+// file that isn't there yet is created, if the PiecerFS is allowed to.
+func (p *PiecerFS) file(i int, create bool) (*os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[i]
+	if p.files[i] != nil || e.pad {
+		return p.files[i], nil
+	}
+	if !create || p.flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(p.dir, e.path), Err: os.ErrNotExist}
+	}
+	f, err := p.open(e, true)
+	if err != nil {
+		return nil, err
+	}
+	p.files[i] = f
+	return f, nil
+}
+
+func (p *PiecerFS) Write(index int, begin int, data []byte) error {
+	p.io.RLock()
+	defer p.io.RUnlock()
+	return p.each(p.calcOffset(index, begin), data, true, func(f *os.File, b []byte, off int64) error {
+		if f == nil {
+			return nil // padding
+		}
+		_, err := f.WriteAt(b, off)
+		return err
+	})
+}
+
+func (p *PiecerFS) Read(index int, begin int, data []byte) error {
+	p.io.RLock()
+	defer p.io.RUnlock()
+	return p.each(p.calcOffset(index, begin), data, false, func(f *os.File, b []byte, off int64) error {
+		if f == nil {
+			for i := range b {
+				b[i] = 0
+			}
+			return nil
+		}
+		_, err := f.ReadAt(b, off)
+		return err
+	})
+}
+
+// each splits data up between the files it falls in and calls fn with each
+// part, padding files get a nil *os.File. Missing files are created if create
+// is set.
+func (p *PiecerFS) each(offset int64, data []byte, create bool, fn func(*os.File, []byte, int64) error) error {
+	return eachEntry(p.entries, offset, data, func(i int, b []byte, off int64) error {
+		f, err := p.file(i, create)
+		if err != nil {
+			return err
+		}
+		return fn(f, b, off)
+	})
+}
+
+func (p *PiecerFS) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PiecerFS) Close() error {
+	p.io.Lock()
+	defer p.io.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for _, f := range p.files {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// allocate grows every file the torrent wants to its full length
+func (p *PiecerFS) allocate(mode Allocation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, f := range p.files {
+		if f == nil || p.entries[i].skip {
+			continue
+		}
+		if err := allocateFile(f, p.entries[i].length, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the resume file keeps track of which pieces are complete, see Piecer
+func (p *PiecerFS) MarkComplete(index int) error { return nil }
+func (p *PiecerFS) Completed() Bitfield          { return nil }
+
+// move closes the files, moves them to where to says and opens them again
+// there. Files that were never created are left that way.
+func (p *PiecerFS) move(to StorageInfo) error {
+	p.io.Lock()
+	defer p.io.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var open []int
+	var from, dest []string
+	for i, f := range p.files {
+		if f == nil {
+			continue
+		}
+		f.Close()
+		p.files[i] = nil
+		open = append(open, i)
+		from = append(from, filepath.Join(p.dir, p.entries[i].path))
+		dest = append(dest, filepath.Join(to.Dir, to.Files[i].Path))
+	}
+	err := moveFiles(p.dir, from, dest)
+	if err == nil {
+		p.dir = to.Dir
+		for i := range p.entries {
+			p.entries[i].path = to.Files[i].Path
+		}
+	}
+	// wherever they ended up, they're opened again
+	for _, i := range open {
+		f, oerr := p.open(p.entries[i], false)
+		if oerr != nil {
+			if err == nil {
+				err = oerr
+			}
+			continue
+		}
+		p.files[i] = f
+	}
+	return err
+}
+
+// paths are where the torrent's files live on disk
+func (p *PiecerFS) paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return entryPaths(p.dir, p.entries)
+}
+
+func (p *PiecerFS) calcOffset(index, begin int) int64 {
+	return int64(index)*int64(p.blockSize) + int64(begin)
+}
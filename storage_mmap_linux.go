@@ -0,0 +1,260 @@
+package torgo
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"syscall"
+)
+
+// mmapPiecer maps each of a torrent's files into memory, pieces that span
+// files are split between the maps.
+type mmapPiecer struct {
+	io          sync.RWMutex // held for reading while the maps are used, move and Close take it to unmap them
+	mu          sync.Mutex   // guards files, maps, dir and entries, skipped files are mapped on first write
+	files       []*os.File
+	maps        [][]byte
+	entries     []fileEntry
+	dir         string
+	pieceLength int
+}
+
+func openMmap(info StorageInfo) (Piecer, error) {
+	p := &mmapPiecer{
+		files:       make([]*os.File, len(info.Files)),
+		maps:        make([][]byte, len(info.Files)),
+		entries:     info.entries(),
+		dir:         info.Dir,
+		pieceLength: info.PieceLength,
+	}
+	for i, e := range p.entries {
+		if e.pad {
+			continue
+		}
+		if e.skip {
+			// skipped files are used if they're there but not created
+			if _, err := os.Stat(filepath.Join(p.dir, e.path)); os.IsNotExist(err) {
+				continue
+			}
+		}
+		if err := p.open(i); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// open creates entry i's file if it has to, grows it to its full length and
+// maps it. p has to be locked or not shared yet.
+func (p *mmapPiecer) open(i int) error {
+	e := p.entries[i]
+	path := filepath.Join(p.dir, e.path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < e.length {
+		// the file ends up sparse, space is only taken as it's written
+		err = f.Truncate(e.length)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	p.files[i] = f
+	if e.length == 0 {
+		return nil // there's nothing to map
+	}
+	m, err := syscall.Mmap(int(f.Fd()), 0, int(e.length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return &os.PathError{Op: "mmap", Path: path, Err: err}
+	}
+	p.maps[i] = m
+	return nil
+}
+
+// mapped is the map for entry i, nil for padding. A skipped file that isn't
+// there yet is created if create is set.
+func (p *mmapPiecer) mapped(i int, create bool) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := p.entries[i]
+	if p.files[i] != nil || e.pad {
+		return p.maps[i], nil
+	}
+	if !create {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(p.dir, e.path), Err: os.ErrNotExist}
+	}
+	if err := p.open(i); err != nil {
+		return nil, err
+	}
+	return p.maps[i], nil
+}
+
+func (p *mmapPiecer) offset(index, begin int) int64 {
+	return int64(index)*int64(p.pieceLength) + int64(begin)
+}
+
+func (p *mmapPiecer) Write(index int, begin int, data []byte) error {
+	p.io.RLock()
+	defer p.io.RUnlock()
+	return eachEntry(p.entries, p.offset(index, begin), data, func(i int, b []byte, off int64) error {
+		m, err := p.mapped(i, true)
+		if err != nil || m == nil {
+			return err // padding
+		}
+		return p.copyMap(i, m[off:], b, "write", syscall.ENOSPC)
+	})
+}
+
+func (p *mmapPiecer) Read(index int, begin int, data []byte) error {
+	p.io.RLock()
+	defer p.io.RUnlock()
+	return eachEntry(p.entries, p.offset(index, begin), data, func(i int, b []byte, off int64) error {
+		m, err := p.mapped(i, false)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			for j := range b {
+				b[j] = 0
+			}
+			return nil
+		}
+		return p.copyMap(i, b, m[off:], "read", syscall.EIO)
+	})
+}
+
+// copyMap copies between entry i's map and a buffer. The files are sparse, so
+// a disk that fills up doesn't fail a write, touching the page faults
+// instead. The fault is turned into errno, ENOSPC for writes so it's handled
+// like a full disk would be by the file storage.
+func (p *mmapPiecer) copyMap(i int, dst, src []byte, op string, errno syscall.Errno) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, fault := r.(interface{ Addr() uintptr }); !fault {
+			panic(r)
+		}
+		err = &os.PathError{Op: op, Path: filepath.Join(p.dir, p.entries[i].path), Err: errno}
+	}()
+	copy(dst, src)
+	return nil
+}
+
+// Sync writes the maps back, on Linux they share the page cache with the
+// files so syncing the files does it.
+func (p *mmapPiecer) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *mmapPiecer) Close() error {
+	p.io.Lock()
+	defer p.io.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unmap()
+}
+
+// unmap unmaps and closes every file, p has to be locked
+func (p *mmapPiecer) unmap() error {
+	var err error
+	for i, f := range p.files {
+		if p.maps[i] != nil {
+			if merr := syscall.Munmap(p.maps[i]); err == nil {
+				err = merr
+			}
+			p.maps[i] = nil
+		}
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		p.files[i] = nil
+	}
+	return err
+}
+
+// allocate reserves the blocks of every file the torrent wants, they're
+// already their full length from being mapped
+func (p *mmapPiecer) allocate(mode Allocation) error {
+	if mode != AllocFull {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, f := range p.files {
+		if f == nil || p.entries[i].skip {
+			continue
+		}
+		if err := allocateFile(f, p.entries[i].length, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the resume file keeps track of which pieces are complete, see Piecer
+func (p *mmapPiecer) MarkComplete(index int) error { return nil }
+func (p *mmapPiecer) Completed() Bitfield          { return nil }
+
+// move unmaps the files, moves them to where to says and maps them again
+// there. Files that were never created are left that way.
+func (p *mmapPiecer) move(to StorageInfo) error {
+	p.io.Lock()
+	defer p.io.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var open []int
+	var from, dest []string
+	for i, f := range p.files {
+		if f == nil {
+			continue
+		}
+		open = append(open, i)
+		from = append(from, filepath.Join(p.dir, p.entries[i].path))
+		dest = append(dest, filepath.Join(to.Dir, to.Files[i].Path))
+	}
+	p.unmap()
+	err := moveFiles(p.dir, from, dest)
+	if err == nil {
+		p.dir = to.Dir
+		for i := range p.entries {
+			p.entries[i].path = to.Files[i].Path
+		}
+	}
+	// wherever they ended up, they're mapped again
+	for _, i := range open {
+		if oerr := p.open(i); oerr != nil && err == nil {
+			err = oerr
+		}
+	}
+	return err
+}
+
+func (p *mmapPiecer) paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return entryPaths(p.dir, p.entries)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package torgo
+
+func openMmap(info StorageInfo) (Piecer, error) {
+	return nil, errMmapUnsupported
+}
@@ -0,0 +1,179 @@
+package torgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_StorageBackends(t *testing.T) {
+	storages := map[string]Storage{
+		"file":   FileStorage{},
+		"memory": NewMemoryStorage(),
+	}
+	if runtime.GOOS == "linux" {
+		storages["mmap"] = MmapStorage{}
+	}
+	for name, s := range storages {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "torgo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			info := StorageInfo{
+				InfoHash: [20]byte{1},
+				Dir:      dir,
+				Files: []StorageFile{
+					{Path: "x/one", Offset: 0, Length: 3},
+					{Path: "x/empty", Offset: 3, Length: 0},
+					{Path: ".pad/1", Offset: 3, Length: 1, Pad: true},
+					{Path: "x/two", Offset: 4, Length: 5},
+					{Path: "x/skipped", Offset: 9, Length: 3, Skip: true},
+				},
+				PieceCount:  3,
+				PieceLength: 4,
+			}
+			p, err := s.Open(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			if err := p.Write(0, 1, []byte("ab")); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Write(1, 0, []byte("cdefg")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 8)
+			if err := p.Read(0, 1, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ab\x00cdefg" {
+				t.Errorf("got %q; want %q", got, "ab\x00cdefg")
+			}
+			if err := p.Read(2, 3, make([]byte, 2)); err == nil {
+				t.Error("expected reading past the end to fail")
+			}
+			if err := p.MarkComplete(1); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			if name == "memory" {
+				if _, err := os.Stat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+					t.Error("memory storage wrote to disk")
+				}
+				return
+			}
+			two, _ := ioutil.ReadFile(filepath.Join(dir, "x", "two"))
+			if string(two) != "cdefg" {
+				t.Errorf("got %q on disk; want %q", two, "cdefg")
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+				t.Error("padding was stored")
+			}
+			if _, err := os.Stat(filepath.Join(dir, "x", "skipped")); !os.IsNotExist(err) {
+				t.Error("a skipped file was created")
+			}
+		})
+	}
+}
+
+func Test_MemoryStorageReopen(t *testing.T) {
+	s := NewMemoryStorage()
+	info := StorageInfo{
+		InfoHash:    [20]byte{1},
+		Files:       []StorageFile{{Path: "data", Length: 10}},
+		PieceCount:  3,
+		PieceLength: 4,
+	}
+	p, _ := s.Open(info)
+	p.Write(2, 0, []byte("xy"))
+	p.MarkComplete(2)
+	p.Close()
+
+	p, _ = s.Open(info)
+	got := make([]byte, 2)
+	if err := p.Read(2, 0, got); err != nil || string(got) != "xy" {
+		t.Errorf("got %q, %v after reopening; want %q", got, err, "xy")
+	}
+	if c := p.Completed(); !c.Has(2) || c.Count() != 1 {
+		t.Errorf("got %v complete after reopening; want just piece 2", c)
+	}
+
+	s.Delete(info.InfoHash)
+	p, _ = s.Open(info)
+	if c := p.Completed(); c.Count() != 0 {
+		t.Errorf("got %v complete after deleting the torrent", c)
+	}
+}
+
+// Touching a map past the end of its file faults the same way a full disk
+// does, the write fails instead of the process dying.
+func Test_MmapStorageFault(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap storage is only on linux")
+	}
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := StorageInfo{
+		Dir:         dir,
+		Files:       []StorageFile{{Path: "data", Length: 1 << 16}},
+		PieceCount:  4,
+		PieceLength: 1 << 14,
+	}
+	p, err := MmapStorage{}.Open(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := os.Truncate(filepath.Join(dir, "data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(3, 0, []byte("xy")); !isNoSpace(err) {
+		t.Errorf("got %v writing past the end of the file; want no space", err)
+	}
+	if err := p.Read(3, 0, make([]byte, 2)); err == nil {
+		t.Error("read past the end of the file worked")
+	}
+}
+
+// A Piecer that keeps track of complete pieces is believed over the resume file
+func Test_loadResumeTrustsStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tor := newTestTorrent(t, dir, []byte("the quick brown fox"), 8)
+	tor.WriteLog[0] = true
+	tor.WriteLog[1] = true
+	if err := tor.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	tor.close()
+
+	s := NewMemoryStorage()
+	p, _ := s.Open(newStorageInfo(&tor.ti, "", tor.layout))
+	p.MarkComplete(2)
+	p.Close()
+	fresh := openTestTorrent(t, dir, tor.ti, UseStorage(s))
+	defer fresh.close()
+	for i, want := range []bool{false, false, true} {
+		if fresh.WriteLog[i] != want {
+			t.Errorf("piece %d: got %v; want %v", i, fresh.WriteLog[i], want)
+		}
+	}
+}
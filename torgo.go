@@ -0,0 +1,1583 @@
+// Package torgo downloads and seeds torrents. A Client runs any number of
+// them in one process:
+//
+//	c, err := torgo.NewClient(ctx, torgo.ClientConfig{ListenAddr: torgo.LISTEN_ADDR}, logger)
+//	t, err := c.AddTorrentFile("debian.torrent")
+//	<-t.Complete()
+//
+// Everything a torrent is doing is stopped when the context passed to
+// NewClient is cancelled or the Client is closed.
+package torgo
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/zanadar/torgo/bencode"
+)
+
+const (
+	DL_FILE         = "./Downloads/"
+	PART_SUFFIX     = ".part"
+	RESUME_DIR      = "./.torgo/"
+	RESUME_INTERVAL = 30 * time.Second
+)
+
+type Info struct {
+	Name        string `bencode:"name"`
+	NameUTF8    string `bencode:"name.utf-8,omitempty"`
+	Pieces      string `bencode:"pieces"`
+	pieceStore  Pieces
+	Length      int64  `bencode:"length,omitempty"`
+	PieceLength int64  `bencode:"piece length"`
+	Files       []File `bencode:"files,omitempty"`
+	Private     int64  `bencode:"private,omitempty"`
+
+	// rawInfo is the info dict exactly as it was in the torrent, it's what the
+	// info hash is taken over and what should be handed on to anyone else.
+	rawInfo bencode.RawMessage
+}
+
+// RawInfo is the info dict exactly as it was in the torrent, keys Info has
+// no field for included. It's nil for an Info that wasn't parsed from one.
+func (i *Info) RawInfo() []byte {
+	return i.rawInfo
+}
+
+// File is an entry in a multi file torrent, Path is relative to Info.Name
+type File struct {
+	Length   int64    `bencode:"length"`
+	Path     []string `bencode:"path"`
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"`
+	Attr     string   `bencode:"attr,omitempty"` // BEP 47, "p" marks a padding file
+}
+
+func (f File) isPad() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// fileEntry is where a file sits in the torrent's contiguous run of bytes
+type fileEntry struct {
+	path   string
+	length int64
+	offset int64
+	pad    bool // padding is all zeros and never stored
+	skip   bool // not wanted, only created if a wanted piece spills into it
+}
+
+type Pieces struct {
+	data string
+}
+
+func (i *Pieces) String() [][]byte {
+	pieces := []byte(i.data)
+	var hashes [][]byte
+	var hash []byte
+
+	for i := 0; i < len(pieces); i += 20 {
+		hash = pieces[i : i+20]
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
+
+// totalLength is the size of all the torrent's data, single or multi file
+func (ti *TorrentInfo) totalLength() int64 {
+	if len(ti.Files) == 0 {
+		return ti.Length
+	}
+	var length int64
+	for _, f := range ti.Files {
+		length += f.Length
+	}
+	return length
+}
+
+// fileLayout is where the torrent's files go, whatever the torrent says its
+// files are called they're kept to separate paths under the download
+// directory.
+func (ti *TorrentInfo) fileLayout() []fileEntry {
+	name := ti.Name
+	if ti.NameUTF8 != "" {
+		name = ti.NameUTF8
+	}
+	if len(ti.Files) == 0 {
+		return []fileEntry{{path: safePath(name), length: ti.Length}}
+	}
+	entries := make([]fileEntry, 0, len(ti.Files))
+	var offset int64
+	for _, f := range ti.Files {
+		path := f.Path
+		if len(f.PathUTF8) > 0 {
+			path = f.PathUTF8
+		}
+		entries = append(entries, fileEntry{
+			path:   safePath(append([]string{name}, path...)...),
+			length: f.Length,
+			offset: offset,
+			pad:    f.isPad(),
+		})
+		offset += f.Length
+	}
+	safeLayout(entries)
+	return entries
+}
+
+var (
+	errPieceLength = errors.New("piece length isn't positive")
+	errPieceHashes = errors.New("pieces isn't a whole number of hashes")
+	errPieceCount  = errors.New("number of pieces doesn't match the torrent's length")
+	errFileLength  = errors.New("file length is negative")
+)
+
+// checkPieces makes sure the pieces cover the torrent's data exactly, working
+// out where anything is depends on it.
+func (ti *TorrentInfo) checkPieces() error {
+	if ti.PieceLength <= 0 {
+		return errPieceLength
+	}
+	if len(ti.Pieces)%20 != 0 {
+		return errPieceHashes
+	}
+	if ti.Length < 0 {
+		return errFileLength
+	}
+	for _, f := range ti.Files {
+		if f.Length < 0 {
+			return errFileLength
+		}
+	}
+	length := ti.totalLength()
+	want := length / ti.PieceLength
+	if length%ti.PieceLength != 0 {
+		want++
+	}
+	if length < 0 || int64(ti.pieceCount()) != want {
+		return errPieceCount
+	}
+	return nil
+}
+
+func (ti *TorrentInfo) pieceCount() int {
+	return len(ti.Pieces) / 20
+}
+
+// pieceLen is the length of the piece at index, the last piece is usually short
+func (ti *TorrentInfo) pieceLen(index int) int64 {
+	if index == ti.pieceCount()-1 {
+		if rem := ti.totalLength() % ti.PieceLength; rem != 0 {
+			return rem
+		}
+	}
+	return ti.PieceLength
+}
+
+func (ti *TorrentInfo) pieceHash(index int) []byte {
+	return []byte(ti.Pieces[index*20 : index*20+20])
+}
+
+type TrackerResponse struct {
+	PeerList       []ConnPeer `bencode:"-"`
+	FailureReason  string     `bencode:"failure reason"`
+	WarningMessage string     `bencode:"warning message"`
+	Interval       int        `bencode:"interval"`
+	MinInternal    int        `bencode:"min interval"`
+	TrackerID      string     `bencode:"tracker id"`
+	Complete       int        `bencode:"complete"`
+	incomplete     int
+	Peers          bencode.RawMessage `bencode:"peers"` // compact, or a list of dictionaries with peer ids
+}
+
+// trackerLimits keep a misbehaving tracker from making us buffer too much
+var trackerLimits = bencode.Limits{
+	MaxSize:         1 << 20,
+	MaxStringLength: 1 << 20,
+	MaxDepth:        8,
+}
+
+// callTracker announces to the tracker at announce, event is "started",
+// "stopped" or "" for a regular announce. wantIDs asks for the long form of the
+// peer list that has their peer ids in.
+func (ti *TorrentInfo) callTracker(ctx context.Context, client *http.Client, announce, event string, wantIDs bool, logger log.Logger) (*TrackerResponse, error) {
+	url, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Query()
+	q.Add("info_hash", string(ti.InfoHash[:]))
+	q.Add("peer_id", string(ti.PeerId[:]))
+	q.Add("left", strconv.Itoa(int(ti.totalLength())))
+	if event != "" {
+		q.Add("event", event)
+	}
+	if wantIDs {
+		q.Add("compact", "0")
+	}
+	url.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	trackerResp := &TrackerResponse{}
+	dec := bencode.NewDecoder(resp.Body)
+	dec.SetLimits(trackerLimits)
+	if err := dec.Decode(trackerResp); err != nil {
+		return nil, err
+	}
+	level.Debug(ti.logger).Log("response", spew.Sdump(trackerResp))
+
+	peers, err := parsePeers(trackerResp.Peers, logger)
+	if err != nil {
+		return nil, err
+	}
+	trackerResp.PeerList = peers
+	level.Debug(ti.logger).Log("peers", spew.Sdump(peers))
+
+	return trackerResp, nil
+}
+
+// trackerPeer is a peer in the long form of a tracker's peer list
+type trackerPeer struct {
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+	PeerID string `bencode:"peer id"`
+}
+
+// parsePeers reads a tracker's peer list in either of its forms, peers from
+// the long form remember the id the tracker gave for them.
+func parsePeers(raw bencode.RawMessage, logger log.Logger) ([]ConnPeer, error) {
+	if len(raw) == 0 {
+		return []ConnPeer{}, nil
+	}
+	if raw[0] != 'l' {
+		var compact string
+		if err := bencode.Unmarshal(raw, &compact); err != nil {
+			return nil, err
+		}
+		return parseCompactPeers(compact, logger), nil
+	}
+	var list []trackerPeer
+	if err := bencode.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	peers := []ConnPeer{}
+	for _, tp := range list {
+		if tp.IP == "" || tp.Port <= 0 || tp.Port > 65535 {
+			continue
+		}
+		p := newPeer(tp.IP, tp.Port, log.With(logger, "Peer", tp.IP))
+		if len(tp.PeerID) == 20 {
+			p.advertisedID = tp.PeerID
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// parseCompactPeers reads the 6 byte ip:port form that trackers send back
+func parseCompactPeers(compact string, logger log.Logger) []ConnPeer {
+	peers := []ConnPeer{}
+	var ip []interface{}
+	for i := 0; i+6 <= len(compact); i += 6 {
+		peerBytes := []byte(compact[i : i+6])
+		{
+			ip = []interface{}{
+				peerBytes[0],
+				peerBytes[1],
+				peerBytes[2],
+				peerBytes[3],
+			}
+			ipString := fmt.Sprintf("%d.%d.%d.%d", ip...)
+			port := int(peerBytes[4])*256 + int(peerBytes[5])
+			peers = append(peers, newPeer(ipString, port, log.With(logger, "Peer", ipString)))
+		}
+	}
+	return peers
+}
+
+// ReadTorrentFile reads and parses a .torrent file
+func ReadTorrentFile(path string) (*TorrentInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTorrent(f)
+}
+
+// ParseTorrent reads a torrent's metainfo from r
+func ParseTorrent(r io.Reader) (*TorrentInfo, error) {
+	return parseTorrent(r, log.NewNopLogger())
+}
+
+func parseTorrent(torrentF io.Reader, logger log.Logger) (*TorrentInfo, error) {
+	data, err := ioutil.ReadAll(torrentF)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash the info dict exactly as it is in the file. Decoding it and encoding
+	// it again only gives the same bytes if the torrent was canonical to begin with.
+	var raw struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if len(raw.Info) == 0 || raw.Info[0] != 'd' {
+		return nil, errors.New("info isn't a dictionary")
+	}
+	infoHash := sha1.Sum(raw.Info)
+	// This is correct per: https://allenkim67.github.io/programming/2016/05/04/how-to-make-your-own-bittorrent-client.html#info-hash
+	// <Buffer 11 7e 3a 66 65 e8 ff 1b 15 7e 5e c3 78 23 57 8a db 8a 71 2b>
+
+	torrentInfo := &TorrentInfo{
+		logger: logger,
+	}
+	id := [20]byte{} // This is important!  The ID must be 20 bytes long
+	copy(id[:], "boblog123")
+	torrentInfo.PeerId = id[:]
+	if err := bencode.Unmarshal(data, torrentInfo); err != nil {
+		return nil, err
+	}
+	if err := torrentInfo.checkPieces(); err != nil {
+		return nil, err
+	}
+	torrentInfo.InfoHash = infoHash[:] // copy the hash into a full slice of the array
+	torrentInfo.pieceStore.data = torrentInfo.Pieces
+	torrentInfo.rawInfo = raw.Info
+
+	return torrentInfo, nil
+}
+
+type TorrentInfo struct {
+	Announce string `bencode:"announce"`
+	Encoding string `bencode:"encoding"`
+	Info     `bencode:"info"`
+	InfoHash []byte `bencode:"-"`
+	PeerId   []byte `bencode:"-"` // Our id that we send to the clients
+	logger   log.Logger
+}
+
+type Torrent struct {
+	ti TorrentInfo
+	TrackerResponse
+	Handshake
+	msgs         chan message
+	PeerPieceLog PieceLog
+	WriteLog     []bool
+	Piecer       Piecer
+	storage      Storage      // opens Piecer
+	cache        *blockCache  // in front of Piecer, nil if the cache is off
+	err          error        // why the torrent was paused, if it wasn't asked to
+	moveTo       *StorageInfo // where the files go once the torrent is complete
+	sync.Mutex
+	peerConns  map[string]ConnPeer
+	logger     log.Logger
+	resumePath string
+	downloaded int64
+	uploaded   int64
+
+	client    *Client
+	ctx       context.Context
+	cancel    context.CancelFunc // nil unless the torrent is running
+	done      chan struct{}      // closed once run returns
+	complete  chan struct{}      // closed once every piece is verified
+	completed bool
+	events    chan posted
+	loopDone  chan struct{} // closed once the loop returns, unlike done stop leaves it set
+
+	readers   map[*Reader]readRange
+	pieceDone chan struct{} // closed and replaced each time a piece is verified
+	wake      chan struct{} // tells the loop priorities have changed
+
+	sequential bool
+	deadlines  map[int]time.Time
+	peerRates  map[string]*peerRate
+
+	requests map[block]map[string]time.Time // peers we've asked for each block, and when
+	partial  map[int][]bool                 // blocks we have of unverified pieces
+	activity map[string]*peerActivity
+
+	dials      map[string]*dialState // by address
+	connecting int                   // dials in progress
+	announced  map[string]bool       // trackers that know we're here, told when we stop
+
+	layout          []fileEntry
+	filePriorities  []FilePriority // by layout entry
+	piecePriorities []FilePriority // the highest of the files each piece is in
+
+	down     *limiter
+	up       *limiter
+	peerDown int64 // each peer's limits
+	peerUp   int64
+	traffic  *traffic
+}
+
+func newTorrent(ti TorrentInfo, c *Client, logger log.Logger, opts ...AddOption) (*Torrent, error) {
+	// not every TorrentInfo comes from parseTorrent
+	if err := ti.checkPieces(); err != nil {
+		return nil, err
+	}
+	h := Handshake{}
+	h.InfoHash = [20]byte{}
+	h.PeerId = [20]byte{}
+	copy(h.InfoHash[:], ti.InfoHash)
+	copy(h.PeerId[:], ti.PeerId)
+
+	level.Debug(logger).Log("handshake", ti.InfoHash)
+
+	pieceCount := ti.pieceCount()
+	torrent := &Torrent{
+		Handshake:    h,
+		ti:           ti,
+		msgs:         make(chan message),
+		peerConns:    make(map[string]ConnPeer),
+		PeerPieceLog: newPieceLog(pieceCount),
+		WriteLog:     make([]bool, pieceCount),
+		logger:       logger,
+		resumePath:   filepath.Join(c.config.ResumeDir, fmt.Sprintf("%x.resume", ti.InfoHash)),
+		client:       c,
+		complete:     make(chan struct{}),
+		events:       make(chan posted),
+		readers:      make(map[*Reader]readRange),
+		pieceDone:    make(chan struct{}),
+		wake:         make(chan struct{}, 1),
+		deadlines:    make(map[int]time.Time),
+		peerRates:    make(map[string]*peerRate),
+		requests:     make(map[block]map[string]time.Time),
+		partial:      make(map[int][]bool),
+		activity:     make(map[string]*peerActivity),
+		dials:        make(map[string]*dialState),
+		announced:    make(map[string]bool),
+		layout:       ti.fileLayout(),
+		down:         newLimiter(0),
+		up:           newLimiter(0),
+		peerDown:     c.config.PeerDownloadLimit,
+		peerUp:       c.config.PeerUploadLimit,
+		traffic:      &traffic{},
+		storage:      c.config.Storage,
+	}
+	if torrent.storage == nil {
+		torrent.storage = FileStorage{}
+	}
+	torrent.filePriorities = make([]FilePriority, len(torrent.layout))
+	for i := range torrent.filePriorities {
+		torrent.filePriorities[i] = FileNormal
+	}
+	for _, opt := range opts {
+		if err := opt(torrent); err != nil {
+			return nil, err
+		}
+	}
+	torrent.updatePiecePriorities()
+
+	entries := make([]fileEntry, len(torrent.layout))
+	for i, e := range torrent.layout {
+		e.skip = torrent.filePriorities[i] == FileSkip
+		entries[i] = e
+	}
+	info := newStorageInfo(&ti, c.config.DownloadDir, entries)
+	if onDisk(torrent.storage) {
+		info, torrent.moveTo = c.config.locate(info)
+	}
+	if onDisk(torrent.storage) {
+		if need, free, ok := spaceNeeded(info); ok && need > free {
+			if c.config.RefuseLowSpace {
+				level.Error(logger).Log("need", need, "free", free, "err", ErrNotEnoughSpace)
+				return nil, ErrNotEnoughSpace
+			}
+			level.Warn(logger).Log("need", need, "free", free, "msg", "torrent won't fit on disk")
+		}
+	}
+	piecer, err := torrent.storage.Open(info)
+	if err != nil {
+		return nil, err
+	}
+	torrent.Piecer = piecer
+	// there's no point caching what's already in memory
+	if _, inMemory := piecer.(*memPiecer); !inMemory && c.config.CacheSize > 0 {
+		torrent.cache = newBlockCache(piecer, info, c.config.CacheSize, c.config.DiskWorkers, torrent.diskFailed)
+		torrent.Piecer = torrent.cache
+	}
+
+	if err := torrent.loadResume(); err != nil {
+		level.Error(logger).Log("resume", err)
+	}
+	// only once the resume data has been checked, fresh files would look
+	// like they had something in them
+	if a, ok := torrent.Piecer.(allocator); ok {
+		if err := a.allocate(c.config.Allocation); err != nil {
+			torrent.Piecer.Close()
+			return nil, err
+		}
+	}
+	// nothing else has the torrent yet, so there's no loop to wait on
+	if torrent.allWritten() {
+		torrent.completed = true
+		torrent.finishComplete(torrent.finish(torrent.moveTo))
+	}
+
+	return torrent, nil
+}
+
+// start runs the torrent in the background, it does nothing if it's already
+// running.
+func (t *Torrent) start() {
+	ctx, done, err := t.begin(t.client.ctx)
+	if err != nil {
+		return
+	}
+	t.retryWrites()
+	go t.loop(ctx, done)
+}
+
+// Run is the torrent's event loop. It owns the torrent's state while it
+// runs: peers hand it what they've sent as events and it does everything
+// else itself. It returns once ctx is done, after hanging up on every peer,
+// with any error saving the resume data.
+func (t *Torrent) Run(ctx context.Context) error {
+	ctx, done, err := t.begin(ctx)
+	if err != nil {
+		return err
+	}
+	return t.loop(ctx, done)
+}
+
+// begin marks the torrent as running under ctx
+func (t *Torrent) begin(ctx context.Context) (context.Context, chan struct{}, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.cancel != nil {
+		return nil, nil, errTorrentRunning
+	}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	t.done = make(chan struct{})
+	t.loopDone = t.done
+	t.err = nil
+	return t.ctx, t.done, nil
+}
+
+// loop runs the torrent until ctx is done, then marks it as stopped
+func (t *Torrent) loop(ctx context.Context, done chan struct{}) error {
+	defer close(done)
+	err := t.run(ctx)
+	t.Lock()
+	if t.done == done {
+		// it was ctx rather than stop that ended it
+		t.cancel()
+		t.cancel, t.done = nil, nil
+	}
+	t.Unlock()
+	return err
+}
+
+// stop disconnects every peer and saves the resume data, it waits for the
+// torrent's loop to finish.
+func (t *Torrent) stop() {
+	t.Lock()
+	cancel, done := t.cancel, t.done
+	t.cancel, t.done = nil, nil
+	t.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// finish makes sure a complete torrent's data is in storage rather than just
+// the cache, then moves its files from where they're kept while it downloads
+// to to, if to is set. written is why the data couldn't be written out, the
+// files aren't moved then. It can take as long as copying the whole torrent,
+// so t mustn't be locked.
+func (t *Torrent) finish(to *StorageInfo) (written, err error) {
+	if t.cache != nil {
+		if err := t.cache.flush(); err != nil {
+			return err, nil
+		}
+	}
+	if to == nil {
+		return nil, nil
+	}
+	if m, ok := t.Piecer.(mover); ok {
+		return nil, m.move(*to)
+	}
+	return nil, nil
+}
+
+// finishComplete closes complete once finish is done, t has to be locked. If
+// the data couldn't be written out it isn't complete after all, it's checked
+// again once the cache has had another go. If the move failed the files are
+// left where they are and it's tried again the next time the torrent is added.
+func (t *Torrent) finishComplete(written, err error) {
+	if written != nil {
+		level.Error(t.logger).Log("msg", "writing out the last pieces", "err", written)
+		t.completed = false
+		return
+	}
+	if t.moveTo != nil {
+		if err != nil {
+			level.Error(t.logger).Log("msg", "moving complete files", "dir", t.moveTo.Dir, "err", err)
+		} else {
+			level.Info(t.logger).Log("msg", "moved complete files", "dir", t.moveTo.Dir)
+			t.moveTo = nil
+		}
+	}
+	close(t.complete)
+	level.Info(t.logger).Log("msg", "complete")
+}
+
+// retryWrites has another go at writing out pieces the cache couldn't, the
+// torrent may have been paused for a full disk that's had room made on it.
+func (t *Torrent) retryWrites() {
+	if t.cache == nil {
+		return
+	}
+	t.cache.retry()
+	t.Lock()
+	t.checkComplete()
+	t.Unlock()
+}
+
+// diskFailed pauses the torrent if storage has run out of space, there's no
+// point downloading what can't be written. It stays paused with the error
+// until it's resumed.
+func (t *Torrent) diskFailed(err error) {
+	t.post(diskFailure{err})
+}
+
+// handleDiskFailed is diskFailed on the loop
+func (t *Torrent) handleDiskFailed(err error) {
+	if !isNoSpace(err) {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.cancel == nil || t.err != nil {
+		return
+	}
+	t.err = err
+	level.Error(t.logger).Log("msg", "out of disk space, pausing", "err", err)
+	t.cancel()
+}
+
+// running is true between start and stop, t has to be locked
+func (t *Torrent) running() bool {
+	return t.cancel != nil && t.ctx.Err() == nil
+}
+
+// close lets go of the torrent's storage, it has to be stopped first
+func (t *Torrent) close() error {
+	return t.Piecer.Close()
+}
+
+func (t *Torrent) run(ctx context.Context) error {
+	t.announce(ctx)
+	t.connectPeers(ctx)
+
+	resumeTicker := time.NewTicker(RESUME_INTERVAL)
+	defer resumeTicker.Stop()
+	pickTicker := time.NewTicker(PICK_INTERVAL)
+	defer pickTicker.Stop()
+	connectTicker := time.NewTicker(CONNECT_INTERVAL)
+	defer connectTicker.Stop()
+	for {
+		select {
+		case <-resumeTicker.C:
+			if err := t.saveResume(); err != nil {
+				level.Error(t.logger).Log("resume", err)
+				break
+			}
+			// the last pieces may have only just been written out
+			t.Lock()
+			t.checkComplete()
+			t.Unlock()
+		case <-t.wake:
+			t.sendRequest(message{})
+		case <-pickTicker.C:
+			t.sendRequest(message{})
+		case <-connectTicker.C:
+			t.connectPeers(ctx)
+		case p := <-t.events:
+			p.err <- t.handleEvent(p.ev)
+		case msg := <-t.msgs:
+			if !t.connected(msg.source) {
+				// it's been dropped since it sent this
+				continue
+			}
+			switch msg.Kind() {
+			case BITFLD:
+				t.handleBitfield(msg)
+				t.sendInterest(msg)
+			case HAVE:
+				t.handleHave(msg)
+				t.sendInterest(msg)
+			case CHOKE:
+				t.handleChoke(msg)
+			case UNCHOKE:
+				t.handleUnchoke(msg)
+				t.sendRequest(msg)
+			case PIECE:
+				t.handlePiece(msg)
+			default:
+				level.Debug(t.logger).Log("msg", msg)
+			}
+		case <-ctx.Done():
+			return t.shutdown()
+		}
+	}
+	//TODO at this point, we can take the message from the peers and start to do things with them.
+	// use IOTA to give them meaningful names, and then change the state of the torrent based on some kind of logic?
+	/* we're getting BITFLD and HAVE messages from peers, so we need to track their state:
+		        This starts as: i
+		        {
+		          INTERST: 0
+		          CHOKE: 1
+		        }
+
+			   1. Choked
+			   2. which pieces they have
+			   3. which pieces they want
+
+		           Then we send them an INTERST message and receive an UNCHOKE
+	                   If we receive and INTERST msg we can respond with a UNCHOKE to indicate we will serve files
+	                   After a peer is UNCHOKEd we can send requests
+
+	*/
+}
+
+// announce tells the tracker we've started and asks it for peers, anything
+// we already knew about from the resume data is kept.
+func (t *Torrent) announce(ctx context.Context) {
+	resp, err := t.ti.callTracker(ctx, t.client.tracker, t.ti.Announce, "started", t.client.config.CheckPeerIDs, t.logger)
+	if err != nil {
+		level.Error(t.logger).Log("tracker", t.ti.Announce, "err", err)
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.announced[t.ti.Announce] = true
+	known := t.PeerList
+	t.TrackerResponse = *resp
+	t.PeerList = mergePeers(resp.PeerList, known)
+}
+
+// addPeer hands a connected peer to the torrent, it's refused if the torrent
+// isn't running. When we're already talking to that peer only one of the two
+// connections is kept, see keepNewer. If the torrent is out of connections the
+// peer with the lowest BEP 40 priority goes, which may be p.
+func (t *Torrent) addPeer(p ConnPeer) error {
+	return t.post(peerAdded{p})
+}
+
+// handleAddPeer is addPeer on the loop
+func (t *Torrent) handleAddPeer(p ConnPeer) error {
+	ours := t.client.ourAddr()
+	t.Lock()
+	defer t.Unlock()
+	if !t.running() {
+		return errTorrentNotReady
+	}
+	if old, ok := t.peerConns[p.ID()]; ok {
+		if !t.keepNewer(old, p) {
+			return errDuplicatePeer
+		}
+		// the same peer, so what it has stays in the piece log
+		delete(t.peerConns, old.ID())
+		delete(t.activity, old.ID())
+		t.releaseRequests(old.ID())
+		t.peerConns[p.ID()] = p
+		if old, ok := old.(*Peer); ok {
+			go func() {
+				old.Close()
+				t.client.releaseConn()
+			}()
+		}
+		if p, ok := p.(*Peer); ok {
+			go t.watchPeer(p)
+		}
+		level.Debug(t.logger).Log("duplicate", p, "replaced", old)
+		return nil
+	}
+	if len(t.peerConns) >= t.client.config.MaxConnsPerTorrent {
+		var victim ConnPeer
+		for _, other := range t.peerConns {
+			if victim == nil || peerPriority(ours, other) < peerPriority(ours, victim) {
+				victim = other
+			}
+		}
+		if victim == nil || peerPriority(ours, p) <= peerPriority(ours, victim) {
+			return errTooManyConns
+		}
+		t.removePeer(victim.ID())
+		if victim, ok := victim.(*Peer); ok {
+			go func() {
+				victim.Close()
+				t.client.releaseConn()
+			}()
+		}
+		level.Debug(t.logger).Log("replaced", victim, "with", p)
+	}
+	t.peerConns[p.ID()] = p
+	if p, ok := p.(*Peer); ok {
+		go t.watchPeer(p)
+	}
+	return nil
+}
+
+// keepNewer decides between two connections to the same peer. Both ends have
+// to keep the same one, so it's the one made by whichever of us has the lower
+// peer id. When both were made the same way the one we have already stays.
+func (t *Torrent) keepNewer(old, newer ConnPeer) bool {
+	return t.initiator(newer) < t.initiator(old)
+}
+
+// initiator is the peer id of whoever opened the connection to p
+func (t *Torrent) initiator(p ConnPeer) string {
+	if p, ok := p.(*Peer); ok && p.outgoing {
+		return string(t.PeerId[:])
+	}
+	return p.ID()
+}
+
+// acceptPeer takes a connection a peer made to us, hs is the handshake they
+// opened with.
+func (t *Torrent) acceptPeer(conn net.Conn, hs *Handshake) error {
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	portNum, _ := strconv.Atoi(port)
+	p := newPeer(host, portNum, log.With(t.logger, "Peer", host))
+	t.Lock()
+	ctx := t.ctx
+	t.Unlock()
+	if ctx == nil {
+		return errTorrentNotReady
+	}
+	t.limitPeer(ctx, p)
+	p.pieces = t.ti.pieceCount()
+	if err := p.accept(conn, t.Handshake, hs); err != nil {
+		return err
+	}
+	if err := t.addPeer(p); err != nil {
+		p.conn.Close() // its loops never started
+		return err
+	}
+	// it's only read from once it's a peer of the torrent, or the loop would
+	// throw away its bitfield
+	p.run(t.msgs)
+	return nil
+}
+
+func (t *Torrent) writeLoop() {
+	// send shit to clients
+}
+
+func (t *Torrent) handleBitfield(msg message) {
+	t.PeerPieceLog.LogField(msg.source, msg.WireMessage.(Bitfield))
+}
+
+func (t *Torrent) handleHave(msg message) {
+	t.PeerPieceLog.LogSingle(msg.source, msg.WireMessage.(Have).Index)
+}
+
+// connected is true if id is one of the torrent's peers
+func (t *Torrent) connected(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.peerConns[id]
+	return ok
+}
+
+func (t *Torrent) handleUnchoke(msg message) {
+	t.unchoke(msg.source)
+}
+
+// handleChoke gives back everything we'd asked the peer for, it won't be
+// sending it now.
+func (t *Torrent) handleChoke(msg message) {
+	t.Lock()
+	defer t.Unlock()
+	p, ok := t.peerConns[msg.source]
+	if !ok {
+		return
+	}
+	p.PeerChoking(true)
+	t.releaseRequests(msg.source)
+	a := t.activityOf(msg.source)
+	a.unchoked, a.waiting = time.Time{}, time.Time{}
+	level.Debug(t.logger).Log("peerChoke", p.ID())
+}
+
+func (t *Torrent) handlePiece(msg message) {
+	piece := msg.WireMessage.(Piece)
+	index, offset, data := piece.Index, piece.Begin, piece.Block
+	b := block{index: index, begin: offset, length: len(data)}
+
+	t.Lock()
+	t.downloaded += int64(len(data))
+	t.received(msg.source, len(data), time.Now())
+	others, ok := t.blockReceived(b, msg.source)
+	t.Unlock()
+	if !ok {
+		// another peer beat this one to it in end-game, or we never asked
+		level.Debug(t.logger).Log("piece", index, "offset", offset, "from", msg.source, "dropped", "unwanted block")
+		return
+	}
+	// anyone else we asked for the block can stop sending it
+	for _, p := range others {
+		p.Message(cancelFor(b))
+	}
+
+	err := t.Piecer.Write(index, offset, data)
+	if err != nil {
+		level.Error(t.logger).Log("piece", index, "offset", offset, "err", err)
+		t.Lock()
+		delete(t.partial, index)
+		t.Unlock()
+		t.handleDiskFailed(err)
+		return
+	}
+	// only check the hash once every block of the piece has come in
+	t.Lock()
+	done := t.pieceReceived(index)
+	t.Unlock()
+	if !done {
+		return
+	}
+	verified := t.verifyPiece(index)
+	if verified {
+		if err := t.Piecer.MarkComplete(index); err != nil {
+			level.Error(t.logger).Log("piece", index, "err", err)
+		}
+	}
+	t.Lock()
+	delete(t.partial, index)
+	if verified {
+		t.WriteLog[index] = true
+		delete(t.deadlines, index)
+		close(t.pieceDone)
+		t.pieceDone = make(chan struct{})
+		t.checkComplete()
+	}
+	t.Unlock()
+	if verified {
+		level.Debug(t.logger).Log("piece", index, "msg", "verified")
+	} else {
+		level.Error(t.logger).Log("piece", index, "err", "hash mismatch")
+		if t.cache != nil {
+			t.cache.discard(index)
+		}
+	}
+}
+
+// verifyPiece reads the piece back out of storage and checks it against its hash
+func (t *Torrent) verifyPiece(index int) bool {
+	return checkPiece(&t.ti, t.Piecer, index, nil)
+}
+
+func (t *Torrent) unchoke(id string) {
+	t.Lock()
+	defer t.Unlock()
+	p, ok := t.peerConns[id]
+	if !ok {
+		return
+	}
+	p.PeerChoking(false)
+	if a := t.activityOf(id); a.unchoked.IsZero() {
+		a.unchoked = time.Now()
+	}
+	level.Debug(t.logger).Log("peerUnchoke", p.state())
+}
+
+// shutdown winds the torrent down once its context is done, nothing new is
+// taken on by then. Peers are told we don't want what we asked for and hung
+// up on, the data is synced to disk before the resume data's written, and
+// trackers are told we've gone. Problems saving the resume data are returned.
+func (t *Torrent) shutdown() error {
+	t.handleShutdown()
+	err := t.saveResume()
+	if err != nil {
+		level.Error(t.logger).Log("resume", err)
+	}
+	t.announceStopped()
+	return err
+}
+
+// announceStopped tells the trackers we announced to that we've stopped, not
+// waiting more than TRACKER_STOP_TIMEOUT for them.
+func (t *Torrent) announceStopped() {
+	t.Lock()
+	var trackers []string
+	for tracker := range t.announced {
+		trackers = append(trackers, tracker)
+	}
+	t.announced = make(map[string]bool)
+	t.Unlock()
+
+	// the torrent's context is done, this has a little time of its own
+	ctx, cancel := context.WithTimeout(context.Background(), TRACKER_STOP_TIMEOUT)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, tracker := range trackers {
+		wg.Add(1)
+		go func(tracker string) {
+			defer wg.Done()
+			if _, err := t.ti.callTracker(ctx, t.client.tracker, tracker, "stopped", false, t.logger); err != nil {
+				level.Error(t.logger).Log("tracker", tracker, "event", "stopped", "err", err)
+			}
+		}(tracker)
+	}
+	wg.Wait()
+}
+
+// handleShutdown cancels everything we've asked peers for and hangs up on
+// them, a peer that's stalled is cut off after CLOSE_TIMEOUT.
+func (t *Torrent) handleShutdown() {
+	t.Lock()
+	for b, asked := range t.requests {
+		for id := range asked {
+			if p, ok := t.peerConns[id]; ok {
+				p.Message(cancelFor(b))
+			}
+		}
+	}
+	peers := t.peerConns
+	t.peerConns = make(map[string]ConnPeer)
+	t.requests = make(map[block]map[string]time.Time)
+	t.activity = make(map[string]*peerActivity)
+	t.Unlock()
+
+	var wg sync.WaitGroup
+	shutdown := func(p *Peer) {
+		p.Close()
+		t.client.releaseConn()
+		wg.Done()
+	}
+	for _, peer := range peers {
+		if p, ok := peer.(*Peer); ok {
+			wg.Add(1)
+			go shutdown(p)
+		}
+	}
+	wg.Wait()
+}
+
+func (t *Torrent) sendInterest(msg message) {
+	t.Lock()
+	defer t.Unlock()
+	p, ok := t.peerConns[msg.source]
+	if !ok {
+		return
+	}
+	p.AmInterested(true)
+	p.Message(Interested{})
+	level.Debug(t.logger).Log("interest", p.state())
+}
+
+// sendRequest asks peers for the blocks we want next. Each block normally
+// goes to one peer, urgent ones to up to MAX_URGENT_REQUESTS and, in
+// end-game, to every peer that has them. Requests that have timed out are
+// given back first, and no peer gets more than its queue limit at once.
+func (t *Torrent) sendRequest(msg message) {
+	type request struct {
+		p   ConnPeer
+		msg WireMessage
+	}
+	var requests []request
+
+	now := time.Now()
+	t.Lock()
+	level.Debug(t.logger).Log("request", msg.source)
+	expired, blocks := t.expireRequests(now)
+	for i, p := range expired {
+		b := blocks[i]
+		requests = append(requests, request{
+			p:   p,
+			msg: cancelFor(b),
+		})
+	}
+	queued := t.queued()
+	order := t.pickOrder() // pieces we haven't written, most wanted first
+	endGame := t.endGame(order)
+	// the disk isn't keeping up, anything more would only pile up in memory
+	if t.cache != nil && t.cache.backlogged() {
+		order = nil
+	}
+	for _, i := range order {
+		// the peers that have it and aren't choking us, fastest first
+		var holders []string
+		for pID := range t.PeerPieceLog.At(i) {
+			if p := t.peerConns[pID]; p != nil && !p.GetPeerChoking() && !p.backlogged() {
+				holders = append(holders, pID)
+			}
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		t.fastestPeers(holders, now)
+
+		limit := 1
+		if t.urgent(i, now) {
+			limit = MAX_URGENT_REQUESTS
+		}
+		for _, b := range t.missingBlocks(i) {
+			asked := t.requests[b]
+			if !endGame && len(asked) >= limit {
+				continue
+			}
+			// one more peer each time round, or every peer in end-game
+			for _, pID := range holders {
+				if _, ok := asked[pID]; ok || queued[pID] >= t.queueLimit(pID) {
+					continue
+				}
+				t.requested(b, pID, now)
+				queued[pID]++
+				requests = append(requests, request{
+					p:   t.peerConns[pID],
+					msg: requestFor(b),
+				})
+				if !endGame {
+					break
+				}
+			}
+		}
+	}
+	t.Unlock()
+
+	for _, r := range requests {
+		r.p.Message(r.msg)
+	}
+}
+
+type PieceLog struct {
+	sync.RWMutex
+	vector []map[string]struct{}
+}
+
+func newPieceLog(length int) PieceLog {
+	vec := make([]map[string]struct{}, length)
+	for i := range vec {
+		vec[i] = make(map[string]struct{})
+	}
+	return PieceLog{vector: vec}
+}
+
+// LogField records the pieces in a peer's bitfield, bits past the last piece
+// are ignored.
+func (p *PieceLog) LogField(id string, pieces []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	field := Bitfield(pieces)
+	for i := range p.vector {
+		if field.Has(i) {
+			p.vector[i][id] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (p *PieceLog) LogSingle(id string, piece int) {
+	p.Lock()
+	defer p.Unlock()
+	if piece < 0 || piece >= len(p.vector) {
+		return
+	}
+	p.vector[piece][id] = struct{}{}
+}
+
+func (p *PieceLog) String() (filled string) {
+	var has int
+	for _, piece := range p.Logged() {
+		if piece {
+			has = 1
+		} else {
+			has = 0
+		}
+		filled = fmt.Sprintf("%s%b", filled, has)
+	}
+
+	return filled
+}
+
+func (p *PieceLog) Logged() []bool {
+	p.RLock()
+	defer p.RUnlock()
+	have := make([]bool, len(p.vector))
+	for i, piece := range p.vector {
+		if len(piece) > 0 {
+			have[i] = true
+		}
+	}
+
+	return have
+}
+
+// Forget drops a peer from every piece
+func (p *PieceLog) Forget(id string) {
+	p.Lock()
+	defer p.Unlock()
+	for _, peers := range p.vector {
+		delete(peers, id)
+	}
+}
+
+// We need to start making these access synced
+func (p *PieceLog) At(index int) map[string]struct{} {
+	p.RLock()
+	defer p.RUnlock()
+	return p.vector[index]
+}
+
+type ConnPeer interface {
+	Message(WireMessage)
+	Connect(Handshake) error
+	ParseMsgs(chan message)
+	AmChoking(bool)
+	GetAmChoking() bool
+	AmInterested(bool)
+	GetAmInterested() bool
+	PeerChoking(bool)
+	GetPeerChoking() bool
+	PeerInterested(bool)
+	GetPeerInterested() bool
+	backlogged() bool
+	state() string
+	ID() string
+	String() string
+}
+
+type Peer struct {
+	id              string
+	IP              string
+	Port            int
+	rw              *bufio.ReadWriter
+	conn            net.Conn
+	mu              sync.Mutex // guards the four flags below
+	am_choking      bool
+	peer_choking    bool
+	peer_interested bool
+	am_interested   bool
+	shutdown        chan struct{}
+	messages        chan WireMessage // waiting to be sent, MAX_OUTBOX at most
+	dead            chan struct{}    // closed once we can't read from the peer
+	logger          log.Logger
+	outgoing        bool   // we dialed it rather than it dialing us
+	advertisedID    string // the peer id the tracker gave, if any
+	pieces          int    // the torrent's piece count, to check its messages against
+
+	ctx     context.Context // stops waits for bandwidth
+	down    []*limiter      // the peer's own limit, then the torrent's and the client's
+	up      []*limiter
+	traffic *traffic
+}
+
+func newPeer(IP string, Port int, logger log.Logger) *Peer {
+	return &Peer{
+		IP:              IP,
+		Port:            Port,
+		am_choking:      true,
+		am_interested:   false,
+		peer_choking:    true,
+		peer_interested: false,
+		shutdown:        make(chan struct{}),
+		messages:        make(chan WireMessage, MAX_OUTBOX),
+		logger:          logger,
+		ctx:             context.Background(),
+	}
+}
+
+func (p *Peer) String() string {
+	pString := fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return pString
+}
+
+func (p *Peer) ID() string {
+	return p.id
+}
+
+func (p *Peer) AmChoking(choke bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.am_choking = choke
+}
+
+func (p *Peer) GetAmChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.am_choking
+}
+
+func (p *Peer) AmInterested(interest bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.am_interested = interest
+}
+
+func (p *Peer) GetAmInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.am_interested
+}
+
+func (p *Peer) PeerInterested(interest bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peer_interested = interest
+}
+
+func (p *Peer) GetPeerInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peer_interested
+}
+
+func (p *Peer) PeerChoking(choke bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peer_choking = choke
+}
+
+func (p *Peer) GetPeerChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peer_choking
+}
+
+// Connect dials the peer and shakes hands, its loops aren't started until run
+// so nothing it sends is handled before the torrent knows about it.
+func (p *Peer) Connect(hs Handshake) error {
+	dialer := net.Dialer{Timeout: DIAL_TIMEOUT}
+	conn, err := dialer.DialContext(p.ctx, "tcp", p.String())
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	p.setConn(conn)
+	_, err = p.conn.Write(hs.Marshall())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	err = p.rw.Flush()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	r := io.Reader(p.rw)
+	reply, err := Unmarshal(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := checkReply(hs, reply, p.advertisedID); err != nil {
+		conn.Close()
+		return err
+	}
+	p.id = string(reply.PeerId[:])
+	p.outgoing = true
+
+	conn.SetDeadline(time.Time{})
+	level.Debug(p.logger).Log("connected", p.state())
+	return nil
+}
+
+// accept finishes the handshake on a connection the peer made to us, theirs
+// is the handshake they've already sent. Like Connect it leaves starting the
+// loops to run.
+func (p *Peer) accept(conn net.Conn, hs Handshake, theirs *Handshake) error {
+	p.setConn(conn)
+	p.id = string(theirs.PeerId[:])
+	p.outgoing = false
+	if _, err := p.conn.Write(hs.Marshall()); err != nil {
+		return err
+	}
+	if err := p.rw.Flush(); err != nil {
+		return err
+	}
+	level.Debug(p.logger).Log("accepted", p.state())
+	return nil
+}
+
+// setConn starts the peer over on a new connection
+func (p *Peer) setConn(conn net.Conn) {
+	p.conn = conn
+	p.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	p.mu.Lock()
+	p.am_choking = true
+	p.am_interested = false
+	p.peer_choking = true
+	p.peer_interested = false
+	p.mu.Unlock()
+	p.shutdown = make(chan struct{})
+	p.messages = make(chan WireMessage, MAX_OUTBOX)
+	p.dead = make(chan struct{})
+}
+
+// run starts reading and writing messages, what's read goes to msgs
+func (p *Peer) run(msgs chan message) {
+	go p.ParseMsgs(msgs)
+	go p.writeLoop()
+}
+
+// Close stops the peer's loops and hangs up. It waits no more than
+// CLOSE_TIMEOUT for the writer to be free before hanging up under it, so a
+// peer that's stopped reading can't hold up closing the torrent.
+func (p *Peer) Close() {
+	select {
+	case p.shutdown <- struct{}{}:
+	case <-time.After(CLOSE_TIMEOUT):
+		// the write it's stuck in fails once the connection's gone
+		p.conn.Close()
+		p.shutdown <- struct{}{}
+	}
+	<-p.shutdown
+}
+
+// writeLoop sends the messages queued for the peer, as many at once as are
+// waiting, and a keepalive whenever it's gone KEEPALIVE_INTERVAL without one.
+func (p *Peer) writeLoop() {
+	w := newMsgWriter(p.conn)
+	keepalive := time.NewTimer(KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-p.shutdown:
+			level.Debug(p.logger).Log("peer", p.ID(), "msg", "shutting down")
+			// it gets whatever's still queued if it takes it quickly
+			p.batch(w)
+			p.send(w, CLOSE_TIMEOUT)
+			p.conn.Close()
+			close(p.shutdown)
+			return
+		case msg := <-p.messages:
+			p.add(w, msg)
+			p.batch(w)
+		case <-keepalive.C:
+			p.add(w, KeepAlive{})
+		}
+		p.send(w, WRITE_TIMEOUT)
+		if !keepalive.Stop() {
+			select {
+			case <-keepalive.C:
+			default:
+			}
+		}
+		keepalive.Reset(KEEPALIVE_INTERVAL)
+	}
+}
+
+func (p *Peer) ParseMsgs(msgs chan message) {
+	defer close(p.dead)
+	for {
+		// a peer that's gone quiet for too long is hung up on
+		p.conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		m, err := readMessage(p.rw, p.pieces)
+		if err != nil {
+			level.Debug(p.logger).Log("read", err)
+			break
+		}
+		// holding off on the next read pushes back on the peer through TCP
+		n := frameLen(m)
+		if err := waitN(p.ctx, n, p.down...); err != nil {
+			break
+		}
+		p.traffic.received(m, n)
+		if m.Kind() == KPALIVE {
+			continue
+		}
+		select {
+		case msgs <- message{source: p.ID(), WireMessage: m}:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// Message queues msg to be sent without waiting, it's dropped if the
+// connection has died. A peer that lets MAX_OUTBOX messages pile up is too
+// slow to keep and is hung up on.
+func (p *Peer) Message(msg WireMessage) {
+	select {
+	case p.messages <- msg:
+	case <-p.dead:
+	default:
+		level.Debug(p.logger).Log("peer", p, "err", "too slow to take its messages")
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	}
+}
+
+// backlogged is true once the peer's got half an outbox of messages waiting,
+// it isn't asked for anything more until it catches up.
+func (p *Peer) backlogged() bool {
+	return len(p.messages) >= MAX_OUTBOX/2
+}
+
+func (p *Peer) state() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprintf("%s %q choking: %v interested: %v peer choking: %v peer interested: %v",
+		p, p.id, p.am_choking, p.am_interested, p.peer_choking, p.peer_interested)
+}
+
+// add batches msg up in w to be sent
+func (p *Peer) add(w *msgWriter, msg WireMessage) {
+	w.add(msg)
+	p.traffic.sent(msg, frameLen(msg))
+}
+
+// batch adds whatever else is already queued to w, up to about
+// WRITE_BATCH_SIZE
+func (p *Peer) batch(w *msgWriter) {
+	for w.buffered() < WRITE_BATCH_SIZE {
+		select {
+		case msg := <-p.messages:
+			p.add(w, msg)
+		default:
+			return
+		}
+	}
+}
+
+// send writes out everything batched in w once the limits let it through,
+// giving the peer timeout to take it. A peer that doesn't is hung up on, its
+// reader sees the connection die and it's dropped.
+func (p *Peer) send(w *msgWriter, timeout time.Duration) {
+	// this only fails once the torrent's stopping, the batch goes anyway
+	waitN(p.ctx, w.buffered(), p.up...)
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := w.flush(); err != nil {
+		level.Debug(p.logger).Log("write", err)
+		p.conn.Close()
+	}
+}
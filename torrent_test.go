@@ -1,9 +1,11 @@
-package main
+package torgo
 
 import (
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/go-kit/kit/log"
 )
 
 func Test_handleHaveMsg(t *testing.T) {
@@ -20,10 +22,10 @@ func Test_handleHaveMsg(t *testing.T) {
 			tor := &Torrent{
 				PeerPieceLog: newPieceLog(32),
 			}
+			have, _ := decodeMessage(HAVE, tc.payload)
 			msg := message{
-				source:  tc.source,
-				kind:    HAVE,
-				payload: tc.payload,
+				source:      tc.source,
+				WireMessage: have,
 			}
 			tor.handleHave(msg)
 			res := tor.PeerPieceLog.String()
@@ -34,7 +36,7 @@ func Test_handleHaveMsg(t *testing.T) {
 			first := strings.Index(res, "1")
 			_, ok := tor.PeerPieceLog.vector[first][tc.source]
 			if !ok {
-				t.Fatalf("got %s; not stored at %s", tor.PeerPieceLog.vector, ok)
+				t.Fatalf("got %v; not stored at piece %d", tor.PeerPieceLog.vector, first)
 			}
 		})
 	}
@@ -57,12 +59,11 @@ func Test_handleBitfieldMsg(t *testing.T) {
 				PeerPieceLog: newPieceLog(len(tc.payload) * 8),
 			}
 			msg := message{
-				source:  tc.source,
-				kind:    BITFLD,
-				payload: tc.payload,
+				source:      tc.source,
+				WireMessage: Bitfield(tc.payload),
 			}
 			tor.handleBitfield(msg)
-			res := tor.PieceLog.String()
+			res := tor.PeerPieceLog.String()
 			if res != tc.expected {
 				t.Fatalf("got %s; want %s to be stored", res, tc.expected)
 			}
@@ -70,7 +71,7 @@ func Test_handleBitfieldMsg(t *testing.T) {
 			first := strings.Index(res, "1")
 			_, ok := tor.PeerPieceLog.vector[first][tc.source]
 			if !ok {
-				t.Fatalf("got %s; not stored at %s", tor.PeerPieceLog.vector, ok)
+				t.Fatalf("got %v; not stored at piece %d", tor.PeerPieceLog.vector, first)
 			}
 		})
 	}
@@ -103,26 +104,32 @@ func Test_PieceLogString(t *testing.T) {
 
 func Test_sendInterst(t *testing.T) {
 	cases := []struct {
-		id       string
-		expected string
+		name    string
+		payload []byte
+		source  string
 	}{
-		{"boblog123", []byte("\x06"), "00000110"}, {"boblog123", []byte("\x06\xff"), "0000011011111111"},
-		{"boblog123", []byte("\xfe\xff"), "1111111011111111"},
+		{"7th piece", []byte("\x00\x00\x00\x06"), "boblog123"},
+		{"1st piece", []byte("\x00\x00\x00\x00"), "boblog123"},
 	}
 
 	for _, tc := range cases {
-		t.Run(fmt.Sprintf("Test: %s", tc.expected), func(t *testing.T) {
-
+		t.Run(tc.name, func(t *testing.T) {
+			p := &fakePeer{id: tc.source}
 			tor := &Torrent{
-				PieceLog: newPieceLog(32),
+				PeerPieceLog: newPieceLog(32),
+				peerConns:    map[string]ConnPeer{tc.source: p},
+				logger:       log.NewNopLogger(),
 			}
+			have, _ := decodeMessage(HAVE, tc.payload)
 			msg := message{
-				source:  tc.source,
-				kind:    HAVE,
-				payload: tc.payload,
+				source:      tc.source,
+				WireMessage: have,
 			}
 			tor.handleHave(msg)
+			tor.sendInterest(msg)
+			if len(p.sent) != 1 || p.sent[0] != (Interested{}) {
+				t.Errorf("sent %v; want just %v", p.sent, Interested{})
+			}
 		})
 	}
-
 }
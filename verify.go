@@ -0,0 +1,145 @@
+package torgo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"sync"
+)
+
+// checkPiece reads a piece out of storage and compares it to its hash. buf is
+// used to read into if it's big enough.
+func checkPiece(ti *TorrentInfo, p Piecer, index int, buf []byte) bool {
+	length := ti.pieceLen(index)
+	if int64(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	buf = buf[:length]
+	if err := p.Read(index, 0, buf); err != nil {
+		return false
+	}
+	sum := sha1.Sum(buf)
+	return bytes.Equal(sum[:], ti.pieceHash(index))
+}
+
+// recheck hashes the torrent's pieces in storage using workers goroutines and
+// returns the ones that are good. If want isn't nil only the pieces it returns
+// true for are checked, the rest are treated as missing.
+func recheck(ti *TorrentInfo, p Piecer, workers int, want func(int) bool) Bitfield {
+	if workers < 1 {
+		workers = 1
+	}
+	have := newBitfield(ti.pieceCount())
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, ti.PieceLength)
+			for i := range indexes {
+				if checkPiece(ti, p, i, buf) {
+					mu.Lock()
+					have.Set(i)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < ti.pieceCount(); i++ {
+		if want == nil || want(i) {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return have
+}
+
+// FileStatus is how much of a file is covered by good pieces
+type FileStatus struct {
+	Path     string // relative to the download directory
+	Length   int64
+	Verified int64 // bytes in pieces that hashed correctly
+	Missing  bool
+}
+
+func (fs FileStatus) String() string {
+	switch {
+	case fs.Missing:
+		return "missing"
+	case fs.Verified == fs.Length:
+		return "complete"
+	default:
+		return "incomplete"
+	}
+}
+
+// completeness works out per file how many bytes are in pieces we have
+func completeness(ti *TorrentInfo, have Bitfield) []FileStatus {
+	layout := ti.fileLayout()
+	statuses := make([]FileStatus, len(layout))
+	for i, e := range layout {
+		statuses[i] = FileStatus{Path: e.path, Length: e.length}
+		if e.length == 0 {
+			continue
+		}
+		first := int(e.offset / ti.PieceLength)
+		last := int((e.offset + e.length - 1) / ti.PieceLength)
+		for piece := first; piece <= last; piece++ {
+			if !have.Has(piece) {
+				continue
+			}
+			start := int64(piece) * ti.PieceLength
+			end := start + ti.pieceLen(piece)
+			if start < e.offset {
+				start = e.offset
+			}
+			if end > e.offset+e.length {
+				end = e.offset + e.length
+			}
+			statuses[i].Verified += end - start
+		}
+	}
+	return statuses
+}
+
+// VerifyResult is what Verify found on disk
+type VerifyResult struct {
+	Files    []FileStatus // padding files are left out
+	Pieces   int
+	Verified int // pieces that hashed correctly
+}
+
+// Complete is true if every piece checked out
+func (r *VerifyResult) Complete() bool {
+	return r.Verified == r.Pieces
+}
+
+// Verify checks the data for ti against its piece hashes, hashing workers
+// pieces at once. The files are looked for where a client with config keeps
+// them, under IncompleteDir and with IncompleteSuffix on their names if the
+// torrent hasn't finished yet, otherwise under DownloadDir. Nothing is
+// created or changed on disk.
+func Verify(ti *TorrentInfo, config ClientConfig, workers int) (*VerifyResult, error) {
+	layout := ti.fileLayout()
+	info, _ := config.locate(newStorageInfo(ti, config.DownloadDir, layout))
+	p, err := openPiecerFSReadOnly(info.Dir, info.entries(), ti.pieceCount(), int(ti.PieceLength))
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	have := recheck(ti, p, workers, nil)
+	result := &VerifyResult{Pieces: ti.pieceCount(), Verified: have.Count()}
+	for i, st := range completeness(ti, have) {
+		if layout[i].pad {
+			continue
+		}
+		st.Missing = p.files[i] == nil
+		result.Files = append(result.Files, st)
+	}
+	return result, nil
+}
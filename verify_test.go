@@ -0,0 +1,212 @@
+package torgo
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zanadar/torgo/bencode"
+)
+
+// writeMultiFileTorrent lays out files under dir/multi and writes a torrent
+// for them, returning the torrent's path.
+func writeMultiFileTorrent(t *testing.T, dir string, pieceLength int64, files map[string]string) string {
+	var all []byte
+	var list []interface{}
+	for _, name := range []string{"a", "sub/b", "sub/c"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, "multi", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, content...)
+		parts := []interface{}{}
+		for _, part := range strings.Split(name, "/") {
+			parts = append(parts, part)
+		}
+		list = append(list, map[string]interface{}{"length": int64(len(content)), "path": parts})
+	}
+	var pieces []byte
+	for i := int64(0); i < int64(len(all)); i += pieceLength {
+		end := i + pieceLength
+		if end > int64(len(all)) {
+			end = int64(len(all))
+		}
+		sum := sha1.Sum(all[i:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	meta := map[string]interface{}{
+		"announce": "http://localhost/announce",
+		"info": map[string]interface{}{
+			"name":         "multi",
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+			"files":        list,
+		},
+	}
+	torrentPath := filepath.Join(dir, "multi.torrent")
+	f, err := os.Create(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := bencode.NewEncoder(f).Encode(meta); err != nil {
+		t.Fatal(err)
+	}
+	return torrentPath
+}
+
+func Test_Verify(t *testing.T) {
+	files := map[string]string{
+		"a":     "0123456789",
+		"sub/b": "abcdefghijklmno",
+		"sub/c": "",
+	}
+	cases := []struct {
+		name     string
+		mangle   func(dir string)
+		verified int
+		expected []FileStatus
+	}{
+		{"everything there", func(string) {}, 4, []FileStatus{
+			{Path: filepath.Join("multi", "a"), Length: 10, Verified: 10},
+			{Path: filepath.Join("multi", "sub", "b"), Length: 15, Verified: 15},
+			{Path: filepath.Join("multi", "sub", "c")},
+		}},
+		{"corrupt piece spanning files", func(dir string) {
+			ioutil.WriteFile(filepath.Join(dir, "multi", "a"), []byte("012345678X"), 0644)
+		}, 3, []FileStatus{
+			{Path: filepath.Join("multi", "a"), Length: 10, Verified: 8},
+			{Path: filepath.Join("multi", "sub", "b"), Length: 15, Verified: 9},
+			{Path: filepath.Join("multi", "sub", "c")},
+		}},
+		{"missing file", func(dir string) {
+			os.Remove(filepath.Join(dir, "multi", "sub", "b"))
+		}, 1, []FileStatus{
+			{Path: filepath.Join("multi", "a"), Length: 10, Verified: 8},
+			{Path: filepath.Join("multi", "sub", "b"), Length: 15, Missing: true},
+			{Path: filepath.Join("multi", "sub", "c")},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "torgo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			torrentPath := writeMultiFileTorrent(t, dir, 8, files)
+			tc.mangle(dir)
+
+			ti, err := ReadTorrentFile(torrentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := Verify(ti, ClientConfig{DownloadDir: dir}, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Pieces != 4 || result.Verified != tc.verified {
+				t.Errorf("got %d/%d pieces; want %d/4", result.Verified, result.Pieces, tc.verified)
+			}
+			if result.Complete() != (tc.verified == 4) {
+				t.Errorf("got complete %v", result.Complete())
+			}
+			if !reflect.DeepEqual(result.Files, tc.expected) {
+				t.Errorf("got %+v; want %+v", result.Files, tc.expected)
+			}
+		})
+	}
+}
+
+// A torrent that hasn't finished is verified where the client keeps it
+func Test_VerifyIncomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	torrentPath := writeMultiFileTorrent(t, dir, 8, map[string]string{"a": "0123456789", "sub/b": "abcdefghijklmno"})
+	ti, err := ReadTorrentFile(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incomplete := filepath.Join(dir, "incomplete")
+	for _, name := range []string{"a", filepath.Join("sub", "b")} {
+		to := filepath.Join(incomplete, "multi", name+PART_SUFFIX)
+		os.MkdirAll(filepath.Dir(to), 0755)
+		if err := os.Rename(filepath.Join(dir, "multi", name), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := ClientConfig{DownloadDir: dir, IncompleteDir: incomplete, IncompleteSuffix: PART_SUFFIX}
+	result, err := Verify(ti, config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete() {
+		t.Errorf("got %d/%d pieces for the staged files; want them all", result.Verified, result.Pieces)
+	}
+	if result.Files[0].Path != filepath.Join("multi", "a") || result.Files[0].Missing {
+		t.Errorf("got %+v; want multi/a there", result.Files[0])
+	}
+
+	result, err = Verify(ti, ClientConfig{DownloadDir: dir}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Verified != 0 || !result.Files[0].Missing {
+		t.Errorf("found the staged files without being told where they are: %+v", result)
+	}
+}
+
+func Test_PiecerFSSpansFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := []fileEntry{
+		{path: "x/one", length: 3, offset: 0},
+		{path: "x/empty", length: 0, offset: 3},
+		{path: "x/two", length: 5, offset: 3},
+	}
+	p, err := newPiecerFS(dir, entries, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Write(0, 2, []byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if err := p.Read(0, 2, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcd" {
+		t.Errorf("got %q; want %q", got, "abcd")
+	}
+	one, _ := ioutil.ReadFile(filepath.Join(dir, "x", "one"))
+	two, _ := ioutil.ReadFile(filepath.Join(dir, "x", "two"))
+	if string(one) != "\x00\x00a" || string(two) != "bcd" {
+		t.Errorf("got %q and %q on disk", one, two)
+	}
+	if err := p.Read(1, 3, make([]byte, 2)); err == nil {
+		t.Error("expected reading past the end to fail")
+	}
+}
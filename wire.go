@@ -0,0 +1,536 @@
+package torgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// WRITE_BATCH_SIZE is about how many bytes of queued messages a peer's
+	// writer gathers up before putting them on the wire in one go
+	WRITE_BATCH_SIZE = 1 << 16
+	// MAX_OUTBOX is how many messages can wait to go out to a peer, one that
+	// falls that far behind is hung up on rather than holding the torrent up
+	MAX_OUTBOX = 64
+)
+
+var errWrongKind = errors.New("wrong kind of message")
+
+// WireMessage is a typed peer wire message. MarshalBinary gives the whole
+// frame, length prefix and all, and the pointer to each type has an
+// UnmarshalBinary that reads one back.
+type WireMessage interface {
+	Kind() msgID
+	MarshalBinary() ([]byte, error)
+	// payloadLen is how long the message is after its kind byte
+	payloadLen() int
+	// appendPayload adds everything after the kind byte to buf
+	appendPayload(buf []byte) []byte
+}
+
+// frameLen is how many bytes m takes on the wire
+func frameLen(m WireMessage) int {
+	if m.Kind() == KPALIVE {
+		return 4
+	}
+	return 5 + m.payloadLen()
+}
+
+// appendFrame adds m to buf the way it goes on the wire
+func appendFrame(buf []byte, m WireMessage) []byte {
+	if m.Kind() == KPALIVE {
+		return append(buf, 0, 0, 0, 0)
+	}
+	var head [5]byte
+	binary.BigEndian.PutUint32(head[:], uint32(1+m.payloadLen()))
+	head[4] = byte(m.Kind())
+	return m.appendPayload(append(buf, head[:]...))
+}
+
+func marshalFrame(m WireMessage) ([]byte, error) {
+	return appendFrame(make([]byte, 0, frameLen(m)), m), nil
+}
+
+// framePayload checks data is a whole frame of kind and returns what comes
+// after the kind byte
+func framePayload(data []byte, kind msgID) ([]byte, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if kind == KPALIVE {
+		if len(data) != 4 {
+			return nil, errWrongKind
+		}
+		return nil, nil
+	}
+	if len(data) < 5 || msgID(data[4]) != kind {
+		return nil, errWrongKind
+	}
+	return data[5:], nil
+}
+
+func badLength(kind msgID, n int) error {
+	return fmt.Errorf("%v message with a %d byte payload", kind, n)
+}
+
+// noPayload is for the messages that are nothing but their kind
+type noPayload struct{}
+
+func (noPayload) payloadLen() int                 { return 0 }
+func (noPayload) appendPayload(buf []byte) []byte { return buf }
+
+func unmarshalEmpty(data []byte, kind msgID) error {
+	p, err := framePayload(data, kind)
+	if err != nil {
+		return err
+	}
+	if len(p) != 0 {
+		return badLength(kind, len(p))
+	}
+	return nil
+}
+
+type (
+	KeepAlive     struct{ noPayload }
+	Choke         struct{ noPayload }
+	Unchoke       struct{ noPayload }
+	Interested    struct{ noPayload }
+	NotInterested struct{ noPayload }
+	HaveAll       struct{ noPayload } // fast extension
+	HaveNone      struct{ noPayload } // fast extension
+)
+
+func (KeepAlive) Kind() msgID     { return KPALIVE }
+func (Choke) Kind() msgID         { return CHOKE }
+func (Unchoke) Kind() msgID       { return UNCHOKE }
+func (Interested) Kind() msgID    { return INTERST }
+func (NotInterested) Kind() msgID { return UNINTERST }
+func (HaveAll) Kind() msgID       { return HAVEALL }
+func (HaveNone) Kind() msgID      { return HAVENONE }
+
+func (m KeepAlive) MarshalBinary() ([]byte, error)     { return marshalFrame(m) }
+func (m Choke) MarshalBinary() ([]byte, error)         { return marshalFrame(m) }
+func (m Unchoke) MarshalBinary() ([]byte, error)       { return marshalFrame(m) }
+func (m Interested) MarshalBinary() ([]byte, error)    { return marshalFrame(m) }
+func (m NotInterested) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+func (m HaveAll) MarshalBinary() ([]byte, error)       { return marshalFrame(m) }
+func (m HaveNone) MarshalBinary() ([]byte, error)      { return marshalFrame(m) }
+
+func (m *KeepAlive) UnmarshalBinary(data []byte) error     { return unmarshalEmpty(data, KPALIVE) }
+func (m *Choke) UnmarshalBinary(data []byte) error         { return unmarshalEmpty(data, CHOKE) }
+func (m *Unchoke) UnmarshalBinary(data []byte) error       { return unmarshalEmpty(data, UNCHOKE) }
+func (m *Interested) UnmarshalBinary(data []byte) error    { return unmarshalEmpty(data, INTERST) }
+func (m *NotInterested) UnmarshalBinary(data []byte) error { return unmarshalEmpty(data, UNINTERST) }
+func (m *HaveAll) UnmarshalBinary(data []byte) error       { return unmarshalEmpty(data, HAVEALL) }
+func (m *HaveNone) UnmarshalBinary(data []byte) error      { return unmarshalEmpty(data, HAVENONE) }
+
+// pieceIndex is the payload of the messages that are about one piece
+type pieceIndex struct {
+	Index int
+}
+
+func (m pieceIndex) appendPayload(buf []byte) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(m.Index))
+	return append(buf, b[:]...)
+}
+
+func (m *pieceIndex) unmarshal(data []byte, kind msgID) error {
+	p, err := framePayload(data, kind)
+	if err != nil {
+		return err
+	}
+	return m.setPayload(p, kind)
+}
+
+func (m *pieceIndex) setPayload(p []byte, kind msgID) error {
+	if len(p) != 4 {
+		return badLength(kind, len(p))
+	}
+	m.Index = int(binary.BigEndian.Uint32(p))
+	return nil
+}
+
+// Have says the peer has a piece, Suggest and AllowedFast are from the fast
+// extension
+type (
+	Have        pieceIndex
+	Suggest     pieceIndex
+	AllowedFast pieceIndex
+)
+
+func (Have) Kind() msgID        { return HAVE }
+func (Suggest) Kind() msgID     { return SUGGEST }
+func (AllowedFast) Kind() msgID { return ALLOWEDFAST }
+
+func (Have) payloadLen() int        { return 4 }
+func (Suggest) payloadLen() int     { return 4 }
+func (AllowedFast) payloadLen() int { return 4 }
+
+func (m Have) appendPayload(buf []byte) []byte        { return pieceIndex(m).appendPayload(buf) }
+func (m Suggest) appendPayload(buf []byte) []byte     { return pieceIndex(m).appendPayload(buf) }
+func (m AllowedFast) appendPayload(buf []byte) []byte { return pieceIndex(m).appendPayload(buf) }
+
+func (m Have) MarshalBinary() ([]byte, error)        { return marshalFrame(m) }
+func (m Suggest) MarshalBinary() ([]byte, error)     { return marshalFrame(m) }
+func (m AllowedFast) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+
+func (m *Have) UnmarshalBinary(data []byte) error {
+	return (*pieceIndex)(m).unmarshal(data, HAVE)
+}
+
+func (m *Suggest) UnmarshalBinary(data []byte) error {
+	return (*pieceIndex)(m).unmarshal(data, SUGGEST)
+}
+
+func (m *AllowedFast) UnmarshalBinary(data []byte) error {
+	return (*pieceIndex)(m).unmarshal(data, ALLOWEDFAST)
+}
+
+// blockRef is the payload of the messages that are about one block
+type blockRef struct {
+	Index, Begin, Length int
+}
+
+func (m blockRef) appendPayload(buf []byte) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[0:], uint32(m.Index))
+	binary.BigEndian.PutUint32(b[4:], uint32(m.Begin))
+	binary.BigEndian.PutUint32(b[8:], uint32(m.Length))
+	return append(buf, b[:]...)
+}
+
+func (m *blockRef) unmarshal(data []byte, kind msgID) error {
+	p, err := framePayload(data, kind)
+	if err != nil {
+		return err
+	}
+	return m.setPayload(p, kind)
+}
+
+func (m *blockRef) setPayload(p []byte, kind msgID) error {
+	if len(p) != 12 {
+		return badLength(kind, len(p))
+	}
+	m.Index = int(binary.BigEndian.Uint32(p[0:]))
+	m.Begin = int(binary.BigEndian.Uint32(p[4:]))
+	m.Length = int(binary.BigEndian.Uint32(p[8:]))
+	return nil
+}
+
+// Request asks for a block, Cancel takes a request back and Reject, from the
+// fast extension, turns one down
+type (
+	Request blockRef
+	Cancel  blockRef
+	Reject  blockRef
+)
+
+// requestFor asks for b
+func requestFor(b block) Request {
+	return Request{b.index, b.begin, b.length}
+}
+
+// cancelFor takes back a request for b
+func cancelFor(b block) Cancel {
+	return Cancel{b.index, b.begin, b.length}
+}
+
+func (Request) Kind() msgID { return REQ }
+func (Cancel) Kind() msgID  { return CNCL }
+func (Reject) Kind() msgID  { return REJECT }
+
+func (Request) payloadLen() int { return 12 }
+func (Cancel) payloadLen() int  { return 12 }
+func (Reject) payloadLen() int  { return 12 }
+
+func (m Request) appendPayload(buf []byte) []byte { return blockRef(m).appendPayload(buf) }
+func (m Cancel) appendPayload(buf []byte) []byte  { return blockRef(m).appendPayload(buf) }
+func (m Reject) appendPayload(buf []byte) []byte  { return blockRef(m).appendPayload(buf) }
+
+func (m Request) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+func (m Cancel) MarshalBinary() ([]byte, error)  { return marshalFrame(m) }
+func (m Reject) MarshalBinary() ([]byte, error)  { return marshalFrame(m) }
+
+func (m *Request) UnmarshalBinary(data []byte) error {
+	return (*blockRef)(m).unmarshal(data, REQ)
+}
+
+func (m *Cancel) UnmarshalBinary(data []byte) error {
+	return (*blockRef)(m).unmarshal(data, CNCL)
+}
+
+func (m *Reject) UnmarshalBinary(data []byte) error {
+	return (*blockRef)(m).unmarshal(data, REJECT)
+}
+
+// Piece is a block of piece data, Block isn't copied when it's written so it
+// mustn't change until it has been.
+type Piece struct {
+	Index, Begin int
+	Block        []byte
+}
+
+func (Piece) Kind() msgID { return PIECE }
+
+func (m Piece) payloadLen() int { return 8 + len(m.Block) }
+
+func (m Piece) appendPayload(buf []byte) []byte {
+	return append(m.appendHeader(buf), m.Block...)
+}
+
+// appendHeader adds the payload up to the block
+func (m Piece) appendHeader(buf []byte) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[0:], uint32(m.Index))
+	binary.BigEndian.PutUint32(b[4:], uint32(m.Begin))
+	return append(buf, b[:]...)
+}
+
+func (m Piece) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+
+func (m *Piece) UnmarshalBinary(data []byte) error {
+	p, err := framePayload(data, PIECE)
+	if err != nil {
+		return err
+	}
+	return m.setPayload(p)
+}
+
+func (m *Piece) setPayload(p []byte) error {
+	if len(p) < 8 {
+		return badLength(PIECE, len(p))
+	}
+	m.Index = int(binary.BigEndian.Uint32(p[0:]))
+	m.Begin = int(binary.BigEndian.Uint32(p[4:]))
+	m.Block = p[8:]
+	return nil
+}
+
+func (Bitfield) Kind() msgID { return BITFLD }
+
+func (b Bitfield) payloadLen() int { return len(b) }
+
+func (b Bitfield) appendPayload(buf []byte) []byte { return append(buf, b...) }
+
+func (b Bitfield) MarshalBinary() ([]byte, error) { return marshalFrame(b) }
+
+func (b *Bitfield) UnmarshalBinary(data []byte) error {
+	p, err := framePayload(data, BITFLD)
+	if err != nil {
+		return err
+	}
+	*b = append(Bitfield(nil), p...)
+	return nil
+}
+
+// Port is the DHT port of the peer
+type Port struct {
+	Port uint16
+}
+
+func (Port) Kind() msgID { return PORT }
+
+func (Port) payloadLen() int { return 2 }
+
+func (m Port) appendPayload(buf []byte) []byte {
+	return append(buf, byte(m.Port>>8), byte(m.Port))
+}
+
+func (m Port) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+
+func (m *Port) UnmarshalBinary(data []byte) error {
+	p, err := framePayload(data, PORT)
+	if err != nil {
+		return err
+	}
+	return m.setPayload(p)
+}
+
+func (m *Port) setPayload(p []byte) error {
+	if len(p) != 2 {
+		return badLength(PORT, len(p))
+	}
+	m.Port = binary.BigEndian.Uint16(p)
+	return nil
+}
+
+// Extended is a BEP 10 extension message, ID 0 is the extension handshake
+type Extended struct {
+	ID      uint8
+	Payload []byte
+}
+
+func (Extended) Kind() msgID { return EXTENDED }
+
+func (m Extended) payloadLen() int { return 1 + len(m.Payload) }
+
+func (m Extended) appendPayload(buf []byte) []byte {
+	return append(append(buf, m.ID), m.Payload...)
+}
+
+func (m Extended) MarshalBinary() ([]byte, error) { return marshalFrame(m) }
+
+func (m *Extended) UnmarshalBinary(data []byte) error {
+	p, err := framePayload(data, EXTENDED)
+	if err != nil {
+		return err
+	}
+	return m.setPayload(p)
+}
+
+func (m *Extended) setPayload(p []byte) error {
+	if len(p) < 1 {
+		return badLength(EXTENDED, len(p))
+	}
+	m.ID = p[0]
+	m.Payload = p[1:]
+	return nil
+}
+
+// unknownMsg is a kind of message we don't speak, it's read so it can be
+// ignored
+type unknownMsg struct {
+	kind    msgID
+	payload []byte
+}
+
+func (m unknownMsg) Kind() msgID                     { return m.kind }
+func (m unknownMsg) payloadLen() int                 { return len(m.payload) }
+func (m unknownMsg) appendPayload(buf []byte) []byte { return append(buf, m.payload...) }
+func (m unknownMsg) MarshalBinary() ([]byte, error)  { return marshalFrame(m) }
+
+// decodeMessage makes the typed message for kind out of what came after its
+// kind byte, p is kept rather than copied.
+func decodeMessage(kind msgID, p []byte) (WireMessage, error) {
+	var err error
+	switch kind {
+	case CHOKE, UNCHOKE, INTERST, UNINTERST, HAVEALL, HAVENONE:
+		if len(p) != 0 {
+			return nil, badLength(kind, len(p))
+		}
+		switch kind {
+		case CHOKE:
+			return Choke{}, nil
+		case UNCHOKE:
+			return Unchoke{}, nil
+		case INTERST:
+			return Interested{}, nil
+		case UNINTERST:
+			return NotInterested{}, nil
+		case HAVEALL:
+			return HaveAll{}, nil
+		}
+		return HaveNone{}, nil
+	case HAVE:
+		var m Have
+		err = (*pieceIndex)(&m).setPayload(p, kind)
+		return m, err
+	case SUGGEST:
+		var m Suggest
+		err = (*pieceIndex)(&m).setPayload(p, kind)
+		return m, err
+	case ALLOWEDFAST:
+		var m AllowedFast
+		err = (*pieceIndex)(&m).setPayload(p, kind)
+		return m, err
+	case REQ:
+		var m Request
+		err = (*blockRef)(&m).setPayload(p, kind)
+		return m, err
+	case CNCL:
+		var m Cancel
+		err = (*blockRef)(&m).setPayload(p, kind)
+		return m, err
+	case REJECT:
+		var m Reject
+		err = (*blockRef)(&m).setPayload(p, kind)
+		return m, err
+	case PIECE:
+		var m Piece
+		err = m.setPayload(p)
+		return m, err
+	case BITFLD:
+		return Bitfield(p), nil
+	case PORT:
+		var m Port
+		err = m.setPayload(p)
+		return m, err
+	case EXTENDED:
+		var m Extended
+		err = m.setPayload(p)
+		return m, err
+	}
+	return unknownMsg{kind, p}, nil
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, WRITE_BATCH_SIZE)
+		return &buf
+	},
+}
+
+// msgWriter batches messages up to go out in as few writes as it can. The
+// small ones are copied into a pooled buffer, piece blocks are written from
+// where they are.
+type msgWriter struct {
+	w    io.Writer
+	buf  *[]byte // from bufPool, nil while there's nothing batched
+	mark int     // where the part of buf that isn't in bufs yet starts
+	bufs net.Buffers
+	n    int
+}
+
+func newMsgWriter(w io.Writer) *msgWriter {
+	return &msgWriter{w: w}
+}
+
+// add batches m, it's written on the next flush
+func (w *msgWriter) add(m WireMessage) {
+	if w.buf == nil {
+		w.buf = bufPool.Get().(*[]byte)
+	}
+	w.n += frameLen(m)
+	piece, ok := m.(Piece)
+	if !ok {
+		*w.buf = appendFrame(*w.buf, m)
+		return
+	}
+	var head [5]byte
+	binary.BigEndian.PutUint32(head[:], uint32(1+piece.payloadLen()))
+	head[4] = byte(PIECE)
+	*w.buf = piece.appendHeader(append(*w.buf, head[:]...))
+	w.bufs = append(w.bufs, (*w.buf)[w.mark:], piece.Block)
+	w.mark = len(*w.buf)
+}
+
+// buffered is how many bytes are waiting for a flush
+func (w *msgWriter) buffered() int {
+	return w.n
+}
+
+// flush writes everything batched
+func (w *msgWriter) flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	if w.mark < len(*w.buf) {
+		w.bufs = append(w.bufs, (*w.buf)[w.mark:])
+	}
+	bufs := w.bufs
+	_, err := bufs.WriteTo(w.w)
+
+	for i := range w.bufs {
+		w.bufs[i] = nil // don't hang on to blocks
+	}
+	w.bufs = w.bufs[:0]
+	*w.buf = (*w.buf)[:0]
+	bufPool.Put(w.buf)
+	w.buf, w.mark, w.n = nil, 0, 0
+	return err
+}
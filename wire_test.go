@@ -0,0 +1,127 @@
+package torgo
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+func Test_WireMessageRoundTrip(t *testing.T) {
+	cases := []struct {
+		msg WireMessage
+		out encoding.BinaryUnmarshaler
+	}{
+		{KeepAlive{}, &KeepAlive{}},
+		{Choke{}, &Choke{}},
+		{Unchoke{}, &Unchoke{}},
+		{Interested{}, &Interested{}},
+		{NotInterested{}, &NotInterested{}},
+		{Have{Index: 7}, &Have{}},
+		{Bitfield{0xf0, 0x80}, &Bitfield{}},
+		{Request{Index: 1, Begin: BLOCK_SIZE, Length: BLOCK_SIZE}, &Request{}},
+		{Piece{Index: 2, Begin: 16, Block: []byte("some block")}, &Piece{}},
+		{Cancel{Index: 1, Begin: 0, Length: 100}, &Cancel{}},
+		{Port{Port: 6881}, &Port{}},
+		{Suggest{Index: 3}, &Suggest{}},
+		{HaveAll{}, &HaveAll{}},
+		{HaveNone{}, &HaveNone{}},
+		{Reject{Index: 4, Begin: 8, Length: 12}, &Reject{}},
+		{AllowedFast{Index: 5}, &AllowedFast{}},
+		{Extended{ID: 1, Payload: []byte("d1:md6:ut_pexi1eee")}, &Extended{}},
+	}
+	for _, tc := range cases {
+		data, err := tc.msg.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != frameLen(tc.msg) {
+			t.Errorf("%v: marshalled %d bytes; want %d", tc.msg.Kind(), len(data), frameLen(tc.msg))
+		}
+		if err := tc.out.UnmarshalBinary(data); err != nil {
+			t.Errorf("%v: %v", tc.msg.Kind(), err)
+			continue
+		}
+		if got := reflect.ValueOf(tc.out).Elem().Interface(); !reflect.DeepEqual(got, tc.msg) {
+			t.Errorf("%v: got %+v back; want %+v", tc.msg.Kind(), got, tc.msg)
+		}
+
+		read, err := readMessage(bytes.NewReader(data), 0)
+		if err != nil {
+			t.Errorf("%v: %v reading it off the wire", tc.msg.Kind(), err)
+			continue
+		}
+		if !reflect.DeepEqual(read, tc.msg) {
+			t.Errorf("%v: read %+v; want %+v", tc.msg.Kind(), read, tc.msg)
+		}
+	}
+}
+
+func Test_UnmarshalBinaryErrors(t *testing.T) {
+	have, _ := Have{Index: 1}.MarshalBinary()
+	var req Request
+	if err := req.UnmarshalBinary(have); err != errWrongKind {
+		t.Errorf("got %v reading a HAVE as a REQ; want %v", err, errWrongKind)
+	}
+	var h Have
+	if err := h.UnmarshalBinary(have[:len(have)-1]); err == nil {
+		t.Error("read a HAVE that was cut short")
+	}
+	long := frame(HAVE, 0, 0, 0, 1, 2)
+	if err := h.UnmarshalBinary(long); err == nil {
+		t.Error("read a HAVE with a 5 byte payload")
+	}
+	if _, err := decodeMessage(REQ, make([]byte, 8)); err == nil {
+		t.Error("decoded a REQ with an 8 byte payload")
+	}
+	if m, err := decodeMessage(99, []byte{1}); err != nil || m.Kind() != 99 {
+		t.Errorf("got %v, %v for a kind we don't know", m, err)
+	}
+}
+
+func Test_msgWriter(t *testing.T) {
+	block := []byte("a block that's written from where it is")
+	msgs := []WireMessage{
+		Interested{},
+		Request{Index: 0, Begin: 0, Length: BLOCK_SIZE},
+		Piece{Index: 1, Begin: 0, Block: block},
+		Have{Index: 1},
+		KeepAlive{},
+	}
+	var expected []byte
+	for _, m := range msgs {
+		data, _ := m.MarshalBinary()
+		expected = append(expected, data...)
+	}
+
+	var out bytes.Buffer
+	w := newMsgWriter(&out)
+	for _, m := range msgs {
+		w.add(m)
+	}
+	if w.buffered() != len(expected) {
+		t.Errorf("%d bytes buffered; want %d", w.buffered(), len(expected))
+	}
+	if out.Len() != 0 {
+		t.Error("wrote before being flushed")
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("wrote %x; want %x", out.Bytes(), expected)
+	}
+	if w.buffered() != 0 || w.buf != nil || len(w.bufs) != 0 {
+		t.Error("writer kept hold of the batch after flushing it")
+	}
+
+	// it goes again after a flush
+	out.Reset()
+	w.add(Choke{})
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), frame(CHOKE)) {
+		t.Errorf("wrote %x after the first batch", out.Bytes())
+	}
+}